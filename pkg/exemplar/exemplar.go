@@ -22,3 +22,17 @@ type Exemplar struct {
 	HasTs  bool
 	Ts     int64
 }
+
+// Equals compares if the exemplar e is the same as e2. Note that if HasTs
+// is false for both exemplars then the timestamps are not compared.
+func (e Exemplar) Equals(e2 Exemplar) bool {
+	if !labels.Equal(e.Labels, e2.Labels) {
+		return false
+	}
+
+	if (e.HasTs || e2.HasTs) && e.Ts != e2.Ts {
+		return false
+	}
+
+	return e.Value == e2.Value
+}
@@ -0,0 +1,66 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package textparse
+
+import (
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// SeriesCardinality parses b in the given format and returns, per metric
+// name, the number of distinct label sets in the exposition, e.g. for
+// profiling which metrics drive a target's series count. Only the raw series
+// bytes are inspected, no label sets are decoded, so textually different
+// encodings of the same label set (reordered labels, extra whitespace) count
+// as distinct. For OpenMetrics input the usual `# EOF` handling applies:
+// parsing stops there and its absence is an error.
+func SeriesCardinality(b []byte, format Format) (map[string]int, error) {
+	var p Parser
+	switch format {
+	case FormatPrometheus:
+		// NewPromParser appends to its input, so it gets a copy.
+		p = NewPromParser(append([]byte(nil), b...))
+	case FormatOpenMetrics:
+		p = NewOpenMetricsParser(b)
+	default:
+		return nil, errors.Errorf("unsupported format %q", format)
+	}
+
+	counts := map[string]int{}
+	seen := map[string]struct{}{}
+	for {
+		e, err := p.Next()
+		if err == io.EOF {
+			return counts, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if e != EntrySeries {
+			continue
+		}
+		m, _, _ := p.Series()
+		if _, ok := seen[string(m)]; ok {
+			continue
+		}
+		seen[string(m)] = struct{}{}
+
+		i := 0
+		for i < len(m) && m[i] != '{' && m[i] != ' ' && m[i] != '\t' {
+			i++
+		}
+		counts[string(m[:i])]++
+	}
+}
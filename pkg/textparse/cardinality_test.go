@@ -0,0 +1,60 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package textparse
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSeriesCardinality(t *testing.T) {
+	input := `# HELP go_gc_duration_seconds A summary of the GC invocation durations.
+# TYPE go_gc_duration_seconds summary
+go_gc_duration_seconds{quantile="0"} 4.9351e-05
+go_gc_duration_seconds{quantile="0.25"} 7.4241e-05
+go_gc_duration_seconds{quantile="0.5"} 8.3835e-05
+go_gc_duration_seconds{quantile="0.75"} 8.3835e-05
+go_gc_duration_seconds{quantile="1"} 8.3835e-05
+go_gc_duration_seconds_count 99
+# HELP go_goroutines Number of goroutines that currently exist.
+# TYPE go_goroutines gauge
+go_goroutines 33
+go_goroutines 34
+`
+
+	t.Run("prometheus", func(t *testing.T) {
+		counts, err := SeriesCardinality([]byte(input), FormatPrometheus)
+		require.NoError(t, err)
+		require.Equal(t, map[string]int{
+			"go_gc_duration_seconds":       5,
+			"go_gc_duration_seconds_count": 1,
+			"go_goroutines":                1,
+		}, counts)
+	})
+
+	t.Run("openmetrics", func(t *testing.T) {
+		counts, err := SeriesCardinality([]byte(input+"# EOF\n"), FormatOpenMetrics)
+		require.NoError(t, err)
+		require.Equal(t, 5, counts["go_gc_duration_seconds"])
+
+		_, err = SeriesCardinality([]byte(input), FormatOpenMetrics)
+		require.Error(t, err)
+	})
+
+	t.Run("unknown format", func(t *testing.T) {
+		_, err := SeriesCardinality([]byte("a 1\n"), FormatUnknown)
+		require.Error(t, err)
+	})
+}
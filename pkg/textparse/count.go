@@ -0,0 +1,59 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package textparse
+
+import (
+	"bytes"
+
+	"github.com/pkg/errors"
+)
+
+// CountSeries returns the number of sample lines in the exposition b without
+// parsing labels or values: every non-empty line that is not a comment is
+// counted. For OpenMetrics the terminating # EOF trailer is required and not
+// counted. The count matches the number of EntrySeries a full parse of valid
+// input would return, at a fraction of the cost; invalid sample lines are
+// counted too since they are not inspected.
+func CountSeries(b []byte, format Format) (int, error) {
+	if format == FormatUnknown {
+		return 0, errors.New("unknown exposition format")
+	}
+
+	count := 0
+	sawEOF := false
+	for len(b) > 0 {
+		line := b
+		if i := bytes.IndexByte(b, '\n'); i >= 0 {
+			line, b = b[:i], b[i+1:]
+		} else {
+			b = nil
+		}
+		line = bytes.TrimSpace(line)
+		switch {
+		case len(line) == 0:
+		case line[0] == '#':
+			if format == FormatOpenMetrics && bytes.Equal(line, []byte("# EOF")) {
+				sawEOF = true
+			}
+		case sawEOF:
+			return 0, errors.New("unexpected data after # EOF")
+		default:
+			count++
+		}
+	}
+	if format == FormatOpenMetrics && !sawEOF {
+		return 0, errors.New("data does not end with # EOF")
+	}
+	return count, nil
+}
@@ -0,0 +1,47 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package textparse
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+
+	"github.com/pkg/errors"
+)
+
+// Decompress returns the scrape body b decoded according to the given
+// Content-Encoding header value. An empty encoding and "identity" return b
+// unchanged. Unsupported encodings result in an error so callers can surface
+// them instead of feeding compressed bytes to a parser.
+func Decompress(contentEncoding string, b []byte) ([]byte, error) {
+	switch contentEncoding {
+	case "", "identity":
+		return b, nil
+	case "gzip":
+		r, err := gzip.NewReader(bytes.NewReader(b))
+		if err != nil {
+			return nil, errors.Wrap(err, "creating gzip reader")
+		}
+		defer r.Close()
+
+		decoded, err := ioutil.ReadAll(r)
+		if err != nil {
+			return nil, errors.Wrap(err, "decompressing gzip body")
+		}
+		return decoded, nil
+	default:
+		return nil, errors.Errorf("unsupported Content-Encoding %q", contentEncoding)
+	}
+}
@@ -0,0 +1,50 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package textparse
+
+import (
+	"bytes"
+	"compress/gzip"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDecompress(t *testing.T) {
+	input := []byte("# TYPE foo counter\nfoo_total 17.0\n# EOF\n")
+
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	_, err := w.Write(input)
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+
+	decoded, err := Decompress("gzip", buf.Bytes())
+	require.NoError(t, err)
+	require.Equal(t, input, decoded)
+
+	for _, enc := range []string{"", "identity"} {
+		decoded, err := Decompress(enc, input)
+		require.NoError(t, err)
+		require.Equal(t, input, decoded)
+	}
+
+	_, err = Decompress("snappy", input)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), `unsupported Content-Encoding "snappy"`)
+
+	// Garbage input for gzip must fail rather than return bogus bytes.
+	_, err = Decompress("gzip", input)
+	require.Error(t, err)
+}
@@ -14,7 +14,12 @@
 package textparse
 
 import (
+	"bytes"
+	"io"
 	"mime"
+	"strings"
+
+	"github.com/pkg/errors"
 
 	"github.com/prometheus/prometheus/pkg/exemplar"
 	"github.com/prometheus/prometheus/pkg/labels"
@@ -27,6 +32,26 @@ type Parser interface {
 	// of the current sample.
 	Series() ([]byte, *int64, float64)
 
+	// EntryCount returns the number of entries Next has successfully
+	// returned so far, not counting the terminal io.EOF.
+	EntryCount() int
+
+	// Clone returns an independent parser positioned identically to this
+	// one, so callers can look ahead speculatively without disturbing the
+	// original. Both parsers read the same underlying byte slice.
+	Clone() Parser
+
+	// LabelSpans returns the byte range of every name="value" pair of the
+	// current series within the original input, in order of appearance.
+	// Must only be called after Next returned a series entry; the result
+	// is only valid until the next call to Next.
+	LabelSpans() []LabelSpan
+
+	// HasTimestamp returns true if the current sample carries an explicit
+	// timestamp.
+	// Must only be called after Next returned a series entry.
+	HasTimestamp() bool
+
 	// Help returns the metric name and help text in the current entry.
 	// Must only be called after Next returned a help entry.
 	// The returned byte slices become invalid after the next call to Next.
@@ -51,10 +76,48 @@ type Parser interface {
 	// It returns the string from which the metric was parsed.
 	Metric(l *labels.Labels) string
 
+	// MetricInto resets the passed builder and sets the labels of the
+	// current sample on it. It returns the string from which the metric was
+	// parsed. Compared to Metric, it avoids building an intermediate
+	// labels.Labels when the caller feeds the labels into a builder anyway,
+	// e.g. for relabeling.
+	MetricInto(b *labels.Builder) string
+
+	// MetricName returns just the metric name of the current sample, which
+	// is cheaper than materializing the full label set when only the name
+	// is needed.
+	// Must only be called after Next returned a series entry.
+	// The returned byte slice becomes invalid after the next call to Next.
+	MetricName() []byte
+
 	// Exemplar writes the exemplar of the current sample into the passed
 	// exemplar. It returns if an exemplar exists or not.
 	Exemplar(l *exemplar.Exemplar) bool
 
+	// SeriesType returns the type declared for the metric family the
+	// current series belongs to, resolving histogram and summary suffixes
+	// like _bucket or _count to their family name. It returns false if no
+	// type was declared for the family so far.
+	// Must only be called after Next returned a series entry.
+	SeriesType() (MetricType, bool)
+
+	// SkipToNextFamily advances the parser past the remaining entries of
+	// the current metric family, so the following call to Next returns the
+	// first metadata entry of the next family. The skipped lines are not
+	// lexed and no labels are built for them. It returns io.EOF when the
+	// input holds no further family.
+	SkipToNextFamily() error
+
+	// ContentType returns the canonical Content-Type header value of the
+	// format the parser reads, so code re-emitting the parsed exposition
+	// can set the header without hard-coding it.
+	ContentType() string
+
+	// Peek reports what the following call to Next will return, without
+	// advancing the parser: the current entry and its accessors stay
+	// untouched and the next Next returns the peeked entry.
+	Peek() (Entry, error)
+
 	// Next advances the parser to the next sample. It returns false if no
 	// more samples were read or an error occurred.
 	Next() (Entry, error)
@@ -69,6 +132,61 @@ func New(b []byte, contentType string) Parser {
 	return NewPromParser(b)
 }
 
+// LabelSpan describes the byte range of one name="value" pair within the
+// original input: Start is the offset of the first byte of the label name,
+// End the offset one past the closing quote of the value.
+type LabelSpan struct {
+	Name       string
+	Start, End int
+}
+
+// Format is the exposition format of a scraped body, as far as it can be
+// determined from the body alone.
+type Format int
+
+const (
+	// FormatUnknown means the body carries no signal either way, e.g. it
+	// is empty.
+	FormatUnknown Format = iota
+	// FormatPrometheus is the Prometheus text exposition format.
+	FormatPrometheus
+	// FormatOpenMetrics is the OpenMetrics text exposition format.
+	FormatOpenMetrics
+)
+
+func (f Format) String() string {
+	switch f {
+	case FormatPrometheus:
+		return "prometheus"
+	case FormatOpenMetrics:
+		return "openmetrics"
+	}
+	return "unknown"
+}
+
+// DetectFormat sniffs the exposition format of b for when the Content-Type
+// header is missing or wrong. A terminating # EOF trailer or OpenMetrics-only
+// constructs - # UNIT metadata or exemplar comments - identify OpenMetrics;
+// any other non-empty body is assumed to be Prometheus text format. Only
+// cheap byte scans are used, the body is not parsed.
+func DetectFormat(b []byte) Format {
+	if len(bytes.TrimSpace(b)) == 0 {
+		return FormatUnknown
+	}
+	trimmed := bytes.TrimRight(b, "\n")
+	if bytes.HasSuffix(trimmed, []byte("# EOF")) {
+		return FormatOpenMetrics
+	}
+	if bytes.HasPrefix(b, []byte("# UNIT ")) || bytes.Contains(b, []byte("\n# UNIT ")) {
+		return FormatOpenMetrics
+	}
+	// Exemplars are attached to samples as trailing "# {...}" comments.
+	if bytes.Contains(b, []byte(" # {")) {
+		return FormatOpenMetrics
+	}
+	return FormatPrometheus
+}
+
 // Entry represents the type of a parsed entry.
 type Entry int
 
@@ -94,3 +212,100 @@ const (
 	MetricTypeStateset       = MetricType("stateset")
 	MetricTypeUnknown        = MetricType("unknown")
 )
+
+// String returns the OpenMetrics text form of the type, as it appears after
+// the TYPE keyword in an exposition.
+func (t MetricType) String() string {
+	return string(t)
+}
+
+// ParseMetricType converts the OpenMetrics text form of a metric type back
+// into a MetricType. It accepts exactly the values the parser does and
+// returns the same style of error for anything else.
+func ParseMetricType(s string) (MetricType, error) {
+	switch t := MetricType(s); t {
+	case MetricTypeCounter, MetricTypeGauge, MetricTypeHistogram, MetricTypeGaugeHistogram,
+		MetricTypeSummary, MetricTypeInfo, MetricTypeStateset, MetricTypeUnknown:
+		return t, nil
+	}
+	return "", errors.Errorf("invalid metric type %q", s)
+}
+
+// metadataPrefixes are the comment prefixes that introduce a metric family's
+// metadata in either text format.
+var metadataPrefixes = [][]byte{[]byte("# HELP "), []byte("# TYPE "), []byte("# UNIT ")}
+
+// skipToFamilyBoundary scans whole lines of b from offset i for a HELP, TYPE
+// or UNIT line of a metric family other than cur and returns the offset of
+// that line's start. The lines in between are skipped without lexing them.
+// io.EOF is returned when the input ends without another family; for
+// OpenMetrics input the terminal # EOF line is not consumed, so a parser can
+// still process it.
+func skipToFamilyBoundary(b []byte, i int, cur []byte) (int, error) {
+	for i < len(b) {
+		line := b[i:]
+		next := len(b)
+		if j := bytes.IndexByte(line, '\n'); j >= 0 {
+			line = line[:j]
+			next = i + j + 1
+		}
+		if bytes.Equal(line, []byte("# EOF")) {
+			return i, io.EOF
+		}
+		for _, prefix := range metadataPrefixes {
+			if !bytes.HasPrefix(line, prefix) {
+				continue
+			}
+			name := line[len(prefix):]
+			if j := bytes.IndexByte(name, ' '); j >= 0 {
+				name = name[:j]
+			}
+			if !sameMetricFamily(cur, name) {
+				return i, nil
+			}
+			break
+		}
+		i = next
+	}
+	return i, io.EOF
+}
+
+// sameMetricFamily reports whether the series or family name cur belongs to
+// the metric family called name, i.e. cur equals name or name extended by one
+// of the known family suffixes.
+func sameMetricFamily(cur, name []byte) bool {
+	if !bytes.HasPrefix(cur, name) {
+		return false
+	}
+	rest := cur[len(name):]
+	if len(rest) == 0 {
+		return true
+	}
+	for _, suffix := range metricFamilySuffixes {
+		if string(rest) == suffix {
+			return true
+		}
+	}
+	return false
+}
+
+// metricFamilySuffixes are the sample name suffixes that metric families of
+// the histogram, summary, and counter types produce for their series.
+var metricFamilySuffixes = []string{"_bucket", "_count", "_sum", "_created", "_total"}
+
+// seriesFamilyType resolves the type declared for the family a series with
+// the given name belongs to, stripping known family suffixes if the plain
+// name has no declared type.
+func seriesFamilyType(types map[string]MetricType, name string) (MetricType, bool) {
+	if t, ok := types[name]; ok {
+		return t, true
+	}
+	for _, suffix := range metricFamilySuffixes {
+		if strings.HasSuffix(name, suffix) {
+			if t, ok := types[strings.TrimSuffix(name, suffix)]; ok {
+				return t, true
+			}
+		}
+	}
+	return MetricTypeUnknown, false
+}
@@ -0,0 +1,572 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package textparse
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/prometheus/prometheus/pkg/exemplar"
+	"github.com/prometheus/prometheus/pkg/labels"
+)
+
+func TestSeriesTypeOpenMetrics(t *testing.T) {
+	input := `# TYPE go_gc_duration_seconds summary
+go_gc_duration_seconds{quantile="0"} 4.9351e-05
+go_gc_duration_seconds_count 99
+go_gc_duration_seconds_sum 0.2
+# TYPE hh histogram
+hh_bucket{le="+Inf"} 1
+hh_count 1
+hh_sum 3
+hh_created 1520872607.123
+# TYPE foo counter
+foo_total 17.0
+untyped_metric 1
+# EOF
+`
+	exp := []struct {
+		typ   MetricType
+		found bool
+	}{
+		{MetricTypeSummary, true},
+		{MetricTypeSummary, true},
+		{MetricTypeSummary, true},
+		{MetricTypeHistogram, true},
+		{MetricTypeHistogram, true},
+		{MetricTypeHistogram, true},
+		{MetricTypeHistogram, true},
+		{MetricTypeCounter, true},
+		{MetricTypeUnknown, false},
+	}
+
+	p := NewOpenMetricsParser([]byte(input))
+	i := 0
+	for {
+		et, err := p.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		if et != EntrySeries {
+			continue
+		}
+		typ, found := p.SeriesType()
+		require.Equal(t, exp[i].typ, typ, "series %d", i)
+		require.Equal(t, exp[i].found, found, "series %d", i)
+		i++
+	}
+	require.Equal(t, len(exp), i)
+}
+
+func TestSeriesTypeProm(t *testing.T) {
+	input := `# TYPE go_gc_duration_seconds summary
+go_gc_duration_seconds{quantile="0"} 4.9351e-05
+go_gc_duration_seconds_count 99
+# TYPE hh histogram
+hh_bucket{le="+Inf"} 1
+hh_sum 3
+untyped_metric 1
+`
+	exp := []struct {
+		typ   MetricType
+		found bool
+	}{
+		{MetricTypeSummary, true},
+		{MetricTypeSummary, true},
+		{MetricTypeHistogram, true},
+		{MetricTypeHistogram, true},
+		{MetricTypeUnknown, false},
+	}
+
+	p := NewPromParser([]byte(input))
+	i := 0
+	for {
+		et, err := p.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		if et != EntrySeries {
+			continue
+		}
+		typ, found := p.SeriesType()
+		require.Equal(t, exp[i].typ, typ, "series %d", i)
+		require.Equal(t, exp[i].found, found, "series %d", i)
+		i++
+	}
+	require.Equal(t, len(exp), i)
+}
+
+func TestMetricInto(t *testing.T) {
+	for name, p := range map[string]Parser{
+		"prometheus":  NewPromParser([]byte("metric{a=\"b\",foo=\"value\\nwith\\\\escapes\"} 1\n")),
+		"openmetrics": NewOpenMetricsParser([]byte("metric{a=\"b\",foo=\"value\\nwith\\\\escapes\"} 1\n# EOF\n")),
+	} {
+		et, err := p.Next()
+		require.NoError(t, err, name)
+		require.Equal(t, EntrySeries, et, name)
+
+		// Pre-populate the builder to verify it is reset first.
+		b := labels.NewBuilder(labels.FromStrings("stale", "leftover"))
+
+		var exp labels.Labels
+		expStr := p.Metric(&exp)
+
+		require.Equal(t, expStr, p.MetricInto(b), name)
+		require.Equal(t, exp, b.Labels(), name)
+	}
+}
+
+func TestMetricName(t *testing.T) {
+	for name, p := range map[string]Parser{
+		"prometheus":  NewPromParser([]byte("metric_total{a=\"b\"} 1\nsome:aggregate:rate5m 2\n")),
+		"openmetrics": NewOpenMetricsParser([]byte("metric_total{a=\"b\"} 1\nsome:aggregate:rate5m 2\n# EOF\n")),
+	} {
+		exp := []string{"metric_total", "some:aggregate:rate5m"}
+		i := 0
+		for {
+			et, err := p.Next()
+			if err == io.EOF {
+				break
+			}
+			require.NoError(t, err)
+			if et != EntrySeries {
+				continue
+			}
+			require.Equal(t, exp[i], string(p.MetricName()), "%s: series %d", name, i)
+
+			var lset labels.Labels
+			p.Metric(&lset)
+			require.Equal(t, lset.Get(labels.MetricName), string(p.MetricName()), "%s: series %d", name, i)
+			i++
+		}
+		require.Equal(t, len(exp), i, name)
+	}
+}
+
+func TestHasTimestamp(t *testing.T) {
+	for name, p := range map[string]Parser{
+		"prometheus":  NewPromParser([]byte("metric_no_ts 1\nmetric_ts 1 123\n")),
+		"openmetrics": NewOpenMetricsParser([]byte("metric_no_ts 1\nmetric_ts 1 123.123\n# EOF\n")),
+	} {
+		exp := []bool{false, true}
+		i := 0
+		for {
+			et, err := p.Next()
+			if err == io.EOF {
+				break
+			}
+			require.NoError(t, err)
+			if et != EntrySeries {
+				continue
+			}
+			require.Equal(t, exp[i], p.HasTimestamp(), "%s: series %d", name, i)
+			_, ts, _ := p.Series()
+			require.Equal(t, exp[i], ts != nil, "%s: series %d", name, i)
+			i++
+		}
+		require.Equal(t, len(exp), i, name)
+	}
+}
+
+func TestParserInterface(t *testing.T) {
+	// Both parsers must be drivable through the Parser interface over
+	// equivalent input, including the no-op Exemplar of the Prometheus
+	// parser.
+	input := "# HELP foo_total help text\n# TYPE foo_total counter\nfoo_total{a=\"b\"} 17.0 1234568\n"
+	parsers := map[string]Parser{
+		"prometheus":  NewPromParser([]byte(input)),
+		"openmetrics": NewOpenMetricsParser([]byte(strings.Replace(input, "1234568", "1234.568", 1) + "# EOF\n")),
+	}
+
+	for name, p := range parsers {
+		var (
+			series  int
+			lset    labels.Labels
+			e       exemplar.Exemplar
+			entries []Entry
+		)
+		for {
+			et, err := p.Next()
+			if err == io.EOF {
+				break
+			}
+			require.NoError(t, err, name)
+			entries = append(entries, et)
+
+			switch et {
+			case EntryHelp:
+				m, h := p.Help()
+				require.Equal(t, "foo_total", string(m), name)
+				require.Equal(t, "help text", string(h), name)
+			case EntryType:
+				m, typ := p.Type()
+				require.Equal(t, "foo_total", string(m), name)
+				require.Equal(t, MetricTypeCounter, typ, name)
+			case EntrySeries:
+				series++
+				_, ts, v := p.Series()
+				require.NotNil(t, ts, name)
+				require.Equal(t, int64(1234568), *ts, name)
+				require.Equal(t, 17.0, v, name)
+
+				lset = lset[:0]
+				p.Metric(&lset)
+				require.Equal(t, labels.FromStrings("__name__", "foo_total", "a", "b"), lset, name)
+
+				// Neither input carries an exemplar; the Prometheus
+				// parser never does.
+				require.False(t, p.Exemplar(&e), name)
+			}
+		}
+		require.Equal(t, []Entry{EntryHelp, EntryType, EntrySeries}, entries, name)
+		require.Equal(t, 1, series, name)
+	}
+}
+
+func TestEntryCount(t *testing.T) {
+	f, err := ioutil.ReadFile("promtestdata.txt")
+	require.NoError(t, err)
+
+	for name, p := range map[string]Parser{
+		"prometheus":  NewPromParser(f),
+		"openmetrics": NewOpenMetricsParser([]byte("# TYPE foo counter\nfoo_total 17.0\nbar 1\n# EOF\n")),
+	} {
+		require.Equal(t, 0, p.EntryCount(), name)
+		expected := 0
+		for {
+			_, err := p.Next()
+			if err == io.EOF {
+				break
+			}
+			require.NoError(t, err, name)
+			expected++
+		}
+		require.Equal(t, expected, p.EntryCount(), name)
+		require.NotZero(t, expected, name)
+	}
+}
+
+func TestClone(t *testing.T) {
+	input := `# HELP go_goroutines Number of goroutines.
+# TYPE go_goroutines gauge
+go_goroutines 33
+go_gc_duration_seconds{quantile="0.5"} 0.05
+up 1
+`
+	collect := func(p Parser) []string {
+		var out []string
+		for {
+			e, err := p.Next()
+			if err == io.EOF {
+				break
+			}
+			require.NoError(t, err)
+			if e != EntrySeries {
+				continue
+			}
+			var lset labels.Labels
+			p.Metric(&lset)
+			out = append(out, lset.String())
+		}
+		return out
+	}
+
+	p := NewPromParser([]byte(input))
+	// Advance past the metadata and the first sample.
+	for i := 0; i < 3; i++ {
+		_, err := p.Next()
+		require.NoError(t, err)
+	}
+
+	// Advancing the clone to EOF must not disturb the original.
+	clone := p.Clone()
+	require.Equal(t, p.EntryCount(), clone.EntryCount())
+	rest := collect(clone)
+	require.Equal(t, []string{
+		`{__name__="go_gc_duration_seconds", quantile="0.5"}`,
+		`{__name__="up"}`,
+	}, rest)
+
+	// The original still reports the entry it was positioned on...
+	var lset labels.Labels
+	p.Metric(&lset)
+	require.Equal(t, `{__name__="go_goroutines"}`, lset.String())
+	// ...and parses the remaining entries on its own.
+	require.Equal(t, rest, collect(p))
+}
+
+func TestCloneOpenMetrics(t *testing.T) {
+	input := "# TYPE a counter\na_total{x=\"1\"} 1\na_total{x=\"2\"} 2\n# EOF\n"
+	p := NewOpenMetricsParser([]byte(input), WithStrictOpenMetrics10())
+	for i := 0; i < 2; i++ {
+		_, err := p.Next()
+		require.NoError(t, err)
+	}
+
+	// The strict-mode state is copied, not shared: poisoning the clone's
+	// duplicate tracking trips the clone without affecting the original.
+	clone := p.Clone()
+	om := clone.(*OpenMetricsParser)
+	om.strictSeries[`a_total{x="2"}`] = struct{}{}
+	_, err := clone.Next()
+	require.Error(t, err)
+
+	for {
+		if _, err := p.Next(); err == io.EOF {
+			break
+		} else {
+			require.NoError(t, err)
+		}
+	}
+}
+
+func TestSkipToNextFamily(t *testing.T) {
+	input := `# HELP go_gc_duration_seconds A summary of the GC invocation durations.
+# TYPE go_gc_duration_seconds summary
+go_gc_duration_seconds{quantile="0"} 4.9351e-05
+go_gc_duration_seconds{quantile="0.5"} 5.0e-05
+go_gc_duration_seconds_sum 0.0003
+go_gc_duration_seconds_count 9
+# HELP go_goroutines Number of goroutines that currently exist.
+# TYPE go_goroutines gauge
+go_goroutines 33
+`
+	t.Run("prometheus", func(t *testing.T) {
+		p := NewPromParser([]byte(input))
+
+		// Position on the first family's first sample, then skip it.
+		for i := 0; i < 3; i++ {
+			_, err := p.Next()
+			require.NoError(t, err)
+		}
+		require.NoError(t, p.SkipToNextFamily())
+
+		e, err := p.Next()
+		require.NoError(t, err)
+		require.Equal(t, EntryHelp, e)
+		name, _ := p.Help()
+		require.Equal(t, "go_goroutines", string(name))
+
+		// The last family has no successor.
+		require.Equal(t, io.EOF, p.SkipToNextFamily())
+	})
+
+	t.Run("openmetrics", func(t *testing.T) {
+		p := NewOpenMetricsParser([]byte(input + "# EOF\n"))
+
+		// Skipping from the very start lands on the first metadata entry.
+		require.NoError(t, p.SkipToNextFamily())
+		e, err := p.Next()
+		require.NoError(t, err)
+		require.Equal(t, EntryHelp, e)
+		name, _ := p.Help()
+		require.Equal(t, "go_gc_duration_seconds", string(name))
+
+		require.NoError(t, p.SkipToNextFamily())
+		e, err = p.Next()
+		require.NoError(t, err)
+		require.Equal(t, EntryHelp, e)
+		name, _ = p.Help()
+		require.Equal(t, "go_goroutines", string(name))
+
+		// The terminal # EOF marker is left for Next to consume.
+		require.Equal(t, io.EOF, p.SkipToNextFamily())
+		_, err = p.Next()
+		require.Equal(t, io.EOF, err)
+	})
+}
+
+func TestMetricTypeRoundTrip(t *testing.T) {
+	for _, typ := range []MetricType{
+		MetricTypeCounter,
+		MetricTypeGauge,
+		MetricTypeHistogram,
+		MetricTypeGaugeHistogram,
+		MetricTypeSummary,
+		MetricTypeInfo,
+		MetricTypeStateset,
+		MetricTypeUnknown,
+	} {
+		parsed, err := ParseMetricType(typ.String())
+		require.NoError(t, err)
+		require.Equal(t, typ, parsed)
+	}
+
+	_, err := ParseMetricType("untyped")
+	require.EqualError(t, err, `invalid metric type "untyped"`)
+	_, err = ParseMetricType("counter ")
+	require.EqualError(t, err, `invalid metric type "counter "`)
+}
+
+func TestDetectFormat(t *testing.T) {
+	// promtestdata.txt ends in # EOF so it doubles as OpenMetrics input
+	// in other tests; without that trailer it is a plain Prometheus body.
+	body, err := ioutil.ReadFile("promtestdata.txt")
+	require.NoError(t, err)
+	require.Equal(t, FormatOpenMetrics, DetectFormat(body))
+
+	prom := bytes.TrimSuffix(body, []byte("# EOF\n"))
+	require.Equal(t, FormatPrometheus, DetectFormat(prom))
+
+	// OpenMetrics-only constructs are recognized even without the # EOF
+	// trailer, e.g. on a truncated body.
+	require.Equal(t, FormatOpenMetrics, DetectFormat([]byte("# TYPE foo counter\n# UNIT foo seconds\nfoo_total 1\n")))
+	require.Equal(t, FormatOpenMetrics, DetectFormat([]byte("foo_total 17 # {trace_id=\"abc\"} 0.5\n")))
+
+	require.Equal(t, FormatUnknown, DetectFormat(nil))
+	require.Equal(t, FormatUnknown, DetectFormat([]byte("\n")))
+	require.Equal(t, "openmetrics", FormatOpenMetrics.String())
+}
+
+func TestLabelSpans(t *testing.T) {
+	series := `go_gc_duration_seconds{quantile="0.5",a="b"}`
+	input := series + " 0.05\n"
+
+	check := func(t *testing.T, p Parser) {
+		e, err := p.Next()
+		require.NoError(t, err)
+		require.Equal(t, EntrySeries, e)
+
+		spans := p.LabelSpans()
+		require.Len(t, spans, 2)
+		require.Equal(t, "quantile", spans[0].Name)
+		require.Equal(t, `quantile="0.5"`, input[spans[0].Start:spans[0].End])
+		require.Equal(t, "a", spans[1].Name)
+		require.Equal(t, `a="b"`, input[spans[1].Start:spans[1].End])
+	}
+
+	t.Run("prometheus", func(t *testing.T) {
+		check(t, NewPromParser([]byte(input)))
+	})
+	t.Run("openmetrics", func(t *testing.T) {
+		check(t, NewOpenMetricsParser([]byte(input+"# EOF\n")))
+	})
+}
+
+func TestCountSeries(t *testing.T) {
+	body, err := ioutil.ReadFile("promtestdata.txt")
+	require.NoError(t, err)
+
+	// Establish the expected count with a full parse. NewPromParser
+	// appends to its input, so give it its own copy.
+	expected := 0
+	p := NewPromParser(append([]byte(nil), bytes.TrimSuffix(body, []byte("# EOF\n"))...))
+	for {
+		e, err := p.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		if e == EntrySeries {
+			expected++
+		}
+	}
+
+	// The body ends in # EOF, so it counts as either format.
+	got, err := CountSeries(body, FormatOpenMetrics)
+	require.NoError(t, err)
+	require.Equal(t, expected, got)
+
+	got, err = CountSeries(body, FormatPrometheus)
+	require.NoError(t, err)
+	require.Equal(t, expected, got)
+
+	// OpenMetrics requires the trailer.
+	_, err = CountSeries([]byte("foo_total 1\n"), FormatOpenMetrics)
+	require.Error(t, err)
+	_, err = CountSeries([]byte("# EOF\nfoo_total 1\n"), FormatOpenMetrics)
+	require.Error(t, err)
+	_, err = CountSeries(nil, FormatUnknown)
+	require.Error(t, err)
+}
+
+func BenchmarkCountSeries(b *testing.B) {
+	body, err := ioutil.ReadFile("promtestdata.txt")
+	require.NoError(b, err)
+
+	b.Run("count", func(b *testing.B) {
+		b.SetBytes(int64(len(body)))
+		for i := 0; i < b.N; i++ {
+			if _, err := CountSeries(body, FormatPrometheus); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("full-parse", func(b *testing.B) {
+		b.SetBytes(int64(len(body)))
+		for i := 0; i < b.N; i++ {
+			p := NewPromParser(body)
+			var err error
+			for err == nil {
+				_, err = p.Next()
+			}
+			if err != io.EOF {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestContentType(t *testing.T) {
+	require.Equal(t, "text/plain; version=0.0.4; charset=utf-8", NewPromParser(nil).ContentType())
+	require.Equal(t, "application/openmetrics-text; version=1.0.0; charset=utf-8", NewOpenMetricsParser(nil).ContentType())
+}
+
+func TestPeek(t *testing.T) {
+	input := "# HELP go_goroutines Number of goroutines that currently exist.\n"
+	input += "# TYPE go_goroutines gauge\n"
+	input += "go_goroutines 33\n"
+
+	for name, p := range map[string]Parser{
+		"prometheus":  NewPromParser([]byte(input)),
+		"openmetrics": NewOpenMetricsParser([]byte(input + "# EOF\n")),
+	} {
+		t.Run(name, func(t *testing.T) {
+			e, err := p.Next()
+			require.NoError(t, err)
+			require.Equal(t, EntryHelp, e)
+
+			// Peek across the metadata boundary, then again mid-metadata.
+			e, err = p.Peek()
+			require.NoError(t, err)
+			require.Equal(t, EntryType, e)
+
+			// The current entry is untouched by the peek.
+			m, h := p.Help()
+			require.Equal(t, "go_goroutines", string(m))
+			require.Equal(t, "Number of goroutines that currently exist.", string(h))
+
+			e, err = p.Next()
+			require.NoError(t, err)
+			require.Equal(t, EntryType, e)
+
+			e, err = p.Peek()
+			require.NoError(t, err)
+			require.Equal(t, EntrySeries, e)
+
+			e, err = p.Next()
+			require.NoError(t, err)
+			require.Equal(t, EntrySeries, e)
+			_, _, v := p.Series()
+			require.Equal(t, 33.0, v)
+		})
+	}
+}
@@ -81,26 +81,275 @@ func (l *openMetricsLexer) Error(es string) {
 // OpenMetrics text exposition format.
 // This is based on the working draft https://docs.google.com/document/u/1/d/1KwV0mAXwwbvvifBvDKH_LU1YjyXE_wxCkHNoCGq1GX0/edit
 type OpenMetricsParser struct {
-	l       *openMetricsLexer
-	series  []byte
-	text    []byte
-	mtype   MetricType
-	val     float64
-	ts      int64
-	hasTS   bool
-	start   int
-	offsets []int
+	l         *openMetricsLexer
+	series    []byte
+	text      []byte
+	mtype     MetricType
+	types     map[string]MetricType
+	val       float64
+	ts        int64
+	hasTS     bool
+	start     int
+	offsets   []int
+	entries   int
+	lastEntry Entry
 
 	eOffsets      []int
 	exemplar      []byte
 	exemplarVal   float64
 	exemplarTs    int64
 	hasExemplarTs bool
+
+	// maxLabelsPerSeries caps the number of labels parsed per series, not
+	// counting the metric name. Zero means unlimited.
+	maxLabelsPerSeries int
+
+	// Buffered buckets and counts of the histogram family currently being
+	// read, keyed by the series' labels without "le". Only populated when
+	// checkHistogramConsistency is set and histName is non-empty.
+	checkHistogramConsistency bool
+	histName                  string
+	histBuckets               map[string][]histBucket
+	histCounts                map[string]float64
+
+	// Buffered quantiles, sum and count of the summary family currently
+	// being read, and the aggregate of the last completed one. Only
+	// populated when aggregateSummaries is set.
+	aggregateSummaries bool
+	sumName            string
+	sumQuantiles       []SummaryQuantile
+	sumSum             float64
+	sumCount           uint64
+	lastSummary        summaryAggregate
+
+	// eofOffset is the byte offset of the terminal # EOF marker, or -1
+	// while it has not been reached yet.
+	eofOffset int
+
+	// strict enables the OpenMetrics 1.0 conformance checks of
+	// WithStrictOpenMetrics10. strictSeries records every series seen so
+	// duplicates can be detected; strictSampled records the metric names
+	// samples were seen for, to catch late metadata.
+	strict        bool
+	strictSeries  map[string]struct{}
+	strictSampled map[string]struct{}
+
+	// seenValues tracks the value of every series seen in the current
+	// document when rejectDuplicates is set. Cleared on # EOF.
+	rejectDuplicates bool
+	seenValues       map[string]float64
+
+	// collectWarnings enables WithWarnings. warnedUntyped tracks which
+	// metric names were already reported so each one warns only once.
+	collectWarnings bool
+	warnings        []string
+	warnedUntyped   map[string]struct{}
+
+	// partialInput makes errors at the very end of the input terminate
+	// parsing like a clean EOF. See WithPartialInput.
+	partialInput bool
+
+	// metadataOnly makes Next skip sample lines without parsing them. See
+	// WithMetadataOnly.
+	metadataOnly bool
+
+	requireTypeBeforeSamples bool
+	// declaredTypes holds the names of all metric families for which the
+	// document declares a type anywhere, including after their samples.
+	// It is only populated when requireTypeBeforeSamples is set.
+	declaredTypes map[string]struct{}
+}
+
+// OpenMetricsOption configures the behavior of an OpenMetricsParser.
+type OpenMetricsOption func(*OpenMetricsParser)
+
+// WithRequireTypeBeforeSamples makes Next return an error for any series
+// belonging to a metric family whose # TYPE line only appears later in the
+// document. Families for which the document declares no type at all are
+// still accepted.
+func WithRequireTypeBeforeSamples() OpenMetricsOption {
+	return func(p *OpenMetricsParser) {
+		p.requireTypeBeforeSamples = true
+		p.declaredTypes = map[string]struct{}{}
+
+		// Collect the names of all families with a type declaration so
+		// samples of families that are typed later in the document can
+		// be told apart from entirely untyped ones.
+		typePrefix := []byte("# TYPE ")
+		for b := p.l.b; len(b) > 0; {
+			line := b
+			if i := bytes.IndexByte(b, '\n'); i >= 0 {
+				line, b = b[:i], b[i+1:]
+			} else {
+				b = nil
+			}
+			if !bytes.HasPrefix(line, typePrefix) {
+				continue
+			}
+			name := line[len(typePrefix):]
+			if i := bytes.IndexByte(name, ' '); i >= 0 {
+				name = name[:i]
+			}
+			p.declaredTypes[string(name)] = struct{}{}
+		}
+	}
+}
+
+// WithCaseInsensitiveKeywords makes the parser accept the HELP, TYPE, UNIT
+// and EOF keywords in any case, e.g. `# type foo counter`, as some
+// non-conformant exporters emit them in lowercase. It works by uppercasing
+// the keywords in a copy of the input before parsing, so offsets are
+// unchanged. Note that an ordinary comment starting with one of the keywords
+// in a different case is then read as metadata. The default, per the
+// specification, accepts only uppercase keywords.
+func WithCaseInsensitiveKeywords() OpenMetricsOption {
+	return func(p *OpenMetricsParser) {
+		b := append([]byte(nil), p.l.b...)
+		for i := 0; i < len(b); {
+			if b[i] == '#' {
+				j := i + 1
+				for j < len(b) && (b[j] == ' ' || b[j] == '\t') {
+					j++
+				}
+				for _, kw := range [][]byte{[]byte("HELP"), []byte("TYPE"), []byte("UNIT"), []byte("EOF")} {
+					k := j + len(kw)
+					if k > len(b) || !bytes.EqualFold(b[j:k], kw) {
+						continue
+					}
+					// Only a whole word followed by a separator or the
+					// end of the line is a keyword.
+					if k == len(b) || b[k] == ' ' || b[k] == '\t' || b[k] == '\n' {
+						copy(b[j:k], kw)
+					}
+					break
+				}
+			}
+			n := bytes.IndexByte(b[i:], '\n')
+			if n < 0 {
+				break
+			}
+			i += n + 1
+		}
+		p.l.b = b
+	}
+}
+
+// histBucket is one buffered _bucket sample of a histogram family.
+type histBucket struct {
+	le float64
+	v  float64
+}
+
+// WithHistogramConsistencyCheck makes Next validate classic histograms once a
+// full family has been read, i.e. at the next family's metadata or at # EOF.
+// A family fails validation if its _bucket values are not non-decreasing by
+// "le" or if the +Inf bucket does not equal _count. Bucket series are grouped
+// by their labels without "le", so families with several histogram series are
+// checked per series.
+func WithHistogramConsistencyCheck() OpenMetricsOption {
+	return func(p *OpenMetricsParser) {
+		p.checkHistogramConsistency = true
+	}
+}
+
+// WithStrictOpenMetrics10 tightens validation to the letter of the
+// OpenMetrics 1.0 specification for conformance testing. It makes Next
+// return a specific, descriptive error for duplicate samples, for metadata
+// appearing after samples of its family and for a trailing comma in a label
+// set, all of which the parser otherwise tolerates or reports generically.
+// The terminal # EOF marker is required regardless of this option.
+func WithStrictOpenMetrics10() OpenMetricsOption {
+	return func(p *OpenMetricsParser) {
+		p.strict = true
+		p.strictSeries = map[string]struct{}{}
+		p.strictSampled = map[string]struct{}{}
+	}
+}
+
+// WithRejectDuplicateSeries makes the parser reject a series appearing more
+// than once in the same document with differing values, which OpenMetrics
+// forbids; identical repeats are tolerated. The set of seen series is cleared
+// when the # EOF marker is reached. Unlike the duplicate check of
+// WithStrictOpenMetrics10, repeats are compared by value rather than rejected
+// outright.
+func WithRejectDuplicateSeries() OpenMetricsOption {
+	return func(p *OpenMetricsParser) {
+		p.rejectDuplicates = true
+		p.seenValues = map[string]float64{}
+	}
+}
+
+// WithWarnings makes the parser collect non-fatal observations about inputs
+// that parse fine but point at sloppy exporters, e.g. samples without a
+// preceding # TYPE line or help text with trailing whitespace. The collected
+// warnings are available from Warnings, e.g. for the scrape loop to log.
+func WithWarnings() OpenMetricsOption {
+	return func(p *OpenMetricsParser) {
+		p.collectWarnings = true
+		p.warnedUntyped = map[string]struct{}{}
+	}
+}
+
+// SummaryQuantile is one quantile of an aggregated summary family, as
+// returned by Summary.
+type SummaryQuantile struct {
+	Q, V float64
+}
+
+type summaryAggregate struct {
+	name      []byte
+	quantiles []SummaryQuantile
+	sum       float64
+	count     uint64
+}
+
+// WithSummaryAggregation makes the parser group each summary family's
+// quantile series, _sum and _count as it reads them, exposing the completed
+// family through Summary. Entries are still returned one by one.
+func WithSummaryAggregation() OpenMetricsOption {
+	return func(p *OpenMetricsParser) {
+		p.aggregateSummaries = true
+	}
+}
+
+// WithMetadataOnly makes Next return only metadata and comment entries,
+// skipping sample lines without tokenizing them, building labels or parsing
+// values. This is considerably cheaper than full parsing when only the
+// # HELP/# TYPE/# UNIT lines are of interest. Series, Metric and Exemplar
+// must not be called on a parser in this mode.
+func WithMetadataOnly() OpenMetricsOption {
+	return func(p *OpenMetricsParser) {
+		p.metadataOnly = true
+	}
+}
+
+// WithPartialInput makes Next treat a truncated input, e.g. from a
+// connection dropped mid-scrape, as terminated: an error caused by the input
+// ending in an incomplete trailing line is reported as io.EOF, discarding
+// only the incomplete entry. Errors before the point of truncation are
+// unaffected. This also waives the requirement that the data ends in # EOF.
+func WithPartialInput() OpenMetricsOption {
+	return func(p *OpenMetricsParser) {
+		p.partialInput = true
+	}
+}
+
+// WithMaxLabelsPerSeries makes Next return an error as soon as a series has
+// more than n labels, not counting the metric name, before the labels are
+// materialized. A limit of 0 means unlimited and is the default.
+func WithMaxLabelsPerSeries(n int) OpenMetricsOption {
+	return func(p *OpenMetricsParser) {
+		p.maxLabelsPerSeries = n
+	}
 }
 
 // NewOpenMetricsParser returns a new parser of the byte slice.
-func NewOpenMetricsParser(b []byte) Parser {
-	return &OpenMetricsParser{l: &openMetricsLexer{b: b}}
+func NewOpenMetricsParser(b []byte, opts ...OpenMetricsOption) Parser {
+	p := &OpenMetricsParser{l: &openMetricsLexer{b: b}, eofOffset: -1, lastEntry: EntryInvalid}
+	for _, opt := range opts {
+		opt(p)
+	}
+	return p
 }
 
 // Series returns the bytes of the series, the timestamp if set, and the value
@@ -113,6 +362,114 @@ func (p *OpenMetricsParser) Series() ([]byte, *int64, float64) {
 	return p.series, nil, p.val
 }
 
+// HasTimestamp returns true if the current sample carries an explicit
+// timestamp.
+// Must only be called after Next returned a series entry.
+func (p *OpenMetricsParser) HasTimestamp() bool {
+	return p.hasTS
+}
+
+// EntryCount returns the number of entries Next has successfully returned so
+// far, not counting the terminal io.EOF. It saves callers that report
+// progress over large inputs from keeping their own counter.
+func (p *OpenMetricsParser) EntryCount() int {
+	return p.entries
+}
+
+// LabelSpans returns the byte range of every name="value" pair of the current
+// series within the original input, in order of appearance, e.g. to highlight
+// individual labels in raw exposition text. Must only be called after Next
+// returned a series entry; the result is only valid until the next call to
+// Next.
+func (p *OpenMetricsParser) LabelSpans() []LabelSpan {
+	spans := make([]LabelSpan, 0, (len(p.offsets)-1)/4)
+	for i := 1; i < len(p.offsets); i += 4 {
+		spans = append(spans, LabelSpan{
+			Name:  string(p.series[p.offsets[i]-p.start : p.offsets[i+1]-p.start]),
+			Start: p.offsets[i],
+			End:   p.offsets[i+3] + 1,
+		})
+	}
+	return spans
+}
+
+// Clone returns an independent copy of the parser positioned identically.
+// The input byte slice is shared, everything else - including the state of
+// the opt-in validation modes - is copied so advancing either parser leaves
+// the other untouched.
+func (p *OpenMetricsParser) Clone() Parser {
+	c := *p
+	l := *p.l
+	c.l = &l
+	c.offsets = append([]int(nil), p.offsets...)
+	c.eOffsets = append([]int(nil), p.eOffsets...)
+	c.sumQuantiles = append([]SummaryQuantile(nil), p.sumQuantiles...)
+	c.exemplar = append([]byte(nil), p.exemplar...)
+	c.warnings = append([]string(nil), p.warnings...)
+	c.types = copyTypeMap(p.types)
+	c.histCounts = copyFloatMap(p.histCounts)
+	c.strictSeries = copySet(p.strictSeries)
+	c.seenValues = copyFloatMap(p.seenValues)
+	c.strictSampled = copySet(p.strictSampled)
+	c.warnedUntyped = copySet(p.warnedUntyped)
+	if p.histBuckets != nil {
+		c.histBuckets = make(map[string][]histBucket, len(p.histBuckets))
+		for k, v := range p.histBuckets {
+			c.histBuckets[k] = append([]histBucket(nil), v...)
+		}
+	}
+	return &c
+}
+
+func copyTypeMap(m map[string]MetricType) map[string]MetricType {
+	if m == nil {
+		return nil
+	}
+	c := make(map[string]MetricType, len(m))
+	for k, v := range m {
+		c[k] = v
+	}
+	return c
+}
+
+func copyFloatMap(m map[string]float64) map[string]float64 {
+	if m == nil {
+		return nil
+	}
+	c := make(map[string]float64, len(m))
+	for k, v := range m {
+		c[k] = v
+	}
+	return c
+}
+
+func copySet(m map[string]struct{}) map[string]struct{} {
+	if m == nil {
+		return nil
+	}
+	c := make(map[string]struct{}, len(m))
+	for k := range m {
+		c[k] = struct{}{}
+	}
+	return c
+}
+
+// Warnings returns the non-fatal observations collected during parsing so
+// far. It returns nil unless the parser was created with WithWarnings.
+func (p *OpenMetricsParser) Warnings() []string {
+	return p.warnings
+}
+
+// EOFOffset returns the byte offset of the terminal # EOF marker in the
+// input, pointing at its leading #. It returns false until Next has reached
+// the marker, e.g. for callers splicing additional bytes in front of it.
+func (p *OpenMetricsParser) EOFOffset() (int, bool) {
+	if p.eofOffset < 0 {
+		return 0, false
+	}
+	return p.eofOffset, true
+}
+
 // Help returns the metric name and help text in the current entry.
 // Must only be called after Next returned a help entry.
 // The returned byte slices become invalid after the next call to Next.
@@ -142,6 +499,44 @@ func (p *OpenMetricsParser) Unit() ([]byte, []byte) {
 	return p.l.b[p.offsets[0]:p.offsets[1]], p.text
 }
 
+// familyName returns the metric or family name of the current entry, nil if
+// the parser is not positioned on a named entry.
+func (p *OpenMetricsParser) familyName() []byte {
+	switch p.lastEntry {
+	case EntrySeries:
+		return p.series[:p.offsets[0]-p.start]
+	case EntryHelp, EntryType, EntryUnit:
+		return p.l.b[p.offsets[0]:p.offsets[1]]
+	}
+	return nil
+}
+
+// Peek reports what the following call to Next will return, without
+// advancing the parser, e.g. for deciding how to finish the current entry
+// based on whether metadata or another sample follows. It works on an
+// independent Clone, so the current entry and its accessors stay valid and
+// each call parses the next entry once.
+func (p *OpenMetricsParser) Peek() (Entry, error) {
+	return p.Clone().Next()
+}
+
+// ContentType returns the canonical Content-Type header value of the
+// OpenMetrics text exposition format.
+func (p *OpenMetricsParser) ContentType() string {
+	return "application/openmetrics-text; version=1.0.0; charset=utf-8"
+}
+
+// SkipToNextFamily advances the parser past the remaining entries of the
+// current metric family, so the following call to Next returns the first
+// metadata entry of the next family. The skipped lines are not lexed and no
+// labels are built for them. It returns io.EOF when the input holds no
+// further family; the terminal # EOF marker is left for Next to consume.
+func (p *OpenMetricsParser) SkipToNextFamily() error {
+	i, err := skipToFamilyBoundary(p.l.b, p.l.i, p.familyName())
+	p.l.i = i
+	return err
+}
+
 // Comment returns the text of the current comment.
 // Must only be called after Next returned a comment entry.
 // The returned byte slice becomes invalid after the next call to Next.
@@ -182,6 +577,40 @@ func (p *OpenMetricsParser) Metric(l *labels.Labels) string {
 	return s
 }
 
+// MetricInto resets the passed builder and sets the labels of the current
+// sample on it. It returns the string from which the metric was parsed.
+func (p *OpenMetricsParser) MetricInto(b *labels.Builder) string {
+	// Allocate the full immutable string immediately, so we just
+	// have to create references on it below.
+	s := string(p.series)
+
+	b.Reset(nil)
+	b.Set(labels.MetricName, s[:p.offsets[0]-p.start])
+
+	for i := 1; i < len(p.offsets); i += 4 {
+		a := p.offsets[i] - p.start
+		c := p.offsets[i+1] - p.start
+		d := p.offsets[i+2] - p.start
+		e := p.offsets[i+3] - p.start
+
+		// Replacer causes allocations. Replace only when necessary.
+		if strings.IndexByte(s[d:e], byte('\\')) >= 0 {
+			b.Set(s[a:c], lvalReplacer.Replace(s[d:e]))
+			continue
+		}
+		b.Set(s[a:c], s[d:e])
+	}
+
+	return s
+}
+
+// MetricName returns just the metric name of the current sample.
+// Must only be called after Next returned a series entry.
+// The returned byte slice becomes invalid after the next call to Next.
+func (p *OpenMetricsParser) MetricName() []byte {
+	return p.series[:p.offsets[0]-p.start]
+}
+
 // Exemplar writes the exemplar of the current sample into the passed
 // exemplar. It returns the whether an exemplar exists.
 func (p *OpenMetricsParser) Exemplar(e *exemplar.Exemplar) bool {
@@ -214,6 +643,166 @@ func (p *OpenMetricsParser) Exemplar(e *exemplar.Exemplar) bool {
 	return true
 }
 
+// SeriesType returns the type declared for the metric family the current
+// series belongs to, resolving known family suffixes. It returns false if
+// no type entry was seen for the family.
+// Must only be called after Next returned a series entry.
+func (p *OpenMetricsParser) SeriesType() (MetricType, bool) {
+	return seriesFamilyType(p.types, string(p.series[:p.offsets[0]-p.start]))
+}
+
+// checkTypeSeen returns an error if the current series belongs to a family
+// that is typed somewhere in the document but whose # TYPE line was not
+// seen yet.
+func (p *OpenMetricsParser) checkTypeSeen() error {
+	name := string(p.series[:p.offsets[0]-p.start])
+	if _, ok := seriesFamilyType(p.types, name); ok {
+		return nil
+	}
+	candidates := []string{name}
+	for _, suffix := range metricFamilySuffixes {
+		if strings.HasSuffix(name, suffix) {
+			candidates = append(candidates, strings.TrimSuffix(name, suffix))
+		}
+	}
+	for _, c := range candidates {
+		if _, ok := p.declaredTypes[c]; ok {
+			return errors.Errorf("series for metric %q at byte offset %d before its # TYPE line", name, p.start)
+		}
+	}
+	return nil
+}
+
+// checkMetadataOrder returns an error if a sample of the metric family named
+// m was already seen, since OpenMetrics 1.0 requires all of a family's
+// metadata to precede its samples.
+func (p *OpenMetricsParser) checkMetadataOrder(m string) error {
+	candidates := []string{m}
+	for _, suffix := range metricFamilySuffixes {
+		candidates = append(candidates, m+suffix)
+	}
+	for _, c := range candidates {
+		if _, ok := p.strictSampled[c]; ok {
+			return errors.Errorf("metadata for metric %q after its samples at byte offset %d", m, p.start)
+		}
+	}
+	return nil
+}
+
+// bufferHistogramSample records the current sample if it is a _bucket or
+// _count series of the histogram family currently being read.
+func (p *OpenMetricsParser) bufferHistogramSample() error {
+	name := yoloString(p.series[:p.offsets[0]-p.start])
+	isBucket := name == p.histName+"_bucket"
+	if !isBucket && name != p.histName+"_count" {
+		return nil
+	}
+
+	var lset labels.Labels
+	p.Metric(&lset)
+	le := lset.Get("le")
+	b := labels.NewBuilder(lset)
+	b.Del(labels.MetricName, "le")
+	key := b.Labels().String()
+
+	if !isBucket {
+		if p.histCounts == nil {
+			p.histCounts = map[string]float64{}
+		}
+		p.histCounts[key] = p.val
+		return nil
+	}
+	leVal, err := parseFloat(le)
+	if err != nil {
+		return errors.Errorf("invalid le %q on histogram %q at byte offset %d", le, p.histName, p.start)
+	}
+	if p.histBuckets == nil {
+		p.histBuckets = map[string][]histBucket{}
+	}
+	p.histBuckets[key] = append(p.histBuckets[key], histBucket{le: leVal, v: p.val})
+	return nil
+}
+
+// validateHistogram checks the buffered histogram family, if any, and resets
+// the buffers for the next one.
+func (p *OpenMetricsParser) validateHistogram() error {
+	if !p.checkHistogramConsistency || p.histName == "" {
+		return nil
+	}
+	name := p.histName
+	buckets, counts := p.histBuckets, p.histCounts
+	p.histName = ""
+	p.histBuckets = nil
+	p.histCounts = nil
+
+	for key, bs := range buckets {
+		sort.SliceStable(bs, func(i, j int) bool { return bs[i].le < bs[j].le })
+		prev := math.Inf(-1)
+		for _, b := range bs {
+			if b.v < prev {
+				return errors.Errorf("histogram %q has non-monotonic bucket value %v for le=%v", name, b.v, b.le)
+			}
+			prev = b.v
+		}
+		last := bs[len(bs)-1]
+		if count, ok := counts[key]; ok && math.IsInf(last.le, +1) && last.v != count {
+			return errors.Errorf("histogram %q has +Inf bucket %v not matching its count %v", name, last.v, count)
+		}
+	}
+	return nil
+}
+
+// bufferSummarySample records the current sample if it belongs to the
+// summary family currently being read.
+func (p *OpenMetricsParser) bufferSummarySample() error {
+	name := yoloString(p.series[:p.offsets[0]-p.start])
+	switch name {
+	case p.sumName:
+		var lset labels.Labels
+		p.Metric(&lset)
+		q := lset.Get("quantile")
+		qVal, err := parseFloat(q)
+		if err != nil {
+			return errors.Errorf("invalid quantile %q on summary %q at byte offset %d", q, p.sumName, p.start)
+		}
+		p.sumQuantiles = append(p.sumQuantiles, SummaryQuantile{Q: qVal, V: p.val})
+	case p.sumName + "_sum":
+		p.sumSum = p.val
+	case p.sumName + "_count":
+		p.sumCount = uint64(p.val)
+	}
+	return nil
+}
+
+// finalizeSummary completes the summary family currently being buffered, if
+// any, making it available through Summary, and resets the buffers for the
+// next one.
+func (p *OpenMetricsParser) finalizeSummary() {
+	if !p.aggregateSummaries || p.sumName == "" {
+		return
+	}
+	quantiles := p.sumQuantiles
+	sort.SliceStable(quantiles, func(i, j int) bool { return quantiles[i].Q < quantiles[j].Q })
+	p.lastSummary = summaryAggregate{
+		name:      []byte(p.sumName),
+		quantiles: quantiles,
+		sum:       p.sumSum,
+		count:     p.sumCount,
+	}
+	p.sumName = ""
+	p.sumQuantiles = nil
+	p.sumSum = 0
+	p.sumCount = 0
+}
+
+// Summary returns the most recently completed summary family: its name, the
+// quantiles sorted ascending, and the values of its _sum and _count series.
+// A family is complete once metadata for a different family or the # EOF
+// marker has been read. name is nil while no family has completed yet.
+func (p *OpenMetricsParser) Summary() (name []byte, quantiles []SummaryQuantile, sum float64, count uint64) {
+	return p.lastSummary.name, p.lastSummary.quantiles, p.lastSummary.sum, p.lastSummary.count
+}
+
 // nextToken returns the next token from the openMetricsLexer.
 func (p *OpenMetricsParser) nextToken() token {
 	tok := p.l.Lex()
@@ -223,6 +812,20 @@ func (p *OpenMetricsParser) nextToken() token {
 // Next advances the parser to the next sample. It returns false if no
 // more samples were read or an error occurred.
 func (p *OpenMetricsParser) Next() (Entry, error) {
+	e, err := p.next()
+	if err == nil {
+		p.entries++
+		p.lastEntry = e
+	}
+	// An error produced while the lexer had already consumed the whole
+	// input can only stem from an incomplete trailing entry.
+	if p.partialInput && err != nil && err != io.EOF && p.l.i+1 >= len(p.l.b) {
+		return EntryInvalid, io.EOF
+	}
+	return e, err
+}
+
+func (p *OpenMetricsParser) next() (Entry, error) {
 	var err error
 
 	p.start = p.l.i
@@ -232,11 +835,31 @@ func (p *OpenMetricsParser) Next() (Entry, error) {
 	p.exemplarVal = 0
 	p.hasExemplarTs = false
 
+	// Every comment and metadata line starts with #, so in metadata-only
+	// mode anything else can be skipped wholesale without lexing it.
+	for p.metadataOnly && p.l.i < len(p.l.b) && p.l.b[p.l.i] != '#' {
+		j := bytes.IndexByte(p.l.b[p.l.i:], '\n')
+		if j < 0 {
+			p.l.i = len(p.l.b)
+			break
+		}
+		p.l.i += j + 1
+		p.start = p.l.i
+	}
+
 	switch t := p.nextToken(); t {
 	case tEOFWord:
 		if t := p.nextToken(); t != tEOF {
 			return EntryInvalid, errors.New("unexpected data after # EOF")
 		}
+		if err := p.validateHistogram(); err != nil {
+			return EntryInvalid, err
+		}
+		p.finalizeSummary()
+		p.eofOffset = p.start
+		if p.rejectDuplicates {
+			p.seenValues = map[string]float64{}
+		}
 		return EntryInvalid, io.EOF
 	case tEOF:
 		return EntryInvalid, errors.New("data does not end with # EOF")
@@ -283,11 +906,45 @@ func (p *OpenMetricsParser) Next() (Entry, error) {
 			if !utf8.Valid(p.text) {
 				return EntryInvalid, errors.New("help text is not a valid utf8 string")
 			}
+			if p.collectWarnings && len(p.text) > 0 && p.text[len(p.text)-1] == ' ' {
+				p.warnings = append(p.warnings, fmt.Sprintf("help text for metric %q has trailing whitespace", p.l.b[p.offsets[0]:p.offsets[1]]))
+			}
+		}
+		if p.strict {
+			m := yoloString(p.l.b[p.offsets[0]:p.offsets[1]])
+			if err := p.checkMetadataOrder(m); err != nil {
+				return EntryInvalid, err
+			}
+		}
+		if p.checkHistogramConsistency {
+			// Metadata for a different family ends the buffered one.
+			m := string(p.l.b[p.offsets[0]:p.offsets[1]])
+			if m != p.histName {
+				if err := p.validateHistogram(); err != nil {
+					return EntryInvalid, err
+				}
+			}
+			if t == tType && p.mtype == MetricTypeHistogram {
+				p.histName = m
+			}
+		}
+		if p.aggregateSummaries {
+			m := string(p.l.b[p.offsets[0]:p.offsets[1]])
+			if m != p.sumName {
+				p.finalizeSummary()
+			}
+			if t == tType && p.mtype == MetricTypeSummary {
+				p.sumName = m
+			}
 		}
 		switch t {
 		case tHelp:
 			return EntryHelp, nil
 		case tType:
+			if p.types == nil {
+				p.types = map[string]MetricType{}
+			}
+			p.types[string(p.l.b[p.offsets[0]:p.offsets[1]])] = p.mtype
 			return EntryType, nil
 		case tUnit:
 			m := yoloString(p.l.b[p.offsets[0]:p.offsets[1]])
@@ -306,7 +963,7 @@ func (p *OpenMetricsParser) Next() (Entry, error) {
 
 		t2 := p.nextToken()
 		if t2 == tBraceOpen {
-			offsets, err := p.parseLVals()
+			offsets, err := p.parseLVals(p.maxLabelsPerSeries)
 			if err != nil {
 				return EntryInvalid, err
 			}
@@ -336,7 +993,7 @@ func (p *OpenMetricsParser) Next() (Entry, error) {
 			if ts, err = parseFloat(yoloString(p.l.buf()[1:])); err != nil {
 				return EntryInvalid, err
 			}
-			p.ts = int64(ts * 1000)
+			p.ts = timestampMillis(ts)
 			switch t3 := p.nextToken(); t3 {
 			case tLinebreak:
 			case tComment:
@@ -349,6 +1006,48 @@ func (p *OpenMetricsParser) Next() (Entry, error) {
 		default:
 			return EntryInvalid, parseError("expected timestamp or # symbol", t2)
 		}
+		if p.requireTypeBeforeSamples {
+			if err := p.checkTypeSeen(); err != nil {
+				return EntryInvalid, err
+			}
+		}
+		if p.collectWarnings {
+			name := string(p.series[:p.offsets[0]-p.start])
+			if _, ok := seriesFamilyType(p.types, name); !ok {
+				if _, warned := p.warnedUntyped[name]; !warned {
+					p.warnedUntyped[name] = struct{}{}
+					p.warnings = append(p.warnings, fmt.Sprintf("metric %q has no preceding # TYPE line", name))
+				}
+			}
+		}
+		if p.strict {
+			key := string(p.series)
+			if _, ok := p.strictSeries[key]; ok {
+				return EntryInvalid, errors.Errorf("duplicate sample for series %q at byte offset %d", p.series, p.start)
+			}
+			p.strictSeries[key] = struct{}{}
+			p.strictSampled[string(p.series[:p.offsets[0]-p.start])] = struct{}{}
+		}
+		if p.rejectDuplicates {
+			key := string(p.series)
+			if v, ok := p.seenValues[key]; ok {
+				if v != p.val {
+					return EntryInvalid, errors.Errorf("duplicate series %q with conflicting values %v and %v", p.series, v, p.val)
+				}
+			} else {
+				p.seenValues[key] = p.val
+			}
+		}
+		if p.checkHistogramConsistency && p.histName != "" {
+			if err := p.bufferHistogramSample(); err != nil {
+				return EntryInvalid, err
+			}
+		}
+		if p.aggregateSummaries && p.sumName != "" {
+			if err := p.bufferSummarySample(); err != nil {
+				return EntryInvalid, err
+			}
+		}
 		return EntrySeries, nil
 
 	default:
@@ -365,7 +1064,7 @@ func (p *OpenMetricsParser) parseComment() error {
 	}
 
 	// Parse the labels.
-	offsets, err := p.parseLVals()
+	offsets, err := p.parseLVals(0)
 	if err != nil {
 		return err
 	}
@@ -392,7 +1091,7 @@ func (p *OpenMetricsParser) parseComment() error {
 		if ts, err = parseFloat(yoloString(p.l.buf()[1:])); err != nil {
 			return err
 		}
-		p.exemplarTs = int64(ts * 1000)
+		p.exemplarTs = timestampMillis(ts)
 		switch t3 := p.nextToken(); t3 {
 		case tLinebreak:
 		default:
@@ -404,7 +1103,9 @@ func (p *OpenMetricsParser) parseComment() error {
 	return nil
 }
 
-func (p *OpenMetricsParser) parseLVals() ([]int, error) {
+// parseLVals parses the label pairs between braces. If limit is non-zero,
+// parsing is aborted as soon as more than limit labels were read.
+func (p *OpenMetricsParser) parseLVals(limit int) ([]int, error) {
 	var offsets []int
 	first := true
 	for {
@@ -417,6 +1118,9 @@ func (p *OpenMetricsParser) parseLVals() ([]int, error) {
 				return nil, parseError("expected label name or left brace", t)
 			}
 			t = p.nextToken()
+			if p.strict && t == tBraceClose {
+				return nil, errors.Errorf("trailing comma in label set of metric %q at byte offset %d", p.series, p.l.start)
+			}
 			if t != tLName {
 				return nil, parseError("expected label name", t)
 			}
@@ -434,6 +1138,9 @@ func (p *OpenMetricsParser) parseLVals() ([]int, error) {
 		first = false
 		// t is now a label name.
 
+		if limit > 0 && len(offsets)/4 >= limit {
+			return nil, errors.Errorf("metric %q has more than %d labels at byte offset %d", p.series, limit, p.l.start)
+		}
 		offsets = append(offsets, p.l.start, p.l.i)
 
 		if t := p.nextToken(); t != tEqual {
@@ -452,6 +1159,14 @@ func (p *OpenMetricsParser) parseLVals() ([]int, error) {
 	}
 }
 
+// timestampMillis converts a floating-point seconds timestamp to integer
+// milliseconds, rounding to the nearest millisecond rather than truncating.
+// It is used for both sample and exemplar timestamps so the two cannot drift
+// apart on the same input.
+func timestampMillis(ts float64) int64 {
+	return int64(math.Round(ts * 1000))
+}
+
 func (p *OpenMetricsParser) getFloatValue(t token, after string) (float64, error) {
 	if t != tValue {
 		return 0, parseError(fmt.Sprintf("expected value after %v", after), t)
@@ -14,7 +14,10 @@
 package textparse
 
 import (
+	"bytes"
+	"fmt"
 	"io"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -546,7 +549,7 @@ func TestOMNullByteHandling(t *testing.T) {
 		},
 		{
 			input: "a{b\x00=\"hiih\"}	1",
-			err: "expected equal, got \"INVALID\"",
+			err:   "expected equal, got \"INVALID\"",
 		},
 		{
 			input: "a\x00{b=\"ddd\"} 1",
@@ -585,3 +588,513 @@ func TestOMNullByteHandling(t *testing.T) {
 		require.Equal(t, c.err, err.Error(), "test %d", i)
 	}
 }
+
+func TestOpenMetricsRequireTypeBeforeSamples(t *testing.T) {
+	cases := []struct {
+		input string
+		err   string
+	}{
+		{
+			input: "# TYPE foo counter\nfoo_total 17.0\n# EOF\n",
+		},
+		{
+			input: "# TYPE hh histogram\nhh_bucket{le=\"+Inf\"} 1\nhh_count 1\n# EOF\n",
+		},
+		{
+			// Untyped families are allowed when the document declares
+			// no type for them anywhere.
+			input: "# TYPE un unknown\nsome_untyped_metric 1\n# EOF\n",
+		},
+		{
+			input: "foo_total 17.0\n# TYPE foo counter\n# EOF\n",
+			err:   "series for metric \"foo_total\" at byte offset 0 before its # TYPE line",
+		},
+		{
+			input: "# TYPE aa gauge\naa 1\nhh_bucket{le=\"+Inf\"} 1\n# TYPE hh histogram\n# EOF\n",
+			err:   "series for metric \"hh_bucket\" at byte offset 21 before its # TYPE line",
+		},
+	}
+
+	for i, c := range cases {
+		p := NewOpenMetricsParser([]byte(c.input), WithRequireTypeBeforeSamples())
+		var err error
+		for err == nil {
+			_, err = p.Next()
+		}
+		if c.err == "" {
+			require.Equal(t, io.EOF, err, "test %d: %s", i, c.input)
+			continue
+		}
+		require.Equal(t, c.err, err.Error(), "test %d: %s", i, c.input)
+	}
+}
+
+func TestOpenMetricsMaxLabelsPerSeries(t *testing.T) {
+	cases := []struct {
+		input string
+		limit int
+		err   string
+	}{
+		{
+			input: "foo{a=\"1\",b=\"2\",c=\"3\"} 17.0\n# EOF\n",
+			limit: 3,
+		},
+		{
+			// The default is unlimited.
+			input: "foo{a=\"1\",b=\"2\",c=\"3\"} 17.0\n# EOF\n",
+			limit: 0,
+		},
+		{
+			input: "foo{a=\"1\",b=\"2\",c=\"3\"} 17.0\n# EOF\n",
+			limit: 2,
+			err:   "metric \"foo\" has more than 2 labels at byte offset 16",
+		},
+		{
+			input: "foo 1\nbar{a=\"1\",b=\"2\"} 1\n# EOF\n",
+			limit: 1,
+			err:   "metric \"bar\" has more than 1 labels at byte offset 16",
+		},
+	}
+
+	for i, c := range cases {
+		p := NewOpenMetricsParser([]byte(c.input), WithMaxLabelsPerSeries(c.limit))
+		var err error
+		for err == nil {
+			_, err = p.Next()
+		}
+		if c.err == "" {
+			require.Equal(t, io.EOF, err, "test %d: %s", i, c.input)
+			continue
+		}
+		require.Equal(t, c.err, err.Error(), "test %d: %s", i, c.input)
+	}
+}
+
+func TestOpenMetricsHistogramConsistencyCheck(t *testing.T) {
+	cases := []struct {
+		input string
+		err   string
+	}{
+		{
+			input: "# TYPE hh histogram\nhh_bucket{le=\"1\"} 1\nhh_bucket{le=\"+Inf\"} 3\nhh_count 3\nhh_sum 2.5\n# EOF\n",
+		},
+		{
+			// Bucket series are grouped by their labels without le.
+			input: "# TYPE hh histogram\nhh_bucket{a=\"x\",le=\"1\"} 5\nhh_bucket{a=\"x\",le=\"+Inf\"} 5\nhh_count{a=\"x\"} 5\nhh_bucket{a=\"y\",le=\"1\"} 1\nhh_bucket{a=\"y\",le=\"+Inf\"} 2\nhh_count{a=\"y\"} 2\n# EOF\n",
+		},
+		{
+			// Non-histogram families are not checked.
+			input: "# TYPE foo counter\nfoo_total 17.0\n# EOF\n",
+		},
+		{
+			// Detected at # EOF.
+			input: "# TYPE hh histogram\nhh_bucket{le=\"1\"} 5\nhh_bucket{le=\"+Inf\"} 3\nhh_count 3\n# EOF\n",
+			err:   "histogram \"hh\" has non-monotonic bucket value 3 for le=+Inf",
+		},
+		{
+			// Detected at the next family.
+			input: "# TYPE hh histogram\nhh_bucket{le=\"1\"} 5\nhh_bucket{le=\"+Inf\"} 3\n# TYPE foo counter\nfoo_total 17.0\n# EOF\n",
+			err:   "histogram \"hh\" has non-monotonic bucket value 3 for le=+Inf",
+		},
+		{
+			input: "# TYPE hh histogram\nhh_bucket{le=\"1\"} 1\nhh_bucket{le=\"+Inf\"} 3\nhh_count 4\n# EOF\n",
+			err:   "histogram \"hh\" has +Inf bucket 3 not matching its count 4",
+		},
+		{
+			input: "# TYPE hh histogram\nhh_bucket{le=\"nope\"} 1\n# EOF\n",
+			err:   "invalid le \"nope\" on histogram \"hh\" at byte offset 20",
+		},
+	}
+
+	for i, c := range cases {
+		p := NewOpenMetricsParser([]byte(c.input), WithHistogramConsistencyCheck())
+		var err error
+		for err == nil {
+			_, err = p.Next()
+		}
+		if c.err == "" {
+			require.Equal(t, io.EOF, err, "test %d: %s", i, c.input)
+			continue
+		}
+		require.Equal(t, c.err, err.Error(), "test %d: %s", i, c.input)
+	}
+}
+
+func TestOpenMetricsTimestampRounding(t *testing.T) {
+	// Fractional-second timestamps are converted to integer milliseconds by
+	// rounding to the nearest millisecond, not by truncation, for sample and
+	// exemplar timestamps alike.
+	input := `go_goroutines 33 123.1239
+# TYPE foo counter
+foo_total 17.0 123.1231 # {id="counter-test"} 5 123.1239
+# EOF
+`
+	p := NewOpenMetricsParser([]byte(input))
+
+	_, err := p.Next()
+	require.NoError(t, err)
+	_, ts, _ := p.Series()
+	require.Equal(t, int64(123124), *ts)
+
+	_, err = p.Next()
+	require.NoError(t, err)
+	_, err = p.Next()
+	require.NoError(t, err)
+	_, ts, _ = p.Series()
+	require.Equal(t, int64(123123), *ts)
+
+	var e exemplar.Exemplar
+	require.True(t, p.Exemplar(&e))
+	require.True(t, e.HasTs)
+	require.Equal(t, int64(123124), e.Ts)
+}
+
+func TestEOFOffset(t *testing.T) {
+	input := "# TYPE foo counter\nfoo_total 17.0\nbar 1\n# EOF\n"
+	p := NewOpenMetricsParser([]byte(input)).(*OpenMetricsParser)
+
+	_, found := p.EOFOffset()
+	require.False(t, found)
+
+	var err error
+	for err == nil {
+		_, err = p.Next()
+		if err == nil {
+			// The marker has not been consumed yet.
+			_, found := p.EOFOffset()
+			require.False(t, found)
+		}
+	}
+	require.Equal(t, io.EOF, err)
+
+	offset, found := p.EOFOffset()
+	require.True(t, found)
+	require.Equal(t, strings.Index(input, "# EOF"), offset)
+}
+
+func TestStrictOpenMetrics10(t *testing.T) {
+	cases := []struct {
+		input string
+		err   string
+	}{
+		{
+			input: "# HELP foo help\n# TYPE foo counter\nfoo_total{a=\"b\"} 17.0\nfoo_total{a=\"c\"} 21.0\n# EOF\n",
+		},
+		{
+			input: "# TYPE foo counter\nfoo_total{a=\"b\"} 17.0\nfoo_total{a=\"b\"} 17.0\n# EOF\n",
+			err:   "duplicate sample for series \"foo_total{a=\\\"b\\\"}\" at byte offset 41",
+		},
+		{
+			input: "foo_total 17.0\n# TYPE foo counter\n# EOF\n",
+			err:   "metadata for metric \"foo\" after its samples at byte offset 15",
+		},
+		{
+			input: "bar 1\n# HELP bar help\n# EOF\n",
+			err:   "metadata for metric \"bar\" after its samples at byte offset 6",
+		},
+		{
+			input: "foo{b=\"c\",} 1\n# EOF\n",
+			err:   "trailing comma in label set of metric \"foo\" at byte offset 10",
+		},
+	}
+
+	for i, c := range cases {
+		p := NewOpenMetricsParser([]byte(c.input), WithStrictOpenMetrics10())
+		var err error
+		for err == nil {
+			_, err = p.Next()
+		}
+		if c.err == "" {
+			require.Equal(t, io.EOF, err, "test %d: %s", i, c.input)
+			continue
+		}
+		require.Equal(t, c.err, err.Error(), "test %d: %s", i, c.input)
+	}
+}
+
+func TestOpenMetricsWarnings(t *testing.T) {
+	input := `# HELP foo help with trailing space 
+# TYPE foo counter
+foo_total 17.0
+untyped_metric 1
+untyped_metric 2
+# EOF
+`
+	p := NewOpenMetricsParser([]byte(input), WithWarnings()).(*OpenMetricsParser)
+	var err error
+	for err == nil {
+		_, err = p.Next()
+	}
+	require.Equal(t, io.EOF, err)
+	require.Equal(t, []string{
+		`help text for metric "foo" has trailing whitespace`,
+		`metric "untyped_metric" has no preceding # TYPE line`,
+	}, p.Warnings())
+
+	// Without the option nothing is collected.
+	p = NewOpenMetricsParser([]byte(input)).(*OpenMetricsParser)
+	for err = nil; err == nil; {
+		_, err = p.Next()
+	}
+	require.Nil(t, p.Warnings())
+}
+
+func TestOpenMetricsPartialInput(t *testing.T) {
+	input := `# HELP foo help text
+# TYPE foo counter
+foo_total{a="b"} 17.0
+foo_total{a="c"} 21.0
+bar 1
+# EOF
+`
+	full := NewOpenMetricsParser([]byte(input), WithPartialInput())
+	var err error
+	for err == nil {
+		_, err = full.Next()
+	}
+	require.Equal(t, io.EOF, err)
+	total := full.EntryCount()
+
+	// However much of the tail is cut off, the complete entries before the
+	// truncation are still delivered and parsing ends in a clean EOF.
+	for offset := 0; offset < len(input); offset++ {
+		p := NewOpenMetricsParser([]byte(input[:offset]), WithPartialInput())
+		var err error
+		for err == nil {
+			_, err = p.Next()
+		}
+		require.Equal(t, io.EOF, err, "truncated at byte %d", offset)
+		require.LessOrEqual(t, p.EntryCount(), total, "truncated at byte %d", offset)
+	}
+
+	// Cutting inside the last sample drops only that sample.
+	truncated := input[:strings.Index(input, "bar 1")+3]
+	p := NewOpenMetricsParser([]byte(truncated), WithPartialInput())
+	for err = nil; err == nil; {
+		_, err = p.Next()
+	}
+	require.Equal(t, io.EOF, err)
+	require.Equal(t, 4, p.EntryCount())
+
+	// Errors before the truncation point still surface.
+	p = NewOpenMetricsParser([]byte("foo{ 1\nbar 2\n"), WithPartialInput())
+	for err = nil; err == nil; {
+		_, err = p.Next()
+	}
+	require.Error(t, err)
+	require.NotEqual(t, io.EOF, err)
+}
+
+func TestOpenMetricsMetadataOnly(t *testing.T) {
+	input := `# HELP go_gc_duration_seconds A summary of the GC invocation durations.
+# TYPE go_gc_duration_seconds summary
+go_gc_duration_seconds{quantile="0"} 4.9351e-05
+go_gc_duration_seconds{quantile="0.25"} 7.424100000000001e-05
+# TYPE hh histogram
+hh_bucket{le="+Inf"} 1
+# TYPE foo_seconds counter
+# UNIT foo_seconds seconds
+# HELP foo_seconds help text
+foo_seconds_total 17.0 1520879607.789
+# EOF
+`
+	p := NewOpenMetricsParser([]byte(input), WithMetadataOnly())
+
+	var got []Entry
+	var names []string
+	for {
+		e, err := p.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		got = append(got, e)
+		switch e {
+		case EntryHelp:
+			m, _ := p.Help()
+			names = append(names, string(m))
+		case EntryType:
+			m, _ := p.Type()
+			names = append(names, string(m))
+		case EntryUnit:
+			m, _ := p.Unit()
+			names = append(names, string(m))
+		}
+	}
+	require.Equal(t, []Entry{
+		EntryHelp, EntryType, EntryType, EntryType, EntryUnit, EntryHelp,
+	}, got)
+	require.Equal(t, []string{
+		"go_gc_duration_seconds", "go_gc_duration_seconds", "hh",
+		"foo_seconds", "foo_seconds", "foo_seconds",
+	}, names)
+}
+
+func BenchmarkOpenMetricsMetadataOnly(b *testing.B) {
+	var buf bytes.Buffer
+	for i := 0; i < 100; i++ {
+		fmt.Fprintf(&buf, "# HELP metric_%d help text for metric %d\n", i, i)
+		fmt.Fprintf(&buf, "# TYPE metric_%d counter\n", i)
+		for j := 0; j < 100; j++ {
+			fmt.Fprintf(&buf, "metric_%d_total{foo=\"bar\",instance=\"host:9090\",shard=\"%d\"} %d.0 1520879607.789\n", i, j, j)
+		}
+	}
+	buf.WriteString("# EOF\n")
+	input := buf.Bytes()
+
+	for _, bench := range []struct {
+		name string
+		opts []OpenMetricsOption
+	}{
+		{name: "full"},
+		{name: "metadata-only", opts: []OpenMetricsOption{WithMetadataOnly()}},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			b.SetBytes(int64(len(input)))
+			b.ReportAllocs()
+
+			var lset labels.Labels
+			for i := 0; i < b.N; i++ {
+				p := NewOpenMetricsParser(input, bench.opts...)
+				var err error
+				for err == nil {
+					var e Entry
+					if e, err = p.Next(); err == nil && e == EntrySeries {
+						lset = lset[:0]
+						p.Metric(&lset)
+					}
+				}
+				if err != io.EOF {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestOpenMetricsCaseInsensitiveKeywords(t *testing.T) {
+	input := `# help foo_seconds Some help.
+# type foo_seconds counter
+# unit foo_seconds seconds
+foo_seconds_total 17
+# eof
+`
+
+	// Without the option the lowercase keywords are rejected.
+	p := NewOpenMetricsParser([]byte(input))
+	_, err := p.Next()
+	require.Error(t, err)
+
+	p = NewOpenMetricsParser([]byte(input), WithCaseInsensitiveKeywords())
+
+	e, err := p.Next()
+	require.NoError(t, err)
+	require.Equal(t, EntryHelp, e)
+	name, help := p.Help()
+	require.Equal(t, "foo_seconds", string(name))
+	require.Equal(t, "Some help.", string(help))
+
+	e, err = p.Next()
+	require.NoError(t, err)
+	require.Equal(t, EntryType, e)
+	_, typ := p.Type()
+	require.Equal(t, MetricTypeCounter, typ)
+
+	e, err = p.Next()
+	require.NoError(t, err)
+	require.Equal(t, EntryUnit, e)
+
+	e, err = p.Next()
+	require.NoError(t, err)
+	require.Equal(t, EntrySeries, e)
+
+	_, err = p.Next()
+	require.Equal(t, io.EOF, err)
+
+	// The metric type value itself stays case-sensitive.
+	p = NewOpenMetricsParser([]byte("# TYPE foo Counter\nfoo 1\n# EOF\n"), WithCaseInsensitiveKeywords())
+	_, err = p.Next()
+	require.EqualError(t, err, `invalid metric type "Counter"`)
+}
+
+func TestOpenMetricsSummaryAggregation(t *testing.T) {
+	input := `# HELP go_gc_duration_seconds A summary of the GC invocation durations.
+# TYPE go_gc_duration_seconds summary
+go_gc_duration_seconds{quantile="0.5"} 4.63e-05
+go_gc_duration_seconds{quantile="0"} 4.9351e-05
+go_gc_duration_seconds{quantile="1"} 0.000499903
+go_gc_duration_seconds_sum 0.0003726666
+go_gc_duration_seconds_count 7
+# TYPE other counter
+other_total 1
+# EOF
+`
+	p := NewOpenMetricsParser([]byte(input), WithSummaryAggregation()).(*OpenMetricsParser)
+
+	// While the family is still being read, nothing has completed.
+	for i := 0; i < 4; i++ {
+		_, err := p.Next()
+		require.NoError(t, err)
+	}
+	name, _, _, _ := p.Summary()
+	require.Nil(t, name)
+
+	var err error
+	for err == nil {
+		_, err = p.Next()
+	}
+	require.Equal(t, io.EOF, err)
+
+	name, quantiles, sum, count := p.Summary()
+	require.Equal(t, "go_gc_duration_seconds", string(name))
+	require.Equal(t, []SummaryQuantile{
+		{Q: 0, V: 4.9351e-05},
+		{Q: 0.5, V: 4.63e-05},
+		{Q: 1, V: 0.000499903},
+	}, quantiles)
+	require.Equal(t, 0.0003726666, sum)
+	require.Equal(t, uint64(7), count)
+
+	// A malformed quantile label is reported.
+	p = NewOpenMetricsParser([]byte(`# TYPE s summary
+s{quantile="nope"} 1
+# EOF
+`), WithSummaryAggregation()).(*OpenMetricsParser)
+	for err = nil; err == nil; {
+		_, err = p.Next()
+	}
+	require.Error(t, err)
+	require.Contains(t, err.Error(), `invalid quantile "nope"`)
+}
+
+func TestOpenMetricsRejectDuplicateSeries(t *testing.T) {
+	t.Run("identical repeat allowed", func(t *testing.T) {
+		input := "a_total{x=\"1\"} 5\na_total{x=\"1\"} 5\n# EOF\n"
+		p := NewOpenMetricsParser([]byte(input), WithRejectDuplicateSeries())
+		var err error
+		for err == nil {
+			_, err = p.Next()
+		}
+		require.Equal(t, io.EOF, err)
+	})
+
+	t.Run("conflicting repeat rejected", func(t *testing.T) {
+		input := "a_total{x=\"1\"} 5\nb_total 1\na_total{x=\"1\"} 6\n# EOF\n"
+		p := NewOpenMetricsParser([]byte(input), WithRejectDuplicateSeries())
+		var err error
+		for err == nil {
+			_, err = p.Next()
+		}
+		require.EqualError(t, err, `duplicate series "a_total{x=\"1\"}" with conflicting values 5 and 6`)
+	})
+
+	t.Run("without the option both pass", func(t *testing.T) {
+		input := "a_total{x=\"1\"} 5\na_total{x=\"1\"} 6\n# EOF\n"
+		p := NewOpenMetricsParser([]byte(input))
+		var err error
+		for err == nil {
+			_, err = p.Next()
+		}
+		require.Equal(t, io.EOF, err)
+	})
+}
@@ -143,20 +143,70 @@ func (l *promlexer) Error(es string) {
 // PromParser parses samples from a byte slice of samples in the official
 // Prometheus text exposition format.
 type PromParser struct {
-	l       *promlexer
-	series  []byte
-	text    []byte
-	mtype   MetricType
-	val     float64
-	ts      int64
-	hasTS   bool
-	start   int
-	offsets []int
+	l         *promlexer
+	series    []byte
+	text      []byte
+	mtype     MetricType
+	types     map[string]MetricType
+	val       float64
+	ts        int64
+	hasTS     bool
+	start     int
+	offsets   []int
+	entries   int
+	lastEntry Entry
+
+	parseExemplars bool
+	nameScheme     NameValidationScheme
+	exemplarLbls   labels.Labels
+	exemplarVal    float64
+	exemplarTs     int64
+	hasExemplar    bool
+	hasExemplarTs  bool
+}
+
+// PromOption configures the behavior of a PromParser.
+type PromOption func(*PromParser)
+
+// WithExemplars makes the parser recognize OpenMetrics-style exemplar
+// comments trailing a sample, i.e. `# {trace_id="..."} value [timestamp]` on
+// the same line, as some exporters emit them even in the Prometheus format.
+// The exemplar is exposed via Exemplar. Comment lines starting with # are
+// unaffected and still produce comment entries.
+func WithExemplars() PromOption {
+	return func(p *PromParser) {
+		p.parseExemplars = true
+	}
+}
+
+// NameValidationScheme controls which metric names a parser accepts.
+type NameValidationScheme int
+
+const (
+	// LegacyValidation accepts only the classic character set
+	// [a-zA-Z_:][a-zA-Z0-9_:]*.
+	LegacyValidation NameValidationScheme = iota
+	// UTF8Validation additionally accepts any valid UTF-8 metric name.
+	UTF8Validation
+)
+
+// WithNameValidationScheme selects which metric names the parser accepts;
+// see NameValidationScheme. The default is LegacyValidation. Unlike a global
+// scheme, the option is scoped to one parser instance, so scrape goroutines
+// needing different schemes do not race on shared state.
+func WithNameValidationScheme(scheme NameValidationScheme) PromOption {
+	return func(p *PromParser) {
+		p.nameScheme = scheme
+	}
 }
 
 // NewPromParser returns a new parser of the byte slice.
-func NewPromParser(b []byte) Parser {
-	return &PromParser{l: &promlexer{b: append(b, '\n')}}
+func NewPromParser(b []byte, opts ...PromOption) Parser {
+	p := &PromParser{l: &promlexer{b: append(b, '\n')}, lastEntry: EntryInvalid}
+	for _, opt := range opts {
+		opt(p)
+	}
+	return p
 }
 
 // Series returns the bytes of the series, the timestamp if set, and the value
@@ -168,6 +218,48 @@ func (p *PromParser) Series() ([]byte, *int64, float64) {
 	return p.series, nil, p.val
 }
 
+// HasTimestamp returns true if the current sample carries an explicit
+// timestamp.
+// Must only be called after Next returned a series entry.
+func (p *PromParser) HasTimestamp() bool {
+	return p.hasTS
+}
+
+// EntryCount returns the number of entries Next has successfully returned so
+// far, not counting the terminal io.EOF. It saves callers that report
+// progress over large inputs from keeping their own counter.
+func (p *PromParser) EntryCount() int {
+	return p.entries
+}
+
+// LabelSpans returns the byte range of every name="value" pair of the current
+// series within the original input, in order of appearance, e.g. to highlight
+// individual labels in raw exposition text. Must only be called after Next
+// returned a series entry; the result is only valid until the next call to
+// Next.
+func (p *PromParser) LabelSpans() []LabelSpan {
+	spans := make([]LabelSpan, 0, (len(p.offsets)-1)/4)
+	for i := 1; i < len(p.offsets); i += 4 {
+		spans = append(spans, LabelSpan{
+			Name:  string(p.series[p.offsets[i]-p.start : p.offsets[i+1]-p.start]),
+			Start: p.offsets[i],
+			End:   p.offsets[i+3] + 1,
+		})
+	}
+	return spans
+}
+
+// Clone returns an independent copy of the parser positioned identically.
+// The input byte slice is shared, everything else is copied so advancing
+// either parser leaves the other untouched.
+func (p *PromParser) Clone() Parser {
+	c := *p
+	l := *p.l
+	c.l = &l
+	c.offsets = append([]int(nil), p.offsets...)
+	return &c
+}
+
 // Help returns the metric name and help text in the current entry.
 // Must only be called after Next returned a help entry.
 // The returned byte slices become invalid after the next call to Next.
@@ -235,10 +327,100 @@ func (p *PromParser) Metric(l *labels.Labels) string {
 	return s
 }
 
+// MetricInto resets the passed builder and sets the labels of the current
+// sample on it. It returns the string from which the metric was parsed.
+func (p *PromParser) MetricInto(b *labels.Builder) string {
+	// Allocate the full immutable string immediately, so we just
+	// have to create references on it below.
+	s := string(p.series)
+
+	b.Reset(nil)
+	b.Set(labels.MetricName, s[:p.offsets[0]-p.start])
+
+	for i := 1; i < len(p.offsets); i += 4 {
+		a := p.offsets[i] - p.start
+		c := p.offsets[i+1] - p.start
+		d := p.offsets[i+2] - p.start
+		e := p.offsets[i+3] - p.start
+
+		// Replacer causes allocations. Replace only when necessary.
+		if strings.IndexByte(s[d:e], byte('\\')) >= 0 {
+			b.Set(s[a:c], lvalReplacer.Replace(s[d:e]))
+			continue
+		}
+		b.Set(s[a:c], s[d:e])
+	}
+
+	return s
+}
+
+// MetricName returns just the metric name of the current sample.
+// Must only be called after Next returned a series entry.
+// The returned byte slice becomes invalid after the next call to Next.
+func (p *PromParser) MetricName() []byte {
+	return p.series[:p.offsets[0]-p.start]
+}
+
+// familyName returns the metric or family name of the current entry, nil if
+// the parser is not positioned on a named entry.
+func (p *PromParser) familyName() []byte {
+	switch p.lastEntry {
+	case EntrySeries:
+		return p.series[:p.offsets[0]-p.start]
+	case EntryHelp, EntryType, EntryUnit:
+		return p.l.b[p.offsets[0]:p.offsets[1]]
+	}
+	return nil
+}
+
+// Peek reports what the following call to Next will return, without
+// advancing the parser, e.g. for deciding how to finish the current entry
+// based on whether metadata or another sample follows. It works on an
+// independent Clone, so the current entry and its accessors stay valid and
+// each call parses the next entry once.
+func (p *PromParser) Peek() (Entry, error) {
+	return p.Clone().Next()
+}
+
+// ContentType returns the canonical Content-Type header value of the
+// Prometheus text exposition format.
+func (p *PromParser) ContentType() string {
+	return "text/plain; version=0.0.4; charset=utf-8"
+}
+
+// SkipToNextFamily advances the parser past the remaining entries of the
+// current metric family, so the following call to Next returns the first
+// metadata entry of the next family. The skipped lines are not lexed and no
+// labels are built for them. It returns io.EOF when the input holds no
+// further family.
+func (p *PromParser) SkipToNextFamily() error {
+	i, err := skipToFamilyBoundary(p.l.b, p.l.i, p.familyName())
+	p.l.i = i
+	return err
+}
+
 // Exemplar writes the exemplar of the current sample into the passed
-// exemplar. It returns if an exemplar exists.
+// exemplar. It returns if an exemplar exists. The Prometheus format has no
+// exemplars unless the parser was built with WithExemplars.
 func (p *PromParser) Exemplar(e *exemplar.Exemplar) bool {
-	return false
+	if !p.hasExemplar {
+		return false
+	}
+	e.Labels = append(e.Labels[:0], p.exemplarLbls...)
+	e.Value = p.exemplarVal
+	e.HasTs = p.hasExemplarTs
+	if p.hasExemplarTs {
+		e.Ts = p.exemplarTs
+	}
+	return true
+}
+
+// SeriesType returns the type declared for the metric family the current
+// series belongs to, resolving known family suffixes. It returns false if
+// no type entry was seen for the family.
+// Must only be called after Next returned a series entry.
+func (p *PromParser) SeriesType() (MetricType, bool) {
+	return seriesFamilyType(p.types, string(p.series[:p.offsets[0]-p.start]))
 }
 
 // nextToken returns the next token from the promlexer. It skips over tabs
@@ -258,10 +440,28 @@ func parseError(exp string, got token) error {
 // Next advances the parser to the next sample. It returns false if no
 // more samples were read or an error occurred.
 func (p *PromParser) Next() (Entry, error) {
+	e, err := p.next()
+	if err == nil {
+		p.entries++
+		p.lastEntry = e
+	}
+	return e, err
+}
+
+func (p *PromParser) next() (Entry, error) {
 	var err error
 
 	p.start = p.l.i
 	p.offsets = p.offsets[:0]
+	p.hasExemplar = false
+
+	// Metric names beyond the legacy character set never form a tMName
+	// token, so under UTF8Validation they are consumed before lexing.
+	if p.nameScheme == UTF8Validation && p.lexUTF8Name() {
+		p.offsets = append(p.offsets, p.l.i)
+		p.series = p.l.b[p.start:p.l.i]
+		return p.parseSeriesRest(tMName)
+	}
 
 	switch t := p.nextToken(); t {
 	case tEOF:
@@ -315,6 +515,10 @@ func (p *PromParser) Next() (Entry, error) {
 		case tHelp:
 			return EntryHelp, nil
 		case tType:
+			if p.types == nil {
+				p.types = map[string]MetricType{}
+			}
+			p.types[string(p.l.b[p.offsets[0]:p.offsets[1]])] = p.mtype
 			return EntryType, nil
 		}
 	case tComment:
@@ -327,46 +531,213 @@ func (p *PromParser) Next() (Entry, error) {
 	case tMName:
 		p.offsets = append(p.offsets, p.l.i)
 		p.series = p.l.b[p.start:p.l.i]
+		return p.parseSeriesRest(t)
 
-		t2 := p.nextToken()
-		if t2 == tBraceOpen {
-			if err := p.parseLVals(); err != nil {
-				return EntryInvalid, err
-			}
-			p.series = p.l.b[p.start:p.l.i]
-			t2 = p.nextToken()
+	default:
+		err = errors.Errorf("%q is not a valid start token", t)
+	}
+	return EntryInvalid, err
+}
+
+// parseSeriesRest parses the remainder of a series entry once the metric name
+// has been consumed: the optional label set, the value, the optional
+// timestamp and exemplar. t is the entry's start token, used in errors.
+func (p *PromParser) parseSeriesRest(t token) (Entry, error) {
+	var err error
+
+	t2 := p.nextToken()
+	if t2 == tBraceOpen {
+		if err := p.parseLVals(); err != nil {
+			return EntryInvalid, err
 		}
-		if t2 != tValue {
-			return EntryInvalid, parseError("expected value after metric", t)
+		p.series = p.l.b[p.start:p.l.i]
+		t2 = p.nextToken()
+	}
+	if t2 != tValue {
+		return EntryInvalid, parseError("expected value after metric", t)
+	}
+	if p.val, err = parseFloat(yoloString(p.l.buf())); err != nil {
+		return EntryInvalid, err
+	}
+	// Ensure canonical NaN value.
+	if math.IsNaN(p.val) {
+		p.val = math.Float64frombits(value.NormalNaN)
+	}
+	p.hasTS = false
+	if err := p.tryParseExemplar(); err != nil {
+		return EntryInvalid, err
+	}
+	switch p.nextToken() {
+	case tLinebreak:
+		break
+	case tTimestamp:
+		p.hasTS = true
+		if p.ts, err = strconv.ParseInt(yoloString(p.l.buf()), 10, 64); err != nil {
+			return EntryInvalid, err
 		}
-		if p.val, err = parseFloat(yoloString(p.l.buf())); err != nil {
+		if err := p.tryParseExemplar(); err != nil {
 			return EntryInvalid, err
 		}
-		// Ensure canonical NaN value.
-		if math.IsNaN(p.val) {
-			p.val = math.Float64frombits(value.NormalNaN)
+		if t2 := p.nextToken(); t2 != tLinebreak {
+			return EntryInvalid, parseError("expected next entry after timestamp", t)
 		}
-		p.hasTS = false
-		switch p.nextToken() {
-		case tLinebreak:
+	default:
+		return EntryInvalid, parseError("expected timestamp or new record", t)
+	}
+	return EntrySeries, nil
+}
+
+// lexUTF8Name consumes a metric name that the lexer's legacy character set
+// would reject, leaving the lexer positioned to continue with the label set
+// or value. It reports false, touching nothing, when the line starts with a
+// comment, a purely legacy name or anything but a valid UTF-8 name, so those
+// keep their usual handling.
+func (p *PromParser) lexUTF8Name() bool {
+	b, i := p.l.b, p.l.i
+	legacy := true
+	j := i
+	for j < len(b) {
+		c := b[j]
+		if c == ' ' || c == '\t' || c == '{' || c == '\n' {
 			break
-		case tTimestamp:
-			p.hasTS = true
-			if p.ts, err = strconv.ParseInt(yoloString(p.l.buf()), 10, 64); err != nil {
-				return EntryInvalid, err
-			}
-			if t2 := p.nextToken(); t2 != tLinebreak {
-				return EntryInvalid, parseError("expected next entry after timestamp", t)
+		}
+		if !(c == '_' || c == ':' ||
+			(c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')) {
+			legacy = false
+		}
+		j++
+	}
+	if j == i || legacy || b[i] == '#' || !utf8.Valid(b[i:j]) {
+		return false
+	}
+	p.l.i = j
+	p.l.state = sValue
+	return true
+}
+
+// tryParseExemplar consumes an OpenMetrics-style exemplar comment if one
+// trails the current sample on the same line, leaving the lexer positioned on
+// the closing linebreak. Without WithExemplars, or when the rest of the line
+// is no exemplar comment, it is a no-op.
+func (p *PromParser) tryParseExemplar() error {
+	if !p.parseExemplars {
+		return nil
+	}
+	b, i := p.l.b, p.l.i
+	for i < len(b) && (b[i] == ' ' || b[i] == '\t') {
+		i++
+	}
+	if i >= len(b) || b[i] != '#' {
+		return nil
+	}
+	j := i + 1
+	for j < len(b) && (b[j] == ' ' || b[j] == '\t') {
+		j++
+	}
+	if j >= len(b) || b[j] != '{' {
+		return nil
+	}
+
+	// Find the closing brace of the label set, skipping quoted values.
+	k := j + 1
+	for inQuotes := false; ; k++ {
+		if k >= len(b) || b[k] == '\n' {
+			return errors.New("unterminated exemplar label set")
+		}
+		if inQuotes {
+			if b[k] == '\\' {
+				k++
+			} else if b[k] == '"' {
+				inQuotes = false
 			}
-		default:
-			return EntryInvalid, parseError("expected timestamp or new record", t)
+			continue
+		}
+		if b[k] == '"' {
+			inQuotes = true
+		} else if b[k] == '}' {
+			break
 		}
-		return EntrySeries, nil
+	}
+	lset, err := parseExemplarLabelSet(b[j+1 : k])
+	if err != nil {
+		return err
+	}
 
-	default:
-		err = errors.Errorf("%q is not a valid start token", t)
+	// The value and an optional timestamp follow until the end of the line.
+	n := k + 1
+	for n < len(b) && b[n] != '\n' {
+		n++
 	}
-	return EntryInvalid, err
+	fields := strings.Fields(string(b[k+1 : n]))
+	if len(fields) < 1 || len(fields) > 2 {
+		return errors.Errorf("expected exemplar value and optional timestamp, got %d fields", len(fields))
+	}
+	val, err := parseFloat(fields[0])
+	if err != nil {
+		return err
+	}
+	if math.IsNaN(val) {
+		val = math.Float64frombits(value.NormalNaN)
+	}
+	p.hasExemplarTs = false
+	if len(fields) == 2 {
+		ts, err := parseFloat(fields[1])
+		if err != nil {
+			return err
+		}
+		p.hasExemplarTs = true
+		p.exemplarTs = timestampMillis(ts)
+	}
+	p.exemplarLbls = lset
+	p.exemplarVal = val
+	p.hasExemplar = true
+	p.l.i = n
+	return nil
+}
+
+// parseExemplarLabelSet parses the content between the braces of an exemplar
+// comment into a sorted label set.
+func parseExemplarLabelSet(b []byte) (labels.Labels, error) {
+	var lset labels.Labels
+	i := 0
+	for {
+		for i < len(b) && (b[i] == ' ' || b[i] == '\t' || b[i] == ',') {
+			i++
+		}
+		if i >= len(b) {
+			break
+		}
+		start := i
+		for i < len(b) && b[i] != '=' {
+			i++
+		}
+		if i >= len(b) {
+			return nil, errors.New("expected = after exemplar label name")
+		}
+		name := strings.TrimSpace(string(b[start:i]))
+		i++
+		for i < len(b) && (b[i] == ' ' || b[i] == '\t') {
+			i++
+		}
+		if i >= len(b) || b[i] != '"' {
+			return nil, errors.New("expected quoted exemplar label value")
+		}
+		i++
+		vstart := i
+		for i < len(b) && b[i] != '"' {
+			if b[i] == '\\' {
+				i++
+			}
+			i++
+		}
+		if i >= len(b) {
+			return nil, errors.New("unterminated exemplar label value")
+		}
+		lset = append(lset, labels.Label{Name: name, Value: lvalReplacer.Replace(string(b[vstart:i]))})
+		i++
+	}
+	sort.Sort(lset)
+	return lset, nil
 }
 
 func (p *PromParser) parseLVals() error {
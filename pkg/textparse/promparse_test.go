@@ -19,12 +19,14 @@ import (
 	"io"
 	"io/ioutil"
 	"os"
+	"sync"
 	"testing"
 
 	"github.com/prometheus/common/expfmt"
 	"github.com/prometheus/common/model"
 	"github.com/stretchr/testify/require"
 
+	"github.com/prometheus/prometheus/pkg/exemplar"
 	"github.com/prometheus/prometheus/pkg/labels"
 )
 
@@ -314,7 +316,7 @@ func TestPromNullByteHandling(t *testing.T) {
 		},
 		{
 			input: "a{b\x00=\"hiih\"}	1",
-			err: "expected equal, got \"INVALID\"",
+			err:   "expected equal, got \"INVALID\"",
 		},
 		{
 			input: "a\x00{b=\"ddd\"} 1",
@@ -339,14 +341,62 @@ func TestPromNullByteHandling(t *testing.T) {
 	}
 }
 
+func TestPromParseExemplars(t *testing.T) {
+	input := `go_goroutines 33 # {trace_id="abc"} 0.5
+http_requests_total{code="200"} 17 1520879607789 # {trace_id="def",span="x\"y"} 1.5 1520879607.789
+# {not="an exemplar"} 1
+plain 4
+`
+	p := NewPromParser([]byte(input), WithExemplars())
+
+	e, err := p.Next()
+	require.NoError(t, err)
+	require.Equal(t, EntrySeries, e)
+	var ex exemplar.Exemplar
+	require.True(t, p.Exemplar(&ex))
+	require.Equal(t, exemplar.Exemplar{
+		Labels: labels.FromStrings("trace_id", "abc"),
+		Value:  0.5,
+	}, ex)
+
+	e, err = p.Next()
+	require.NoError(t, err)
+	require.Equal(t, EntrySeries, e)
+	ex = exemplar.Exemplar{}
+	require.True(t, p.Exemplar(&ex))
+	require.Equal(t, exemplar.Exemplar{
+		Labels: labels.FromStrings("span", `x"y`, "trace_id", "def"),
+		Value:  1.5,
+		Ts:     1520879607789,
+		HasTs:  true,
+	}, ex)
+
+	// A full comment line is still a comment, even if it looks like an
+	// exemplar.
+	e, err = p.Next()
+	require.NoError(t, err)
+	require.Equal(t, EntryComment, e)
+
+	// Samples without an exemplar comment report none.
+	e, err = p.Next()
+	require.NoError(t, err)
+	require.Equal(t, EntrySeries, e)
+	require.False(t, p.Exemplar(&ex))
+
+	// Without the option the trailing comment is rejected as before.
+	p = NewPromParser([]byte("go_goroutines 33 # {trace_id=\"abc\"} 0.5\n"))
+	_, err = p.Next()
+	require.Error(t, err)
+}
+
 const (
 	promtestdataSampleCount = 410
 )
 
 func BenchmarkParse(b *testing.B) {
 	for parserName, parser := range map[string]func([]byte) Parser{
-		"prometheus":  NewPromParser,
-		"openmetrics": NewOpenMetricsParser,
+		"prometheus":  func(b []byte) Parser { return NewPromParser(b) },
+		"openmetrics": func(b []byte) Parser { return NewOpenMetricsParser(b) },
 	} {
 		for _, fn := range []string{"promtestdata.txt", "promtestdata.nometa.txt"} {
 			f, err := os.Open(fn)
@@ -519,3 +569,76 @@ func BenchmarkGzip(b *testing.B) {
 		})
 	}
 }
+
+func TestPromParseNameValidationScheme(t *testing.T) {
+	input := "http.requests.total{a=\"b\"} 17 1234568\n"
+	input += `valid_name 1` + "\n"
+	input += "requêtes_en_cours 3\n"
+
+	t.Run("legacy rejects", func(t *testing.T) {
+		p := NewPromParser([]byte(input))
+		_, err := p.Next()
+		require.Error(t, err)
+	})
+
+	t.Run("utf8 accepts", func(t *testing.T) {
+		p := NewPromParser([]byte(input), WithNameValidationScheme(UTF8Validation))
+
+		e, err := p.Next()
+		require.NoError(t, err)
+		require.Equal(t, EntrySeries, e)
+		var res labels.Labels
+		m, _, v := p.Series()
+		p.Metric(&res)
+		require.Equal(t, `http.requests.total{a="b"}`, string(m))
+		require.Equal(t, 17.0, v)
+		require.Equal(t, labels.FromStrings(model.MetricNameLabel, "http.requests.total", "a", "b"), res)
+
+		e, err = p.Next()
+		require.NoError(t, err)
+		require.Equal(t, EntrySeries, e)
+		m, _, _ = p.Series()
+		require.Equal(t, `valid_name`, string(m))
+
+		e, err = p.Next()
+		require.NoError(t, err)
+		require.Equal(t, EntrySeries, e)
+		m, _, _ = p.Series()
+		require.Equal(t, `requêtes_en_cours`, string(m))
+
+		_, err = p.Next()
+		require.Equal(t, io.EOF, err)
+	})
+
+	t.Run("invalid utf8 still rejected", func(t *testing.T) {
+		p := NewPromParser([]byte("na\xffme 1\n"), WithNameValidationScheme(UTF8Validation))
+		_, err := p.Next()
+		require.Error(t, err)
+	})
+}
+
+// TestPromParseSchemeConcurrent runs parsers with different validation
+// schemes side by side; the scheme is per instance, so neither may observe
+// the other's. Meant to be run with -race.
+func TestPromParseSchemeConcurrent(t *testing.T) {
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		utf8Scheme := i%2 == 0
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				if utf8Scheme {
+					p := NewPromParser([]byte("metric.α 1\n"), WithNameValidationScheme(UTF8Validation))
+					_, err := p.Next()
+					require.NoError(t, err)
+				} else {
+					p := NewPromParser([]byte("metric.α 1\n"))
+					_, err := p.Next()
+					require.Error(t, err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
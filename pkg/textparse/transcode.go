@@ -0,0 +1,125 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package textparse
+
+import (
+	"bufio"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/prometheus/pkg/labels"
+)
+
+var (
+	helpEscaper = strings.NewReplacer(
+		`\`, `\\`,
+		"\n", `\n`,
+	)
+	lvalEscaper = strings.NewReplacer(
+		`\`, `\\`,
+		`"`, `\"`,
+		"\n", `\n`,
+	)
+)
+
+// Transcode reads OpenMetrics input and writes the equivalent
+// `text/plain; version=0.0.4` Prometheus text format to dst. Constructs the
+// older format cannot represent are dropped: # UNIT lines, exemplars, and
+// _created series. HELP and TYPE metadata as well as sample timestamps are
+// preserved; metric types unknown to the Prometheus format are emitted as
+// untyped.
+func Transcode(dst io.Writer, omInput []byte) error {
+	var (
+		p    = NewOpenMetricsParser(omInput)
+		w    = bufio.NewWriter(dst)
+		lset labels.Labels
+	)
+	for {
+		et, err := p.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		switch et {
+		case EntryHelp:
+			m, txt := p.Help()
+			w.WriteString("# HELP ")
+			w.Write(m)
+			w.WriteByte(' ')
+			helpEscaper.WriteString(w, string(txt))
+			w.WriteByte('\n')
+
+		case EntryType:
+			m, typ := p.Type()
+			w.WriteString("# TYPE ")
+			w.Write(m)
+			w.WriteByte(' ')
+			switch typ {
+			case MetricTypeCounter, MetricTypeGauge, MetricTypeHistogram, MetricTypeSummary:
+				w.WriteString(string(typ))
+			default:
+				// The Prometheus format has no notion of the remaining
+				// OpenMetrics types.
+				w.WriteString("untyped")
+			}
+			w.WriteByte('\n')
+
+		case EntryUnit, EntryComment:
+			// The Prometheus format has no unit metadata, and comments
+			// carry no information worth transcoding.
+
+		case EntrySeries:
+			lset = lset[:0]
+			p.Metric(&lset)
+
+			name := lset.Get(labels.MetricName)
+			if strings.HasSuffix(name, "_created") {
+				// _created series have no Prometheus format equivalent.
+				continue
+			}
+
+			w.WriteString(name)
+			if len(lset) > 1 {
+				w.WriteByte('{')
+				for i, l := range lset {
+					if l.Name == labels.MetricName {
+						continue
+					}
+					if i > 1 {
+						w.WriteByte(',')
+					}
+					w.WriteString(l.Name)
+					w.WriteString(`="`)
+					lvalEscaper.WriteString(w, l.Value)
+					w.WriteByte('"')
+				}
+				w.WriteByte('}')
+			}
+
+			_, ts, v := p.Series()
+			w.WriteByte(' ')
+			w.WriteString(strconv.FormatFloat(v, 'g', -1, 64))
+			if ts != nil {
+				w.WriteByte(' ')
+				w.WriteString(strconv.FormatInt(*ts, 10))
+			}
+			w.WriteByte('\n')
+		}
+	}
+	return w.Flush()
+}
@@ -0,0 +1,110 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package textparse
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTranscode(t *testing.T) {
+	input := `# HELP go_gc_duration_seconds A summary of the GC invocation durations.
+# TYPE go_gc_duration_seconds summary
+# UNIT go_gc_duration_seconds seconds
+go_gc_duration_seconds{quantile="0"} 4.9351e-05
+go_gc_duration_seconds{quantile="0.25"} 7.424100000000001e-05
+go_gc_duration_seconds{quantile="0.5",a="b"} 8.3835e-05
+# HELP nohelp1 
+# HELP help2 escape \ \n \\ \" \x chars
+# UNIT nounit 
+go_gc_duration_seconds{quantile="1.0",a="b"} 8.3835e-05
+go_gc_duration_seconds_count 99
+go_gc_duration_seconds_created 1520872607.123
+some:aggregate:rate5m{a_b="c"} 1
+# HELP go_goroutines Number of goroutines that currently exist.
+# TYPE go_goroutines gauge
+go_goroutines 33 123.123
+# TYPE hh histogram
+hh_bucket{le="+Inf"} 1
+# TYPE gh gaugehistogram
+gh_bucket{le="+Inf"} 1
+# TYPE hhh histogram
+hhh_bucket{le="+Inf"} 1 # {aa="bb"} 4
+# TYPE ggh gaugehistogram
+ggh_bucket{le="+Inf"} 1 # {cc="dd",xx="yy"} 4 123.123
+# TYPE ii info
+ii{foo="bar"} 1
+# TYPE ss stateset
+ss{ss="foo"} 1
+ss{ss="bar"} 0
+# TYPE un unknown
+_metric_starting_with_underscore 1
+testmetric{_label_starting_with_underscore="foo"} 1
+testmetric{label="\"bar\""} 1
+# TYPE foo counter
+foo_total 17.0 1520879607.789 # {xx="yy"} 5
+# EOF
+`
+
+	expected := `# HELP go_gc_duration_seconds A summary of the GC invocation durations.
+# TYPE go_gc_duration_seconds summary
+go_gc_duration_seconds{quantile="0"} 4.9351e-05
+go_gc_duration_seconds{quantile="0.25"} 7.424100000000001e-05
+go_gc_duration_seconds{a="b",quantile="0.5"} 8.3835e-05
+# HELP nohelp1 
+# HELP help2 escape \\ \n \\ " \\x chars
+go_gc_duration_seconds{a="b",quantile="1.0"} 8.3835e-05
+go_gc_duration_seconds_count 99
+some:aggregate:rate5m{a_b="c"} 1
+# HELP go_goroutines Number of goroutines that currently exist.
+# TYPE go_goroutines gauge
+go_goroutines 33 123123
+# TYPE hh histogram
+hh_bucket{le="+Inf"} 1
+# TYPE gh untyped
+gh_bucket{le="+Inf"} 1
+# TYPE hhh histogram
+hhh_bucket{le="+Inf"} 1
+# TYPE ggh untyped
+ggh_bucket{le="+Inf"} 1
+# TYPE ii untyped
+ii{foo="bar"} 1
+# TYPE ss untyped
+ss{ss="foo"} 1
+ss{ss="bar"} 0
+# TYPE un untyped
+_metric_starting_with_underscore 1
+testmetric{_label_starting_with_underscore="foo"} 1
+testmetric{label="\"bar\""} 1
+# TYPE foo counter
+foo_total 17 1520879607789
+`
+
+	var buf bytes.Buffer
+	require.NoError(t, Transcode(&buf, []byte(input)))
+	require.Equal(t, expected, buf.String())
+
+	// The transcoded output must be parseable as Prometheus text format.
+	p := NewPromParser(buf.Bytes())
+	for {
+		_, err := p.Next()
+		if err != nil {
+			require.Equal(t, io.EOF, err)
+			break
+		}
+	}
+}
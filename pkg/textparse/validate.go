@@ -0,0 +1,93 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package textparse
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// ParseError is one problem Validate found, together with the byte offset in
+// the input at which the parser detected it.
+type ParseError struct {
+	Offset int
+	Err    error
+}
+
+func (e ParseError) Error() string {
+	return fmt.Sprintf("byte offset %d: %s", e.Offset, e.Err)
+}
+
+// maxValidateErrors caps the diagnostics Validate reports, so pathological
+// inputs where every line fails do not produce oversized results.
+const maxValidateErrors = 20
+
+// Validate parses b in the given format and returns every error it can find
+// rather than stopping at the first, e.g. for CI checks on exporter output.
+// After an error, parsing resumes at the following line, so one bad line does
+// not hide problems further down. A line skipped this way is not validated
+// beyond the reported error, and errors that only manifest across lines, like
+// out-of-order metadata, may be missed after a resume. An empty result means
+// the input parsed cleanly.
+func Validate(b []byte, format Format) []ParseError {
+	var errs []ParseError
+
+	base := 0
+	rest := b
+	for len(errs) < maxValidateErrors {
+		var (
+			p   Parser
+			pos func() int
+		)
+		switch format {
+		case FormatPrometheus:
+			// NewPromParser appends to its input, so it gets a copy.
+			pp := NewPromParser(append([]byte(nil), rest...)).(*PromParser)
+			p, pos = pp, func() int { return pp.l.i }
+		case FormatOpenMetrics:
+			op := NewOpenMetricsParser(rest).(*OpenMetricsParser)
+			p, pos = op, func() int { return op.l.i }
+		default:
+			return []ParseError{{Err: errors.Errorf("unsupported format %q", format)}}
+		}
+
+		var err error
+		for err == nil {
+			_, err = p.Next()
+		}
+		if err == io.EOF {
+			return errs
+		}
+		i := pos()
+		if i > len(rest) {
+			i = len(rest)
+		}
+		errs = append(errs, ParseError{Offset: base + i, Err: err})
+
+		// Resume with a fresh parser at the start of the next line.
+		j := bytes.IndexByte(rest[i:], '\n')
+		if j < 0 {
+			return errs
+		}
+		base += i + j + 1
+		rest = rest[i+j+1:]
+		if len(bytes.TrimSpace(rest)) == 0 {
+			return errs
+		}
+	}
+	return errs
+}
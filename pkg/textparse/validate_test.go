@@ -0,0 +1,64 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package textparse
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidate(t *testing.T) {
+	t.Run("clean input", func(t *testing.T) {
+		require.Empty(t, Validate([]byte("a 1\nb 2\n"), FormatPrometheus))
+		require.Empty(t, Validate([]byte("a_total 1\n# EOF\n"), FormatOpenMetrics))
+	})
+
+	t.Run("two independent errors", func(t *testing.T) {
+		input := "a{ 1\nb 2\nc 3 3 3\nd 4\n"
+		errs := Validate([]byte(input), FormatPrometheus)
+		require.Len(t, errs, 2)
+		require.Contains(t, errs[0].Error(), "expected label name")
+		require.Contains(t, errs[1].Error(), "expected next entry after timestamp")
+		// The second offset points past the first two lines.
+		require.Greater(t, errs[1].Offset, len("a{ 1\nb 2\n"))
+	})
+
+	t.Run("openmetrics resumes too", func(t *testing.T) {
+		input := "a_total 1\n# TYPE b untyped\nc_total 2\nd{ 3\n# EOF\n"
+		errs := Validate([]byte(input), FormatOpenMetrics)
+		require.Len(t, errs, 2)
+		require.Contains(t, errs[0].Error(), "invalid metric type")
+		require.Contains(t, errs[1].Error(), "expected label name")
+	})
+
+	t.Run("missing EOF marker", func(t *testing.T) {
+		errs := Validate([]byte("a_total 1\n"), FormatOpenMetrics)
+		require.Len(t, errs, 1)
+		require.Contains(t, errs[0].Error(), "# EOF")
+	})
+
+	t.Run("error cap", func(t *testing.T) {
+		input := strings.Repeat("x{ 1\n", 100)
+		errs := Validate([]byte(input), FormatPrometheus)
+		require.Len(t, errs, maxValidateErrors)
+	})
+
+	t.Run("unknown format", func(t *testing.T) {
+		errs := Validate([]byte("a 1\n"), FormatUnknown)
+		require.Len(t, errs, 1)
+		require.Contains(t, errs[0].Error(), "unsupported format")
+	})
+}
@@ -0,0 +1,29 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package promql
+
+import (
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+// RuleDependencies returns the metrics a recording or alerting rule
+// expression reads, as the sorted, distinct metric names its selectors match
+// by __name__ equality. The returned bool is true when the dependency set is
+// conservative: some selector matched metric names via regex or negation, or
+// carried no metric name matcher at all, so a scheduler cannot rely on the
+// name list being complete and should fall back to conservative ordering.
+func RuleDependencies(expr parser.Expr) ([]string, bool) {
+	names, open := parser.ExtractMetricNames(expr)
+	return names, open
+}
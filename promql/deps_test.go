@@ -0,0 +1,60 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package promql
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+func TestRuleDependencies(t *testing.T) {
+	cases := []struct {
+		input        string
+		deps         []string
+		conservative bool
+	}{
+		{
+			input: `sum by (job)(rate(http_requests_total[5m]))`,
+			deps:  []string{"http_requests_total"},
+		},
+		{
+			input: `b / a + b`,
+			deps:  []string{"a", "b"},
+		},
+		{
+			input:        `sum({job="api"})`,
+			deps:         []string{},
+			conservative: true,
+		},
+		{
+			input:        `rate({__name__=~"http_.*"}[5m]) / http_requests_total`,
+			deps:         []string{"http_requests_total"},
+			conservative: true,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.input, func(t *testing.T) {
+			expr, err := parser.ParseExpr(c.input)
+			require.NoError(t, err)
+
+			deps, conservative := RuleDependencies(expr)
+			require.Equal(t, c.deps, deps)
+			require.Equal(t, c.conservative, conservative)
+		})
+	}
+}
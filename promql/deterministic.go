@@ -0,0 +1,68 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package promql
+
+import (
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+// nonDeterministicFunctions are the functions whose result depends on the
+// engine's evaluation time rather than only on the selected samples:
+//
+//   - time returns the evaluation timestamp itself.
+//   - timestamp returns sample timestamps, which shift as live data arrives
+//     for the same query.
+//
+// The date functions (minute, hour, day_of_week, day_of_month, days_in_month,
+// month, year) are deterministic transforms of their input, but default to
+// the evaluation time when called without arguments, so a bare call is
+// treated as non-deterministic too.
+var nonDeterministicFunctions = map[string]struct{}{
+	"time":      {},
+	"timestamp": {},
+}
+
+// implicitTimeFunctions default their missing argument to vector(time()).
+var implicitTimeFunctions = map[string]struct{}{
+	"minute":        {},
+	"hour":          {},
+	"day_of_week":   {},
+	"day_of_month":  {},
+	"days_in_month": {},
+	"month":         {},
+	"year":          {},
+}
+
+// IsDeterministic reports whether evaluating expr at a given instant depends
+// only on the data selected at that instant, so a results cache may key its
+// output by (query, time). It returns false when the expression calls one of
+// nonDeterministicFunctions, or a date function without arguments.
+func IsDeterministic(expr parser.Expr) bool {
+	deterministic := true
+	//nolint: errcheck
+	parser.Inspect(expr, func(node parser.Node, _ []parser.Node) error {
+		call, ok := node.(*parser.Call)
+		if !ok {
+			return nil
+		}
+		if _, ok := nonDeterministicFunctions[call.Func.Name]; ok {
+			deterministic = false
+		}
+		if _, ok := implicitTimeFunctions[call.Func.Name]; ok && len(call.Args) == 0 {
+			deterministic = false
+		}
+		return nil
+	})
+	return deterministic
+}
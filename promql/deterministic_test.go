@@ -0,0 +1,46 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package promql
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+func TestIsDeterministic(t *testing.T) {
+	cases := []struct {
+		input         string
+		deterministic bool
+	}{
+		{input: `foo{job="api"}`, deterministic: true},
+		{input: `rate(x[5m])`, deterministic: true},
+		{input: `time()`, deterministic: false},
+		{input: `time() - foo`, deterministic: false},
+		{input: `timestamp(foo)`, deterministic: false},
+		{input: `hour()`, deterministic: false},
+		{input: `hour(foo)`, deterministic: true},
+		{input: `sum by (job)(rate(foo[5m]))`, deterministic: true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.input, func(t *testing.T) {
+			expr, err := parser.ParseExpr(c.input)
+			require.NoError(t, err)
+			require.Equal(t, c.deterministic, IsDeterministic(expr))
+		})
+	}
+}
@@ -577,7 +577,7 @@ func (ng *Engine) execEvalStmt(ctx context.Context, query *query, s *parser.Eval
 }
 
 // subqueryOffsetRange returns the sum of offsets and ranges of all subqueries in the path.
-func (ng *Engine) subqueryOffsetRange(path []parser.Node) (time.Duration, time.Duration) {
+func subqueryOffsetRange(path []parser.Node) (time.Duration, time.Duration) {
 	var (
 		subqOffset time.Duration
 		subqRange  time.Duration
@@ -595,7 +595,7 @@ func (ng *Engine) subqueryOffsetRange(path []parser.Node) (time.Duration, time.D
 func (ng *Engine) findMinTime(s *parser.EvalStmt) time.Time {
 	var maxOffset time.Duration
 	parser.Inspect(s.Expr, func(node parser.Node, path []parser.Node) error {
-		subqOffset, subqRange := ng.subqueryOffsetRange(path)
+		subqOffset, subqRange := subqueryOffsetRange(path)
 		switch n := node.(type) {
 		case *parser.VectorSelector:
 			if maxOffset < ng.lookbackDelta+subqOffset+subqRange {
@@ -636,7 +636,7 @@ func (ng *Engine) populateSeries(querier storage.Querier, s *parser.EvalStmt) {
 			// The subqueryOffsetRange function gives the sum of range and the
 			// sum of offset.
 			// TODO(bwplotka): Add support for better hints when subquerying. See: https://github.com/prometheus/prometheus/issues/7630.
-			subqOffset, subqRange := ng.subqueryOffsetRange(path)
+			subqOffset, subqRange := subqueryOffsetRange(path)
 			offsetMilliseconds := durationMilliseconds(subqOffset)
 			hints.Start = hints.Start - offsetMilliseconds - durationMilliseconds(subqRange)
 			hints.End = hints.End - offsetMilliseconds
@@ -0,0 +1,91 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package promql
+
+import (
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+// FindComparisonsWithoutBool returns the positions of comparison operators in
+// expr that compare a vector against a scalar without the bool modifier. Such
+// comparisons filter the vector instead of yielding 0/1 values, which in
+// recording rules is usually a mistake (`up == 1` rather than
+// `up == bool 1`). Comparisons between two vectors are deliberate filtering
+// between series and are not reported.
+func FindComparisonsWithoutBool(expr parser.Expr) []parser.PositionRange {
+	var found []parser.PositionRange
+	parser.Inspect(expr, func(node parser.Node, _ []parser.Node) error {
+		be, ok := node.(*parser.BinaryExpr)
+		if !ok || !be.Op.IsComparisonOperator() || be.ReturnBool {
+			return nil
+		}
+		lt, rt := be.LHS.Type(), be.RHS.Type()
+		if (lt == parser.ValueTypeVector && rt == parser.ValueTypeScalar) ||
+			(lt == parser.ValueTypeScalar && rt == parser.ValueTypeVector) {
+			found = append(found, be.PositionRange())
+		}
+		return nil
+	})
+	return found
+}
+
+// rateFamilyFunctions are the functions that turn a counter's monotonic
+// growth into a meaningful value, making a raw counter selector below them
+// intentional.
+var rateFamilyFunctions = map[string]struct{}{
+	"rate":     {},
+	"irate":    {},
+	"increase": {},
+	"resets":   {},
+}
+
+// FindBareCounters returns the positions of selectors in expr that read a
+// counter metric without a rate-family function (rate, irate, increase,
+// resets) anywhere above them. Evaluating a counter's raw value in a
+// recording rule is almost always a bug, since the result depends on process
+// restarts rather than traffic. Which names are counters is up to the
+// caller-supplied classifier, e.g. one treating *_total names or type
+// metadata from scrapes as counters.
+func FindBareCounters(expr parser.Expr, isCounter func(name string) bool) []parser.PositionRange {
+	var found []parser.PositionRange
+	//nolint: errcheck
+	parser.Inspect(expr, func(node parser.Node, path []parser.Node) error {
+		vs, ok := node.(*parser.VectorSelector)
+		if !ok {
+			return nil
+		}
+		name := vs.Name
+		if name == "" {
+			for _, m := range vs.LabelMatchers {
+				if m.Name == labels.MetricName && m.Type == labels.MatchEqual {
+					name = m.Value
+				}
+			}
+		}
+		if name == "" || !isCounter(name) {
+			return nil
+		}
+		for _, ancestor := range path {
+			if call, ok := ancestor.(*parser.Call); ok {
+				if _, ok := rateFamilyFunctions[call.Func.Name]; ok {
+					return nil
+				}
+			}
+		}
+		found = append(found, vs.PositionRange())
+		return nil
+	})
+	return found
+}
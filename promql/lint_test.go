@@ -0,0 +1,79 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package promql
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+func TestFindComparisonsWithoutBool(t *testing.T) {
+	for _, test := range []struct {
+		input string
+		found int
+	}{
+		{`up == 1`, 1},
+		{`up == bool 1`, 0},
+		{`1 >= up`, 1},
+		// Vector-vector comparisons filter between series and are fine.
+		{`node_load1 > node_load5`, 0},
+		{`sum(rate(x[5m])) > 0.5 or sum(rate(y[5m])) > 0.5`, 2},
+		// Non-comparison operators are never reported.
+		{`up + 1`, 0},
+	} {
+		expr, err := parser.ParseExpr(test.input)
+		require.NoError(t, err)
+		require.Len(t, FindComparisonsWithoutBool(expr), test.found, "input %q", test.input)
+	}
+
+	// The reported position covers the offending comparison.
+	expr, err := parser.ParseExpr(`sum(up == 1)`)
+	require.NoError(t, err)
+	found := FindComparisonsWithoutBool(expr)
+	require.Len(t, found, 1)
+	require.Equal(t, parser.PositionRange{Start: 4, End: 11}, found[0])
+}
+
+func TestFindBareCounters(t *testing.T) {
+	isCounter := func(name string) bool {
+		return strings.HasSuffix(name, "_total")
+	}
+
+	cases := []struct {
+		input string
+		found int
+	}{
+		{input: `http_requests_total`, found: 1},
+		{input: `sum by (job)(http_requests_total)`, found: 1},
+		{input: `rate(http_requests_total[5m])`, found: 0},
+		{input: `sum(increase(http_requests_total[1h]))`, found: 0},
+		{input: `irate(http_requests_total[5m]) / http_errors_total`, found: 1},
+		{input: `resets(http_requests_total[1h])`, found: 0},
+		// Gauges are never reported, with or without rate.
+		{input: `node_load1`, found: 0},
+		{input: `max_over_time(http_requests_total[5m])`, found: 1},
+	}
+
+	for _, c := range cases {
+		t.Run(c.input, func(t *testing.T) {
+			expr, err := parser.ParseExpr(c.input)
+			require.NoError(t, err)
+			require.Len(t, FindBareCounters(expr, isCounter), c.found)
+		})
+	}
+}
@@ -0,0 +1,235 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package promql
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+// NormalizeMatchers merges redundant matchers on the same label and errors on
+// contradictions, so callers combining matcher sets from several sources
+// (e.g. user input plus policy) do not construct selectors that can never
+// match. Exact duplicates collapse to one matcher, and a matcher that is
+// subsumed by an equality matcher on the same label is dropped. Two equality
+// matchers with different values, or any matcher an equality matcher's value
+// fails, are contradictions. Matchers that cannot be proven redundant or
+// contradictory are kept unchanged, in their input order.
+func NormalizeMatchers(matchers []*labels.Matcher) ([]*labels.Matcher, error) {
+	ret := make([]*labels.Matcher, 0, len(matchers))
+	equals := map[string]*labels.Matcher{}
+
+	for _, m := range matchers {
+		redundant := false
+		for _, prev := range ret {
+			if prev.Type == m.Type && prev.Name == m.Name && prev.Value == m.Value {
+				redundant = true
+				break
+			}
+		}
+		if redundant {
+			continue
+		}
+
+		if eq, ok := equals[m.Name]; ok {
+			keep, err := checkAgainstEqual(eq, m)
+			if err != nil {
+				return nil, err
+			}
+			if !keep {
+				continue
+			}
+		}
+
+		if m.Type == labels.MatchEqual {
+			if eq, ok := equals[m.Name]; ok && eq.Value != m.Value {
+				return nil, errors.Errorf("contradictory matchers for label %q: %s and %s", m.Name, eq, m)
+			}
+			equals[m.Name] = m
+			// Matchers appended earlier may now be subsumed or
+			// contradicted by the equality.
+			kept := ret[:0]
+			for _, prev := range ret {
+				if prev.Name != m.Name {
+					kept = append(kept, prev)
+					continue
+				}
+				keep, err := checkAgainstEqual(m, prev)
+				if err != nil {
+					return nil, err
+				}
+				if keep {
+					kept = append(kept, prev)
+				}
+			}
+			ret = kept
+		}
+		ret = append(ret, m)
+	}
+	return ret, nil
+}
+
+// checkAgainstEqual decides the fate of matcher m on the same label as the
+// equality matcher eq: if eq's value fails m the combination can never match,
+// if it passes m is subsumed and can be dropped. m itself being an equality
+// matcher is resolved by the caller.
+func checkAgainstEqual(eq, m *labels.Matcher) (keep bool, err error) {
+	if m.Type == labels.MatchEqual {
+		if m.Value != eq.Value {
+			return false, errors.Errorf("contradictory matchers for label %q: %s and %s", m.Name, eq, m)
+		}
+		return false, nil
+	}
+	// Struct-literal matchers have no compiled regex; rebuild to evaluate.
+	compiled, cerr := labels.NewMatcher(m.Type, m.Name, m.Value)
+	if cerr != nil {
+		return false, errors.Wrapf(cerr, "invalid matcher %s", m)
+	}
+	if !compiled.Matches(eq.Value) {
+		return false, errors.Errorf("contradictory matchers for label %q: %s and %s", m.Name, eq, m)
+	}
+	return false, nil
+}
+
+// CoveringMatchers returns one matcher set matching every series any vector
+// selector in expr can match, so a storage proxy can pre-fetch a query like
+// `{job="a"} or {job="b"}` in a single call. When the selectors differ only
+// in equality matchers on one label, they collapse to a regex matcher over
+// the values (`job=~"a|b"`). Otherwise only the matchers every selector
+// shares are kept. Either way the result is a conservative superset of what
+// the query reads - it may over-fetch, never under-fetch. An expression
+// without selectors, or whose selectors share nothing, yields nil, meaning
+// no constraint at all.
+func CoveringMatchers(expr parser.Expr) []*labels.Matcher {
+	var sels []*parser.VectorSelector
+	//nolint: errcheck
+	parser.Inspect(expr, func(node parser.Node, _ []parser.Node) error {
+		if vs, ok := node.(*parser.VectorSelector); ok {
+			sels = append(sels, vs)
+		}
+		return nil
+	})
+	if len(sels) == 0 {
+		return nil
+	}
+	if len(sels) == 1 {
+		return append([]*labels.Matcher(nil), sels[0].LabelMatchers...)
+	}
+
+	if collapsed, ok := collapseSelectors(sels); ok {
+		return collapsed
+	}
+
+	// Fall back to the matchers present identically in every selector.
+	var ret []*labels.Matcher
+	for _, m := range sels[0].LabelMatchers {
+		shared := true
+		for _, vs := range sels[1:] {
+			if !hasMatcher(vs.LabelMatchers, m) {
+				shared = false
+				break
+			}
+		}
+		if shared {
+			ret = append(ret, m)
+		}
+	}
+	return ret
+}
+
+// collapseSelectors merges selectors that differ only in equality matchers on
+// a single label into the shared matchers plus one regex matcher over that
+// label's values. It reports false when the selectors do not have that shape.
+func collapseSelectors(sels []*parser.VectorSelector) ([]*labels.Matcher, bool) {
+	base := sels[0].LabelMatchers
+	for _, vs := range sels[1:] {
+		if len(vs.LabelMatchers) != len(base) {
+			return nil, false
+		}
+	}
+
+	// Each selector must have exactly one matcher per label name for the
+	// positional comparison below to be meaningful.
+	byName := make([]map[string]*labels.Matcher, len(sels))
+	for i, vs := range sels {
+		byName[i] = make(map[string]*labels.Matcher, len(vs.LabelMatchers))
+		for _, m := range vs.LabelMatchers {
+			if _, ok := byName[i][m.Name]; ok {
+				return nil, false
+			}
+			byName[i][m.Name] = m
+		}
+	}
+
+	diffName := ""
+	var values []string
+	var ret []*labels.Matcher
+	for _, m := range base {
+		identical := true
+		for _, other := range byName[1:] {
+			o, ok := other[m.Name]
+			if !ok {
+				return nil, false
+			}
+			if o.Type != m.Type || o.Value != m.Value {
+				identical = false
+			}
+		}
+		if identical {
+			ret = append(ret, m)
+			continue
+		}
+		if diffName != "" {
+			// Selectors differ on more than one label.
+			return nil, false
+		}
+		diffName = m.Name
+		seen := map[string]struct{}{}
+		for _, other := range byName {
+			o := other[m.Name]
+			if o.Type != labels.MatchEqual {
+				return nil, false
+			}
+			if _, ok := seen[o.Value]; ok {
+				continue
+			}
+			seen[o.Value] = struct{}{}
+			values = append(values, regexp.QuoteMeta(o.Value))
+		}
+	}
+	if diffName == "" {
+		// All selectors are identical; the shared matchers cover them.
+		return ret, true
+	}
+	merged, err := labels.NewMatcher(labels.MatchRegexp, diffName, strings.Join(values, "|"))
+	if err != nil {
+		return nil, false
+	}
+	return append(ret, merged), true
+}
+
+// hasMatcher reports whether ms holds a matcher identical to m.
+func hasMatcher(ms []*labels.Matcher, m *labels.Matcher) bool {
+	for _, o := range ms {
+		if o.Type == m.Type && o.Name == m.Name && o.Value == m.Value {
+			return true
+		}
+	}
+	return false
+}
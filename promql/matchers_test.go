@@ -0,0 +1,168 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package promql
+
+import (
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+func TestNormalizeMatchers(t *testing.T) {
+	mustMatcher := func(mt labels.MatchType, name, value string) *labels.Matcher {
+		m, err := labels.NewMatcher(mt, name, value)
+		require.NoError(t, err)
+		return m
+	}
+
+	for _, test := range []struct {
+		input    []*labels.Matcher
+		expected []string
+		errors   bool
+	}{
+		// Exact duplicates collapse.
+		{
+			input: []*labels.Matcher{
+				mustMatcher(labels.MatchEqual, "a", "x"),
+				mustMatcher(labels.MatchEqual, "a", "x"),
+				mustMatcher(labels.MatchRegexp, "b", "y.*"),
+				mustMatcher(labels.MatchRegexp, "b", "y.*"),
+			},
+			expected: []string{`a="x"`, `b=~"y.*"`},
+		},
+		// An equality matcher subsumes compatible matchers on the label.
+		{
+			input: []*labels.Matcher{
+				mustMatcher(labels.MatchEqual, "a", "x"),
+				mustMatcher(labels.MatchRegexp, "a", "x.*"),
+				mustMatcher(labels.MatchNotEqual, "a", "y"),
+			},
+			expected: []string{`a="x"`},
+		},
+		// ...also when the equality matcher comes last.
+		{
+			input: []*labels.Matcher{
+				mustMatcher(labels.MatchRegexp, "a", "x.*"),
+				mustMatcher(labels.MatchEqual, "a", "x"),
+			},
+			expected: []string{`a="x"`},
+		},
+		// Unrelated labels are kept in input order.
+		{
+			input: []*labels.Matcher{
+				mustMatcher(labels.MatchNotRegexp, "b", "z.*"),
+				mustMatcher(labels.MatchEqual, "a", "x"),
+			},
+			expected: []string{`b!~"z.*"`, `a="x"`},
+		},
+		// Contradictions error instead of producing a dead selector.
+		{
+			input: []*labels.Matcher{
+				mustMatcher(labels.MatchEqual, "a", "x"),
+				mustMatcher(labels.MatchEqual, "a", "y"),
+			},
+			errors: true,
+		},
+		{
+			input: []*labels.Matcher{
+				mustMatcher(labels.MatchEqual, "a", "x"),
+				mustMatcher(labels.MatchNotEqual, "a", "x"),
+			},
+			errors: true,
+		},
+		{
+			input: []*labels.Matcher{
+				mustMatcher(labels.MatchEqual, "a", "x"),
+				mustMatcher(labels.MatchRegexp, "a", "y.*"),
+			},
+			errors: true,
+		},
+		{
+			input: []*labels.Matcher{
+				mustMatcher(labels.MatchNotRegexp, "a", "x.*"),
+				mustMatcher(labels.MatchEqual, "a", "x"),
+			},
+			errors: true,
+		},
+	} {
+		got, err := NormalizeMatchers(test.input)
+		if test.errors {
+			require.Error(t, err)
+			continue
+		}
+		require.NoError(t, err)
+		strs := make([]string, 0, len(got))
+		for _, m := range got {
+			strs = append(strs, m.String())
+		}
+		require.Equal(t, test.expected, strs)
+	}
+}
+
+func TestCoveringMatchers(t *testing.T) {
+	matcherStrings := func(ms []*labels.Matcher) []string {
+		var ss []string
+		for _, m := range ms {
+			ss = append(ss, m.String())
+		}
+		sort.Strings(ss)
+		return ss
+	}
+
+	cases := []struct {
+		input string
+		want  []string
+	}{
+		{
+			input: `{job="a"} or {job="b"}`,
+			want:  []string{`job=~"a|b"`},
+		},
+		{
+			input: `foo{job="a"} or foo{job="b"} or foo{job="c"}`,
+			want:  []string{`__name__="foo"`, `job=~"a|b|c"`},
+		},
+		{
+			// Regex metacharacters in values are quoted, not interpreted.
+			input: `foo{job="a.b"} or foo{job="c"}`,
+			want:  []string{`__name__="foo"`, `job=~"a\\.b|c"`},
+		},
+		{
+			// Differing on two labels cannot collapse; the shared name
+			// matcher remains as the conservative superset.
+			input: `foo{job="a",env="p"} or foo{job="b",zone="x"}`,
+			want:  []string{`__name__="foo"`},
+		},
+		{
+			// Nothing shared at all: no constraint.
+			input: `foo{job="a"} or bar{zone="x"}`,
+			want:  nil,
+		},
+		{
+			input: `rate(foo{job="a"}[5m])`,
+			want:  []string{`__name__="foo"`, `job="a"`},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.input, func(t *testing.T) {
+			expr, err := parser.ParseExpr(c.input)
+			require.NoError(t, err)
+			require.Equal(t, c.want, matcherStrings(CoveringMatchers(expr)))
+		})
+	}
+}
@@ -0,0 +1,50 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package promql
+
+import (
+	"sort"
+
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+// OutputLabels reports which labels the top-level node of expr can produce,
+// e.g. for a query builder offering valid downstream `by` clauses. When open
+// is false, names is the exact, sorted set of output labels: `sum by (a, b)`
+// yields [a, b]. When open is true the output labels depend on the data, and
+// names holds the labels known to be absent: `sum without (c)` yields [c],
+// meaning "all incoming labels minus c", and a bare selector yields no names
+// at all. Expressions other than a top-level aggregation, possibly in
+// parentheses, are always open.
+func OutputLabels(expr parser.Expr) (names []string, open bool) {
+	for {
+		paren, ok := expr.(*parser.ParenExpr)
+		if !ok {
+			break
+		}
+		expr = paren.Expr
+	}
+	agg, ok := expr.(*parser.AggregateExpr)
+	if !ok {
+		return nil, true
+	}
+
+	grouping := make([]string, 0, len(agg.Grouping))
+	grouping = append(grouping, agg.Grouping...)
+	sort.Strings(grouping)
+	if agg.Without {
+		return grouping, true
+	}
+	return grouping, false
+}
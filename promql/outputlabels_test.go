@@ -0,0 +1,48 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package promql
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+func TestOutputLabels(t *testing.T) {
+	cases := []struct {
+		input string
+		names []string
+		open  bool
+	}{
+		{input: `sum by (b, a)(foo)`, names: []string{"a", "b"}},
+		{input: `sum(foo)`, names: []string{}},
+		{input: `(max by (job)(rate(foo[5m])))`, names: []string{"job"}},
+		{input: `sum without (c)(foo)`, names: []string{"c"}, open: true},
+		{input: `foo{job="api"}`, names: nil, open: true},
+		{input: `sum(foo) / bar`, names: nil, open: true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.input, func(t *testing.T) {
+			expr, err := parser.ParseExpr(c.input)
+			require.NoError(t, err)
+
+			names, open := OutputLabels(expr)
+			require.Equal(t, c.names, names)
+			require.Equal(t, c.open, open)
+		})
+	}
+}
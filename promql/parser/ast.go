@@ -305,6 +305,23 @@ func Inspect(node Node, f inspector) {
 	Walk(inspector(f), node, nil)
 }
 
+// InspectWithParents traverses an AST in depth-first order in the same order
+// as Inspect, additionally providing the node enclosing each visited node.
+// The parent of the root node is nil. Traversal stops at the first error
+// returned by f, which is also returned.
+func InspectWithParents(node Node, f func(node, parent Node) error) error {
+	return Walk(inspector(func(n Node, path []Node) error {
+		if n == nil {
+			return nil
+		}
+		var parent Node
+		if len(path) > 0 {
+			parent = path[len(path)-1]
+		}
+		return f(n, parent)
+	}), node, nil)
+}
+
 // Children returns a list of all child nodes of a syntax tree node.
 func Children(node Node) []Node {
 	// For some reasons these switches have significantly better performance than interfaces
@@ -0,0 +1,61 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package parser
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInspectWithParents(t *testing.T) {
+	expr, err := ParseExpr(`rate(x[5m])`)
+	require.NoError(t, err)
+
+	type visit struct {
+		node, parent string
+	}
+	var visits []visit
+	typeName := func(n Node) string {
+		if n == nil {
+			return "<nil>"
+		}
+		return fmt.Sprintf("%T", n)
+	}
+	require.NoError(t, InspectWithParents(expr, func(node, parent Node) error {
+		visits = append(visits, visit{node: typeName(node), parent: typeName(parent)})
+		return nil
+	}))
+
+	require.Equal(t, []visit{
+		{node: "*parser.Call", parent: "<nil>"},
+		{node: "*parser.MatrixSelector", parent: "*parser.Call"},
+		{node: "*parser.VectorSelector", parent: "*parser.MatrixSelector"},
+	}, visits)
+}
+
+func TestInspectWithParentsError(t *testing.T) {
+	expr, err := ParseExpr(`rate(x[5m])`)
+	require.NoError(t, err)
+
+	visited := 0
+	sentinel := errors.New("stop")
+	require.Equal(t, sentinel, InspectWithParents(expr, func(node, parent Node) error {
+		visited++
+		return sentinel
+	}))
+	require.Equal(t, 1, visited)
+}
@@ -0,0 +1,173 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package parser
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/model"
+)
+
+// Canonical renders expr to a canonical minimal string: label matchers and
+// grouping labels are sorted, whitespace is normalized and redundant
+// parentheses are removed, so semantically equivalent queries hash to the
+// same fingerprint. Order-sensitive constructs such as binary operands keep
+// their order, so a-b and b-a stay distinct.
+func Canonical(expr Expr) string {
+	switch e := expr.(type) {
+	case *ParenExpr:
+		// Parentheses are re-added below only where precedence or the
+		// grammar require them.
+		return Canonical(e.Expr)
+
+	case *UnaryExpr:
+		inner := Canonical(e.Expr)
+		if _, ok := unwrapParens(e.Expr).(*BinaryExpr); ok {
+			inner = "(" + inner + ")"
+		}
+		return e.Op.String() + inner
+
+	case *BinaryExpr:
+		lhs := canonicalOperand(e.LHS, e.Op, false)
+		rhs := canonicalOperand(e.RHS, e.Op, true)
+
+		returnBool := ""
+		if e.ReturnBool {
+			returnBool = " bool"
+		}
+		matching := ""
+		if vm := e.VectorMatching; vm != nil && (len(vm.MatchingLabels) > 0 || vm.On) {
+			lbls := sortedCopy(vm.MatchingLabels)
+			if vm.On {
+				matching = fmt.Sprintf(" on(%s)", strings.Join(lbls, ", "))
+			} else {
+				matching = fmt.Sprintf(" ignoring(%s)", strings.Join(lbls, ", "))
+			}
+			if vm.Card == CardManyToOne || vm.Card == CardOneToMany {
+				matching += " group_"
+				if vm.Card == CardManyToOne {
+					matching += "left"
+				} else {
+					matching += "right"
+				}
+				matching += fmt.Sprintf("(%s)", strings.Join(sortedCopy(vm.Include), ", "))
+			}
+		}
+		return fmt.Sprintf("%s %s%s%s %s", lhs, e.Op, returnBool, matching, rhs)
+
+	case *AggregateExpr:
+		aggr := e.Op.String()
+		if e.Without {
+			aggr += fmt.Sprintf(" without(%s) ", strings.Join(sortedCopy(e.Grouping), ", "))
+		} else if len(e.Grouping) > 0 {
+			aggr += fmt.Sprintf(" by(%s) ", strings.Join(sortedCopy(e.Grouping), ", "))
+		}
+		aggr += "("
+		if e.Op.IsAggregatorWithParam() {
+			aggr += Canonical(e.Param) + ", "
+		}
+		return aggr + Canonical(e.Expr) + ")"
+
+	case *Call:
+		args := make([]string, 0, len(e.Args))
+		for _, arg := range e.Args {
+			args = append(args, Canonical(arg))
+		}
+		return fmt.Sprintf("%s(%s)", e.Func.Name, strings.Join(args, ", "))
+
+	case *MatrixSelector:
+		vs := *e.VectorSelector.(*VectorSelector)
+		offset := ""
+		if vs.Offset != time.Duration(0) {
+			offset = fmt.Sprintf(" offset %s", model.Duration(vs.Offset))
+		}
+		vs.Offset = 0
+		return fmt.Sprintf("%s[%s]%s", vs.String(), model.Duration(e.Range), offset)
+
+	case *SubqueryExpr:
+		inner := Canonical(e.Expr)
+		// Binary and unary expressions bind looser than the subquery
+		// brackets and need parentheses.
+		switch unwrapParens(e.Expr).(type) {
+		case *BinaryExpr, *UnaryExpr:
+			inner = "(" + inner + ")"
+		}
+		step := ""
+		if e.Step != 0 {
+			step = model.Duration(e.Step).String()
+		}
+		offset := ""
+		if e.Offset != time.Duration(0) {
+			offset = fmt.Sprintf(" offset %s", model.Duration(e.Offset))
+		}
+		return fmt.Sprintf("%s[%s:%s]%s", inner, model.Duration(e.Range), step, offset)
+	}
+	// Vector selectors already sort their matchers in String, and literals
+	// need no normalization beyond their default formatting.
+	return expr.String()
+}
+
+// canonicalOperand renders one operand of a binary expression, adding
+// parentheses when the operand would otherwise bind differently.
+func canonicalOperand(operand Expr, parentOp ItemType, right bool) string {
+	s := Canonical(operand)
+	child, ok := unwrapParens(operand).(*BinaryExpr)
+	if !ok {
+		return s
+	}
+	cp, pp := binaryPrecedence(child.Op), binaryPrecedence(parentOp)
+	// Power is right-associative, everything else left-associative.
+	if cp < pp || (cp == pp && right != (parentOp == POW)) {
+		return "(" + s + ")"
+	}
+	return s
+}
+
+func unwrapParens(expr Expr) Expr {
+	for {
+		p, ok := expr.(*ParenExpr)
+		if !ok {
+			return expr
+		}
+		expr = p.Expr
+	}
+}
+
+func binaryPrecedence(op ItemType) int {
+	switch op {
+	case LOR:
+		return 1
+	case LAND, LUNLESS:
+		return 2
+	case EQLC, NEQ, LTE, LSS, GTE, GTR:
+		return 3
+	case ADD, SUB:
+		return 4
+	case MUL, DIV, MOD:
+		return 5
+	case POW:
+		return 6
+	}
+	return 7
+}
+
+func sortedCopy(s []string) []string {
+	c := make([]string, len(s))
+	copy(c, s)
+	sort.Strings(c)
+	return c
+}
@@ -0,0 +1,62 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package parser
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCanonical(t *testing.T) {
+	for _, test := range []struct {
+		input    string
+		expected string
+	}{
+		{`foo{b="2",a="1"}`, `foo{a="1",b="2"}`},
+		{`foo{a="1",b="2"}`, `foo{a="1",b="2"}`},
+		{`foo{ a = "1" }`, `foo{a="1"}`},
+		{`((foo))`, `foo`},
+		{`(a + b) * c`, `(a + b) * c`},
+		{`a + (b * c)`, `a + b * c`},
+		{`a - (b - c)`, `a - (b - c)`},
+		{`(a ^ b) ^ c`, `(a ^ b) ^ c`},
+		{`a ^ (b ^ c)`, `a ^ b ^ c`},
+		{`-(a + b)`, `-(a + b)`},
+		{`sum without(b, a) (x)`, `sum without(a, b) (x)`},
+		{`a / on(y, x) group_left(q, p) b`, `a / on(x, y) group_left(p, q) b`},
+		{`topk(3, (x))`, `topk(3, x)`},
+		{`rate(foo[5m] offset 1h)`, `rate(foo[5m] offset 1h)`},
+		{`max_over_time((foo)[1h:5m])`, `max_over_time(foo[1h:5m])`},
+		{`max_over_time(rate(x[5m])[30m:1m] offset 10m)`, `max_over_time(rate(x[5m])[30m:1m] offset 10m)`},
+		{`1e3 + 100`, `1000 + 100`},
+	} {
+		expr, err := ParseExpr(test.input)
+		require.NoError(t, err)
+		got := Canonical(expr)
+		require.Equal(t, test.expected, got, "input %q", test.input)
+
+		// Canonical output must parse back to an equivalent expression.
+		reparsed, err := ParseExpr(got)
+		require.NoError(t, err, "canonical form of %q: %q", test.input, got)
+		require.Equal(t, got, Canonical(reparsed), "input %q", test.input)
+	}
+
+	// Order-sensitive operands are not reordered.
+	a, err := ParseExpr(`a - b`)
+	require.NoError(t, err)
+	b, err := ParseExpr(`b - a`)
+	require.NoError(t, err)
+	require.NotEqual(t, Canonical(a), Canonical(b))
+}
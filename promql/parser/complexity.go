@@ -0,0 +1,64 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package parser
+
+import "time"
+
+// Complexity summarizes structural properties of an expression that
+// correlate with its evaluation cost. It is computed from the AST alone,
+// without executing the query.
+type Complexity struct {
+	// VectorSelectors is the total number of vector selectors in the
+	// expression, including those nested in matrix selectors.
+	VectorSelectors int
+	// MatrixRangeSum is the sum of the ranges of all matrix selectors and
+	// subqueries in the expression.
+	MatrixRangeSum time.Duration
+	// SubqueryDepth is the maximum nesting depth of subqueries. A query
+	// without subqueries has depth 0.
+	SubqueryDepth int
+	// Aggregations is the number of aggregation expressions.
+	Aggregations int
+}
+
+// EstimateComplexity walks the expression and returns a Complexity summary
+// for it. Callers can use the result to reject queries that exceed a policy
+// before handing them to the engine.
+func EstimateComplexity(expr Expr) Complexity {
+	var c Complexity
+	//nolint: errcheck
+	Inspect(expr, func(node Node, path []Node) error {
+		switch n := node.(type) {
+		case *VectorSelector:
+			c.VectorSelectors++
+		case *MatrixSelector:
+			c.MatrixRangeSum += n.Range
+		case *SubqueryExpr:
+			c.MatrixRangeSum += n.Range
+			depth := 1
+			for _, p := range path {
+				if _, ok := p.(*SubqueryExpr); ok {
+					depth++
+				}
+			}
+			if depth > c.SubqueryDepth {
+				c.SubqueryDepth = depth
+			}
+		case *AggregateExpr:
+			c.Aggregations++
+		}
+		return nil
+	})
+	return c
+}
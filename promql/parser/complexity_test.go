@@ -0,0 +1,82 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package parser
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestEstimateComplexity(t *testing.T) {
+	for _, test := range []struct {
+		input    string
+		expected Complexity
+	}{
+		{
+			input:    `1 + 1`,
+			expected: Complexity{},
+		},
+		{
+			input: `foo`,
+			expected: Complexity{
+				VectorSelectors: 1,
+			},
+		},
+		{
+			input: `rate(foo[5m])`,
+			expected: Complexity{
+				VectorSelectors: 1,
+				MatrixRangeSum:  5 * time.Minute,
+			},
+		},
+		{
+			input: `foo / on(bar) bar + ignoring(baz) baz`,
+			expected: Complexity{
+				VectorSelectors: 3,
+			},
+		},
+		{
+			input: `sum by(job) (rate(foo[5m])) / sum by(job) (rate(bar[10m]))`,
+			expected: Complexity{
+				VectorSelectors: 2,
+				MatrixRangeSum:  15 * time.Minute,
+				Aggregations:    2,
+			},
+		},
+		{
+			input: `max_over_time(rate(foo[5m])[30m:1m])`,
+			expected: Complexity{
+				VectorSelectors: 1,
+				MatrixRangeSum:  35 * time.Minute,
+				SubqueryDepth:   1,
+			},
+		},
+	} {
+		expr, err := ParseExpr(test.input)
+		require.NoError(t, err)
+		require.Equal(t, test.expected, EstimateComplexity(expr), "error on input '%s'", test.input)
+	}
+}
+
+func TestEstimateComplexityNestedSubqueries(t *testing.T) {
+	expr, err := ParseExpr(`max_over_time(min_over_time(rate(foo[2m])[10m:1m])[1h:5m])`)
+	require.NoError(t, err)
+
+	c := EstimateComplexity(expr)
+	require.Equal(t, 1, c.VectorSelectors)
+	require.Equal(t, 2, c.SubqueryDepth)
+	require.Equal(t, 2*time.Minute+10*time.Minute+time.Hour, c.MatrixRangeSum)
+}
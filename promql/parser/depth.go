@@ -0,0 +1,36 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package parser
+
+// AggregationDepth returns the length of the deepest chain of nested
+// aggregation operators in expr: a flat query has depth 0, `sum(foo)` depth 1
+// and `sum(max(min(foo)))` depth 3. A scheduler can reject queries above a
+// policy limit to curb nested-aggregation abuse. Aggregations on sibling
+// branches do not add up, only nesting counts.
+func AggregationDepth(expr Expr) int {
+	return aggregationDepth(expr)
+}
+
+func aggregationDepth(node Node) int {
+	depth := 0
+	for _, child := range Children(node) {
+		if d := aggregationDepth(child); d > depth {
+			depth = d
+		}
+	}
+	if _, ok := node.(*AggregateExpr); ok {
+		depth++
+	}
+	return depth
+}
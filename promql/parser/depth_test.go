@@ -0,0 +1,43 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package parser
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAggregationDepth(t *testing.T) {
+	cases := []struct {
+		input string
+		depth int
+	}{
+		{input: `rate(foo[5m])`, depth: 0},
+		{input: `sum(foo)`, depth: 1},
+		{input: `sum(max(min(foo)))`, depth: 3},
+		{input: `sum by (job)(rate(foo[5m]))`, depth: 1},
+		// Sibling aggregations do not add up.
+		{input: `sum(foo) / max(bar)`, depth: 1},
+		{input: `sum(foo) / max(min(bar))`, depth: 2},
+	}
+
+	for _, c := range cases {
+		t.Run(c.input, func(t *testing.T) {
+			expr, err := ParseExpr(c.input)
+			require.NoError(t, err)
+			require.Equal(t, c.depth, AggregationDepth(expr))
+		})
+	}
+}
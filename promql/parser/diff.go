@@ -0,0 +1,171 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package parser
+
+import (
+	"fmt"
+
+	"github.com/prometheus/common/model"
+
+	"github.com/prometheus/prometheus/pkg/labels"
+)
+
+// ChangeKind classifies one entry of a Diff result.
+type ChangeKind string
+
+const (
+	// ChangeAdded marks something present only in the new expression.
+	ChangeAdded ChangeKind = "added"
+	// ChangeRemoved marks something present only in the old expression.
+	ChangeRemoved ChangeKind = "removed"
+	// ChangeModified marks a node that differs between both expressions.
+	ChangeModified ChangeKind = "modified"
+)
+
+// Change describes one structural difference between two expressions. Path
+// locates the difference from the root, Old and New hold the string form of
+// the differing parts; one of them is empty for additions and removals.
+type Change struct {
+	Kind ChangeKind
+	Path string
+	Old  string
+	New  string
+}
+
+// Diff structurally compares the expressions a and b, as Equal does, and
+// returns the differences rather than a single verdict: matchers gained or
+// lost by a selector, a widened range, a changed function or operator. Nodes
+// that differ in type or in shape are reported as one modified node without
+// descending further. An empty result means the expressions are equivalent.
+func Diff(a, b Expr) []Change {
+	var out []Change
+	diffExpr("", a, b, &out)
+	return out
+}
+
+func diffExpr(path string, a, b Expr, out *[]Change) {
+	if Equal(a, b) {
+		return
+	}
+
+	switch ae := a.(type) {
+	case *ParenExpr:
+		if be, ok := b.(*ParenExpr); ok {
+			diffExpr(childPath(path, "expr"), ae.Expr, be.Expr, out)
+			return
+		}
+	case *UnaryExpr:
+		if be, ok := b.(*UnaryExpr); ok && ae.Op == be.Op {
+			diffExpr(childPath(path, "expr"), ae.Expr, be.Expr, out)
+			return
+		}
+	case *VectorSelector:
+		if be, ok := b.(*VectorSelector); ok && ae.Name == be.Name && ae.Offset == be.Offset {
+			diffMatchers(path, ae, be, out)
+			return
+		}
+	case *MatrixSelector:
+		if be, ok := b.(*MatrixSelector); ok {
+			if ae.Range != be.Range {
+				*out = append(*out, Change{
+					Kind: ChangeModified,
+					Path: childPath(path, "range"),
+					Old:  model.Duration(ae.Range).String(),
+					New:  model.Duration(be.Range).String(),
+				})
+			}
+			diffExpr(path, ae.VectorSelector, be.VectorSelector, out)
+			return
+		}
+	case *SubqueryExpr:
+		if be, ok := b.(*SubqueryExpr); ok && ae.Range == be.Range && ae.Step == be.Step && ae.Offset == be.Offset {
+			diffExpr(childPath(path, "expr"), ae.Expr, be.Expr, out)
+			return
+		}
+	case *Call:
+		if be, ok := b.(*Call); ok && ae.Func.Name == be.Func.Name && len(ae.Args) == len(be.Args) {
+			for i := range ae.Args {
+				diffExpr(childPath(path, fmt.Sprintf("args[%d]", i)), ae.Args[i], be.Args[i], out)
+			}
+			return
+		}
+	case *AggregateExpr:
+		if be, ok := b.(*AggregateExpr); ok && ae.Op == be.Op && ae.Without == be.Without &&
+			stringsEqual(ae.Grouping, be.Grouping) && (ae.Param == nil) == (be.Param == nil) {
+			if ae.Param != nil {
+				diffExpr(childPath(path, "param"), ae.Param, be.Param, out)
+			}
+			diffExpr(childPath(path, "expr"), ae.Expr, be.Expr, out)
+			return
+		}
+	case *BinaryExpr:
+		if be, ok := b.(*BinaryExpr); ok && ae.Op == be.Op && ae.ReturnBool == be.ReturnBool &&
+			vectorMatchingEqual(ae.VectorMatching, be.VectorMatching) {
+			diffExpr(childPath(path, "lhs"), ae.LHS, be.LHS, out)
+			diffExpr(childPath(path, "rhs"), ae.RHS, be.RHS, out)
+			return
+		}
+	}
+
+	*out = append(*out, Change{
+		Kind: ChangeModified,
+		Path: path,
+		Old:  a.String(),
+		New:  b.String(),
+	})
+}
+
+// diffMatchers reports matchers present in only one of two selectors on the
+// same metric name.
+func diffMatchers(path string, a, b *VectorSelector, out *[]Change) {
+	am := map[string]struct{}{}
+	for _, m := range a.LabelMatchers {
+		am[m.String()] = struct{}{}
+	}
+	bm := map[string]struct{}{}
+	for _, m := range b.LabelMatchers {
+		bm[m.String()] = struct{}{}
+	}
+	as := make([]*labels.Matcher, len(a.LabelMatchers))
+	copy(as, a.LabelMatchers)
+	sortMatchers(as)
+	bs := make([]*labels.Matcher, len(b.LabelMatchers))
+	copy(bs, b.LabelMatchers)
+	sortMatchers(bs)
+	for _, m := range as {
+		if _, ok := bm[m.String()]; !ok {
+			*out = append(*out, Change{
+				Kind: ChangeRemoved,
+				Path: childPath(path, "matchers"),
+				Old:  m.String(),
+			})
+		}
+	}
+	for _, m := range bs {
+		if _, ok := am[m.String()]; !ok {
+			*out = append(*out, Change{
+				Kind: ChangeAdded,
+				Path: childPath(path, "matchers"),
+				New:  m.String(),
+			})
+		}
+	}
+}
+
+func childPath(path, elem string) string {
+	if path == "" {
+		return elem
+	}
+	return path + "." + elem
+}
@@ -0,0 +1,61 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package parser
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiff(t *testing.T) {
+	mustParse := func(s string) Expr {
+		expr, err := ParseExpr(s)
+		require.NoError(t, err)
+		return expr
+	}
+
+	// Equivalent expressions produce no changes.
+	require.Empty(t, Diff(mustParse(`sum(rate(x[5m]))`), mustParse(`sum(rate(x[5m]))`)))
+
+	// A gained label matcher is reported as an addition, not as a whole
+	// new selector.
+	require.Equal(t, []Change{
+		{Kind: ChangeAdded, Path: "expr.matchers", New: `a="1"`},
+	}, Diff(mustParse(`sum(foo)`), mustParse(`sum(foo{a="1"})`)))
+
+	// A widened range points at the range, keeping the selector out of it.
+	require.Equal(t, []Change{
+		{Kind: ChangeModified, Path: "args[0].range", Old: "5m", New: "10m"},
+	}, Diff(mustParse(`rate(x[5m])`), mustParse(`rate(x[10m])`)))
+
+	// A replaced matcher is one removal plus one addition.
+	require.Equal(t, []Change{
+		{Kind: ChangeRemoved, Path: "matchers", Old: `a="1"`},
+		{Kind: ChangeAdded, Path: "matchers", New: `a="2"`},
+	}, Diff(mustParse(`foo{a="1"}`), mustParse(`foo{a="2"}`)))
+
+	// A changed function is reported as one modified node.
+	changes := Diff(mustParse(`rate(x[5m])`), mustParse(`irate(x[5m])`))
+	require.Len(t, changes, 1)
+	require.Equal(t, ChangeModified, changes[0].Kind)
+	require.Equal(t, "rate(x[5m])", changes[0].Old)
+	require.Equal(t, "irate(x[5m])", changes[0].New)
+
+	// Subtrees of different shapes stop descending at the mismatch.
+	changes = Diff(mustParse(`sum(foo) / bar`), mustParse(`sum(foo) / (bar + 1)`))
+	require.Equal(t, []Change{
+		{Kind: ChangeModified, Path: "rhs", Old: "bar", New: "(bar + 1)"},
+	}, changes)
+}
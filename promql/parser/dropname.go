@@ -0,0 +1,82 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package parser
+
+import (
+	"github.com/prometheus/prometheus/pkg/labels"
+)
+
+// funcsRetainingMetricName are the functions whose output series keep the
+// __name__ label of their input series. Every other function returning a
+// vector drops it, as do all range-vector functions.
+var funcsRetainingMetricName = map[string]struct{}{
+	"label_join":    {},
+	"label_replace": {},
+	"sort":          {},
+	"sort_desc":     {},
+}
+
+// DropsMetricName reports whether the top-level operation of expr produces
+// series without a __name__ label. It mirrors the engine's evaluation rules:
+// arithmetic between vectors, comparisons with the bool modifier, unary
+// negation, most functions, and aggregations not grouping by __name__ all
+// strip the metric name.
+func DropsMetricName(expr Expr) bool {
+	switch e := expr.(type) {
+	case *ParenExpr:
+		return DropsMetricName(e.Expr)
+
+	case *UnaryExpr:
+		return e.Op == SUB && e.Expr.Type() == ValueTypeVector
+
+	case *BinaryExpr:
+		if e.LHS.Type() == ValueTypeScalar && e.RHS.Type() == ValueTypeScalar {
+			// Scalar results carry no labels at all.
+			return false
+		}
+		if e.ReturnBool {
+			return true
+		}
+		switch e.Op {
+		case ADD, SUB, MUL, DIV, POW, MOD:
+			return true
+		}
+		// Comparisons without bool filter the input series and set
+		// operations pass them through, both keeping the name.
+		return false
+
+	case *AggregateExpr:
+		switch e.Op {
+		case TOPK, BOTTOMK:
+			// These return input series unchanged.
+			return false
+		}
+		if !e.Without {
+			for _, g := range e.Grouping {
+				if g == labels.MetricName {
+					return false
+				}
+			}
+		}
+		return true
+
+	case *Call:
+		if e.Func.ReturnType != ValueTypeVector {
+			return false
+		}
+		_, retains := funcsRetainingMetricName[e.Func.Name]
+		return !retains
+	}
+	return false
+}
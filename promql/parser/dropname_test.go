@@ -0,0 +1,51 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package parser
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDropsMetricName(t *testing.T) {
+	cases := []struct {
+		input string
+		drops bool
+	}{
+		{input: `x`, drops: false},
+		{input: `rate(x[5m])`, drops: true},
+		{input: `x + y`, drops: true},
+		{input: `(x + y)`, drops: true},
+		{input: `sum(x)`, drops: true},
+		{input: `label_replace(rate(x[5m]), "dst", "$1", "src", "(.*)")`, drops: false},
+		{input: `sort(x)`, drops: false},
+		{input: `abs(x)`, drops: true},
+		{input: `-x`, drops: true},
+		{input: `x > y`, drops: false},
+		{input: `x > bool y`, drops: true},
+		{input: `x and y`, drops: false},
+		{input: `1 + 2`, drops: false},
+		{input: `scalar(x)`, drops: false},
+		{input: `sum by (__name__) (x)`, drops: false},
+		{input: `sum without (instance) (x)`, drops: true},
+		{input: `topk(3, x)`, drops: false},
+	}
+
+	for _, c := range cases {
+		expr, err := ParseExpr(c.input)
+		require.NoError(t, err)
+		require.Equal(t, c.drops, DropsMetricName(expr), "input %q", c.input)
+	}
+}
@@ -0,0 +1,130 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package parser
+
+import (
+	"sort"
+
+	"github.com/prometheus/prometheus/pkg/labels"
+)
+
+// Equal reports whether the two expressions are structurally identical,
+// ignoring position information. Formatting differences of the original input
+// such as whitespace or comments therefore do not affect the result. Label
+// matchers on a selector are compared irrespective of their order since it
+// does not change the selection, while order remains significant wherever it
+// changes semantics, e.g. for binary operands and function arguments.
+func Equal(a, b Expr) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	switch a := a.(type) {
+	case *AggregateExpr:
+		b, ok := b.(*AggregateExpr)
+		return ok && a.Op == b.Op && a.Without == b.Without &&
+			stringsEqual(a.Grouping, b.Grouping) &&
+			Equal(a.Expr, b.Expr) && Equal(a.Param, b.Param)
+	case *BinaryExpr:
+		b, ok := b.(*BinaryExpr)
+		return ok && a.Op == b.Op && a.ReturnBool == b.ReturnBool &&
+			vectorMatchingEqual(a.VectorMatching, b.VectorMatching) &&
+			Equal(a.LHS, b.LHS) && Equal(a.RHS, b.RHS)
+	case *Call:
+		b, ok := b.(*Call)
+		if !ok || a.Func.Name != b.Func.Name || len(a.Args) != len(b.Args) {
+			return false
+		}
+		for i := range a.Args {
+			if !Equal(a.Args[i], b.Args[i]) {
+				return false
+			}
+		}
+		return true
+	case *MatrixSelector:
+		b, ok := b.(*MatrixSelector)
+		return ok && a.Range == b.Range && Equal(a.VectorSelector, b.VectorSelector)
+	case *SubqueryExpr:
+		b, ok := b.(*SubqueryExpr)
+		return ok && a.Range == b.Range && a.Offset == b.Offset && a.Step == b.Step &&
+			Equal(a.Expr, b.Expr)
+	case *NumberLiteral:
+		b, ok := b.(*NumberLiteral)
+		return ok && a.Val == b.Val
+	case *ParenExpr:
+		b, ok := b.(*ParenExpr)
+		return ok && Equal(a.Expr, b.Expr)
+	case *StringLiteral:
+		b, ok := b.(*StringLiteral)
+		return ok && a.Val == b.Val
+	case *UnaryExpr:
+		b, ok := b.(*UnaryExpr)
+		return ok && a.Op == b.Op && Equal(a.Expr, b.Expr)
+	case *VectorSelector:
+		b, ok := b.(*VectorSelector)
+		return ok && a.Name == b.Name && a.Offset == b.Offset &&
+			matchersEqual(a.LabelMatchers, b.LabelMatchers)
+	}
+	return false
+}
+
+func stringsEqual(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func vectorMatchingEqual(a, b *VectorMatching) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	return a.Card == b.Card && a.On == b.On &&
+		stringsEqual(a.MatchingLabels, b.MatchingLabels) &&
+		stringsEqual(a.Include, b.Include)
+}
+
+func matchersEqual(a, b []*labels.Matcher) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	as := make([]*labels.Matcher, len(a))
+	bs := make([]*labels.Matcher, len(b))
+	copy(as, a)
+	copy(bs, b)
+	sortMatchers(as)
+	sortMatchers(bs)
+	for i := range as {
+		if as[i].Type != bs[i].Type || as[i].Name != bs[i].Name || as[i].Value != bs[i].Value {
+			return false
+		}
+	}
+	return true
+}
+
+func sortMatchers(ms []*labels.Matcher) {
+	sort.Slice(ms, func(i, j int) bool {
+		if ms[i].Name != ms[j].Name {
+			return ms[i].Name < ms[j].Name
+		}
+		if ms[i].Type != ms[j].Type {
+			return ms[i].Type < ms[j].Type
+		}
+		return ms[i].Value < ms[j].Value
+	})
+}
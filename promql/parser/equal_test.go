@@ -0,0 +1,66 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package parser
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestEqual(t *testing.T) {
+	for _, test := range []struct {
+		a, b  string
+		equal bool
+	}{
+		// Formatting differences are invisible to the parsed tree.
+		{`foo{a="b"}`, `foo{ a = "b" }`, true},
+		{`sum(rate(foo[5m]))`, "sum( # comment\n  rate(foo[5m]))", true},
+		{"a\n+\nb", `a + b`, true},
+		// Matcher order does not change the selection.
+		{`foo{a="b",c="d"}`, `foo{c="d",a="b"}`, true},
+		{`foo{a="b"}`, `foo{a="c"}`, false},
+		{`foo{a="b"}`, `foo{a!="b"}`, false},
+		// Operand order is significant.
+		{`a + b`, `b + a`, false},
+		{`a - b`, `a + b`, false},
+		{`a > b`, `a > bool b`, false},
+		{`a / on(x) b`, `a / on(y) b`, false},
+		{`sum by (job) (x)`, `sum by (job) (x)`, true},
+		{`sum by (job) (x)`, `sum without (job) (x)`, false},
+		{`rate(x[5m])`, `rate(x[6m])`, false},
+		{`rate(x[5m])`, `irate(x[5m])`, false},
+		{`x offset 5m`, `x offset 6m`, false},
+		{`max_over_time(x[1h:5m])`, `max_over_time(x[1h:5m])`, true},
+		{`max_over_time(x[1h:5m])`, `max_over_time(x[1h:1m])`, false},
+		{`(foo)`, `foo`, false},
+		{`1e3`, `1000`, true},
+		{`-x`, `x`, false},
+	} {
+		a, err := ParseExpr(test.a)
+		require.NoError(t, err)
+		b, err := ParseExpr(test.b)
+		require.NoError(t, err)
+
+		require.Equal(t, test.equal, Equal(a, b), "Equal(%q, %q)", test.a, test.b)
+		require.Equal(t, test.equal, Equal(b, a), "Equal(%q, %q)", test.b, test.a)
+		require.True(t, Equal(a, a), "Equal(%q, %q)", test.a, test.a)
+	}
+
+	require.True(t, Equal(nil, nil))
+	expr, err := ParseExpr(`foo`)
+	require.NoError(t, err)
+	require.False(t, Equal(expr, nil))
+	require.False(t, Equal(nil, expr))
+}
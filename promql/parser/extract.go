@@ -0,0 +1,151 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package parser
+
+import (
+	"sort"
+
+	"github.com/pkg/errors"
+
+	"github.com/prometheus/prometheus/pkg/labels"
+)
+
+// ExtractMetricNames returns the sorted, distinct literal metric names
+// referenced by the selectors in expr. The returned bool is true if the name
+// set is open-ended, i.e. some selector matched metric names by a
+// non-equality matcher or carried no metric name at all.
+func ExtractMetricNames(expr Expr) ([]string, bool) {
+	var (
+		open  bool
+		names = map[string]struct{}{}
+	)
+	//nolint: errcheck
+	Inspect(expr, func(node Node, _ []Node) error {
+		vs, ok := node.(*VectorSelector)
+		if !ok {
+			return nil
+		}
+		found := false
+		for _, m := range vs.LabelMatchers {
+			if m.Name != labels.MetricName {
+				continue
+			}
+			found = true
+			if m.Type == labels.MatchEqual {
+				names[m.Value] = struct{}{}
+			} else {
+				open = true
+			}
+		}
+		if !found {
+			open = true
+		}
+		return nil
+	})
+
+	ret := make([]string, 0, len(names))
+	for name := range names {
+		ret = append(ret, name)
+	}
+	sort.Strings(ret)
+	return ret, open
+}
+
+// FunctionsUsed returns the sorted, distinct names of the functions called
+// anywhere in expr. Aggregation operators are not functions; see
+// AggregationsUsed for those.
+func FunctionsUsed(expr Expr) []string {
+	names := map[string]struct{}{}
+	//nolint: errcheck
+	Inspect(expr, func(node Node, _ []Node) error {
+		if call, ok := node.(*Call); ok {
+			names[call.Func.Name] = struct{}{}
+		}
+		return nil
+	})
+
+	ret := make([]string, 0, len(names))
+	for name := range names {
+		ret = append(ret, name)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// AggregationsUsed returns the distinct aggregation operators used anywhere
+// in expr, in ascending ItemType order.
+func AggregationsUsed(expr Expr) []ItemType {
+	ops := map[ItemType]struct{}{}
+	//nolint: errcheck
+	Inspect(expr, func(node Node, _ []Node) error {
+		if agg, ok := node.(*AggregateExpr); ok {
+			ops[agg.Op] = struct{}{}
+		}
+		return nil
+	})
+
+	ret := make([]ItemType, 0, len(ops))
+	for op := range ops {
+		ret = append(ret, op)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i] < ret[j] })
+	return ret
+}
+
+// InjectMatchers appends the given matchers to every vector and matrix
+// selector in expr, e.g. to enforce tenant isolation labels. A matcher that
+// is already present on a selector is skipped; an existing matcher for the
+// same label with a different type or value is an error, since silently
+// overriding it could widen the selection.
+func InjectMatchers(expr Expr, extra []*labels.Matcher) error {
+	return Walk(inspector(func(node Node, _ []Node) error {
+		vs, ok := node.(*VectorSelector)
+		if !ok {
+			return nil
+		}
+	Outer:
+		for _, m := range extra {
+			for _, em := range vs.LabelMatchers {
+				if em.Name != m.Name {
+					continue
+				}
+				if em.Type == m.Type && em.Value == m.Value {
+					continue Outer
+				}
+				return errors.Errorf("selector has a conflicting matcher for label %q: %s", m.Name, em)
+			}
+			vs.LabelMatchers = append(vs.LabelMatchers, m)
+		}
+		return nil
+	}), expr, nil)
+}
+
+// SelectorLabelNames returns the distinct label names constrained by the
+// selector's matchers, sorted. The metric name matcher on __name__ is not a
+// label constraint and is excluded.
+func SelectorLabelNames(vs *VectorSelector) []string {
+	seen := map[string]struct{}{}
+	for _, m := range vs.LabelMatchers {
+		if m.Name == labels.MetricName {
+			continue
+		}
+		seen[m.Name] = struct{}{}
+	}
+	names := make([]string, 0, len(seen))
+	for name := range seen {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,147 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package parser
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/prometheus/prometheus/pkg/labels"
+)
+
+func TestExtractMetricNames(t *testing.T) {
+	for _, test := range []struct {
+		input    string
+		expected []string
+		open     bool
+	}{
+		{
+			input:    `foo`,
+			expected: []string{"foo"},
+		},
+		{
+			input:    `sum(rate(foo[5m])) / sum(rate(bar[5m]))`,
+			expected: []string{"bar", "foo"},
+		},
+		{
+			input:    `foo + foo`,
+			expected: []string{"foo"},
+		},
+		{
+			input:    `{__name__=~"a.*"}`,
+			expected: []string{},
+			open:     true,
+		},
+		{
+			input:    `foo + {__name__=~"a.*"}`,
+			expected: []string{"foo"},
+			open:     true,
+		},
+		{
+			input:    `{job="prometheus"}`,
+			expected: []string{},
+			open:     true,
+		},
+		{
+			input:    `1 + 2`,
+			expected: []string{},
+		},
+	} {
+		expr, err := ParseExpr(test.input)
+		require.NoError(t, err)
+
+		names, open := ExtractMetricNames(expr)
+		require.Equal(t, test.expected, names, "error on input '%s'", test.input)
+		require.Equal(t, test.open, open, "error on input '%s'", test.input)
+	}
+}
+
+func TestInjectMatchers(t *testing.T) {
+	tenant, err := labels.NewMatcher(labels.MatchEqual, "tenant", "x")
+	require.NoError(t, err)
+
+	expr, err := ParseExpr(`rate(foo[5m]) + max_over_time(bar{job="a"}[1h:5m])`)
+	require.NoError(t, err)
+	require.NoError(t, InjectMatchers(expr, []*labels.Matcher{tenant}))
+
+	selectors := 0
+	//nolint: errcheck
+	Inspect(expr, func(node Node, _ []Node) error {
+		vs, ok := node.(*VectorSelector)
+		if !ok {
+			return nil
+		}
+		selectors++
+		found := false
+		for _, m := range vs.LabelMatchers {
+			if m.Name == "tenant" {
+				require.Equal(t, tenant, m)
+				found = true
+			}
+		}
+		require.True(t, found, "selector %s has no tenant matcher", vs)
+		return nil
+	})
+	require.Equal(t, 2, selectors)
+
+	// Injecting the same matcher again is a no-op rather than a duplicate.
+	require.NoError(t, InjectMatchers(expr, []*labels.Matcher{tenant}))
+	vs := expr.(*BinaryExpr).LHS.(*Call).Args[0].(*MatrixSelector).VectorSelector.(*VectorSelector)
+	count := 0
+	for _, m := range vs.LabelMatchers {
+		if m.Name == "tenant" {
+			count++
+		}
+	}
+	require.Equal(t, 1, count)
+
+	// A conflicting matcher for the same label is an error.
+	other, err := labels.NewMatcher(labels.MatchEqual, "tenant", "y")
+	require.NoError(t, err)
+	err = InjectMatchers(expr, []*labels.Matcher{other})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), `conflicting matcher for label "tenant"`)
+}
+
+func TestFunctionsAndAggregationsUsed(t *testing.T) {
+	expr, err := ParseExpr(`histogram_quantile(0.9, sum by (le) (rate(foo_bucket[5m]))) / avg(rate(bar[5m]))`)
+	require.NoError(t, err)
+
+	require.Equal(t, []string{"histogram_quantile", "rate"}, FunctionsUsed(expr))
+	require.Equal(t, []ItemType{AVG, SUM}, AggregationsUsed(expr))
+
+	expr, err = ParseExpr(`foo + 1`)
+	require.NoError(t, err)
+	require.Empty(t, FunctionsUsed(expr))
+	require.Empty(t, AggregationsUsed(expr))
+}
+
+func TestSelectorLabelNames(t *testing.T) {
+	for _, test := range []struct {
+		input    string
+		expected []string
+	}{
+		{`foo{a="1",b=~"x"}`, []string{"a", "b"}},
+		{`foo{b="2",a="1",a!="3"}`, []string{"a", "b"}},
+		{`foo`, []string{}},
+		{`{__name__=~"foo.*",job="x"}`, []string{"job"}},
+	} {
+		expr, err := ParseExpr(test.input)
+		require.NoError(t, err)
+		vs, ok := expr.(*VectorSelector)
+		require.True(t, ok)
+		require.Equal(t, test.expected, SelectorLabelNames(vs), "input %q", test.input)
+	}
+}
@@ -0,0 +1,123 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package parser
+
+import "math"
+
+// FoldConstants simplifies scalar-only arithmetic subexpressions of expr into
+// a single NumberLiteral, e.g. (2+3)*4 becomes 20, so the engine does not
+// re-evaluate them at every step. Subtrees touching a selector are left
+// untouched, as are comparison operators, whose filtering semantics cannot be
+// represented by a literal. The expression is rewritten in place; the
+// returned Expr must be used in case the root itself was folded.
+func FoldConstants(expr Expr) (Expr, error) {
+	switch e := expr.(type) {
+	case *ParenExpr:
+		inner, err := FoldConstants(e.Expr)
+		if err != nil {
+			return nil, err
+		}
+		// Parentheses around a literal carry no precedence anymore.
+		if n, ok := inner.(*NumberLiteral); ok {
+			return &NumberLiteral{Val: n.Val, PosRange: e.PositionRange()}, nil
+		}
+		e.Expr = inner
+		return e, nil
+
+	case *UnaryExpr:
+		inner, err := FoldConstants(e.Expr)
+		if err != nil {
+			return nil, err
+		}
+		if n, ok := inner.(*NumberLiteral); ok {
+			v := n.Val
+			if e.Op == SUB {
+				v = -v
+			}
+			return &NumberLiteral{Val: v, PosRange: e.PositionRange()}, nil
+		}
+		e.Expr = inner
+		return e, nil
+
+	case *BinaryExpr:
+		lhs, err := FoldConstants(e.LHS)
+		if err != nil {
+			return nil, err
+		}
+		rhs, err := FoldConstants(e.RHS)
+		if err != nil {
+			return nil, err
+		}
+		e.LHS, e.RHS = lhs, rhs
+
+		ln, lok := lhs.(*NumberLiteral)
+		rn, rok := rhs.(*NumberLiteral)
+		if !lok || !rok {
+			return e, nil
+		}
+		var v float64
+		switch e.Op {
+		case ADD:
+			v = ln.Val + rn.Val
+		case SUB:
+			v = ln.Val - rn.Val
+		case MUL:
+			v = ln.Val * rn.Val
+		case DIV:
+			// Matches the engine: division by zero yields Inf or NaN.
+			v = ln.Val / rn.Val
+		case MOD:
+			v = math.Mod(ln.Val, rn.Val)
+		case POW:
+			v = math.Pow(ln.Val, rn.Val)
+		default:
+			return e, nil
+		}
+		return &NumberLiteral{Val: v, PosRange: e.PositionRange()}, nil
+
+	case *AggregateExpr:
+		if e.Param != nil {
+			param, err := FoldConstants(e.Param)
+			if err != nil {
+				return nil, err
+			}
+			e.Param = param
+		}
+		inner, err := FoldConstants(e.Expr)
+		if err != nil {
+			return nil, err
+		}
+		e.Expr = inner
+		return e, nil
+
+	case *Call:
+		for i, arg := range e.Args {
+			folded, err := FoldConstants(arg)
+			if err != nil {
+				return nil, err
+			}
+			e.Args[i] = folded
+		}
+		return e, nil
+
+	case *SubqueryExpr:
+		inner, err := FoldConstants(e.Expr)
+		if err != nil {
+			return nil, err
+		}
+		e.Expr = inner
+		return e, nil
+	}
+	return expr, nil
+}
@@ -0,0 +1,50 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package parser
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFoldConstants(t *testing.T) {
+	for _, test := range []struct {
+		input    string
+		expected string
+	}{
+		{`(2+3)*4`, `20`},
+		{`2^3`, `8`},
+		{`7 % 3`, `1`},
+		{`-(3)`, `-3`},
+		{`1 / 0`, `+Inf`},
+		// Only the constant part of a mixed expression folds.
+		{`x * (2+3)`, `x * 5`},
+		{`rate(x[5m]) + 2 * 30`, `rate(x[5m]) + 60`},
+		{`sum(x) / (60 * 5)`, `sum(x) / 300`},
+		{`clamp_max(x, 2 + 8)`, `clamp_max(x, 10)`},
+		{`max_over_time((x + 1 - 1)[1h:5m])`, `max_over_time((x + 1 - 1)[1h:5m])`},
+		// Selectors and their modifiers are never touched.
+		{`x offset 5m + 1`, `x offset 5m + 1`},
+		// Comparisons filter and are left alone.
+		{`2 > bool 1`, `2 > bool 1`},
+	} {
+		expr, err := ParseExpr(test.input)
+		require.NoError(t, err)
+
+		folded, err := FoldConstants(expr)
+		require.NoError(t, err)
+		require.Equal(t, test.expected, folded.String(), "input %q", test.input)
+	}
+}
@@ -0,0 +1,44 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package parser
+
+// renamedFunctions maps deprecated function names to their current names.
+var renamedFunctions = map[string]string{
+	"holt_winters": "double_exponential_smoothing",
+}
+
+// MigrateRenamedFunctions rewrites calls to functions that have since been
+// renamed so that they use the current name. The argument lists are left
+// untouched. It is intended for migrating stored queries; the returned
+// expression serializes to the updated query string.
+func MigrateRenamedFunctions(expr Expr) Expr {
+	//nolint: errcheck
+	Inspect(expr, func(node Node, path []Node) error {
+		call, ok := node.(*Call)
+		if !ok {
+			return nil
+		}
+		newName, ok := renamedFunctions[call.Func.Name]
+		if !ok {
+			return nil
+		}
+		// Copy the function before renaming it so the shared function
+		// table is not modified.
+		f := *call.Func
+		f.Name = newName
+		call.Func = &f
+		return nil
+	})
+	return expr
+}
@@ -0,0 +1,54 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package parser
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMigrateRenamedFunctions(t *testing.T) {
+	for _, test := range []struct {
+		input    string
+		expected string
+	}{
+		{
+			input:    `holt_winters(foo[5m], 0.5, 0.5)`,
+			expected: `double_exponential_smoothing(foo[5m], 0.5, 0.5)`,
+		},
+		{
+			input:    `rate(foo[5m])`,
+			expected: `rate(foo[5m])`,
+		},
+		{
+			input:    `sum(holt_winters(foo[5m], 0.5, 0.5)) + rate(bar[1m])`,
+			expected: `sum(double_exponential_smoothing(foo[5m], 0.5, 0.5)) + rate(bar[1m])`,
+		},
+	} {
+		expr, err := ParseExpr(test.input)
+		require.NoError(t, err)
+		require.Equal(t, test.expected, MigrateRenamedFunctions(expr).String(), "error on input '%s'", test.input)
+	}
+}
+
+func TestMigrateRenamedFunctionsLeavesTableUntouched(t *testing.T) {
+	expr, err := ParseExpr(`holt_winters(foo[5m], 0.5, 0.5)`)
+	require.NoError(t, err)
+	MigrateRenamedFunctions(expr)
+
+	f, ok := getFunction("holt_winters")
+	require.True(t, ok)
+	require.Equal(t, "holt_winters", f.Name)
+}
@@ -125,6 +125,91 @@ func ParseExpr(input string) (expr Expr, err error) {
 	return expr, err
 }
 
+// CheckTypes runs the parser's type checking over an already built AST, e.g.
+// one assembled or rewritten programmatically, without parsing or evaluating
+// anything. It reports a range vector where an instant vector is required and
+// vice versa, with the offending positions, just as ParseExpr would for the
+// equivalent input.
+func CheckTypes(expr Expr) (err error) {
+	p := newParser("")
+	defer parserPool.Put(p)
+	defer p.recover(&err)
+
+	p.checkAST(expr)
+	if len(p.parseErrors) != 0 {
+		err = p.parseErrors
+	}
+	return err
+}
+
+// ParseOpts carries policy limits enforced by ParseExprWithOpts on top of
+// syntactic validity. The zero value of each limit disables its check.
+type ParseOpts struct {
+	// MaxRangeDuration rejects range selectors and subqueries whose range
+	// exceeds it.
+	MaxRangeDuration time.Duration
+	// MinSubqueryStep rejects subqueries with an explicit resolution step
+	// smaller than it. Subqueries using the default step are not affected.
+	MinSubqueryStep time.Duration
+	// MaxSubqueryDepth rejects expressions nesting subqueries more than this
+	// many levels deep.
+	MaxSubqueryDepth int
+}
+
+// ParseExprWithOpts returns the expression parsed from the input after
+// checking it against the limits in opts. Violations are reported as
+// ParseErrors pointing at the offending selector or subquery, so API
+// handlers can enforce guardrails with the same error format as syntax
+// errors.
+func ParseExprWithOpts(input string, opts ParseOpts) (Expr, error) {
+	expr, err := ParseExpr(input)
+	if err != nil {
+		return nil, err
+	}
+
+	var errs ParseErrors
+	addErrf := func(pos PositionRange, format string, args ...interface{}) {
+		errs = append(errs, ParseErr{
+			PositionRange: pos,
+			Err:           errors.Errorf(format, args...),
+			Query:         input,
+		})
+	}
+	//nolint: errcheck
+	Inspect(expr, func(node Node, path []Node) error {
+		switch n := node.(type) {
+		case *MatrixSelector:
+			if opts.MaxRangeDuration > 0 && n.Range > opts.MaxRangeDuration {
+				addErrf(n.PositionRange(), "range %s exceeds maximum allowed duration %s", model.Duration(n.Range), model.Duration(opts.MaxRangeDuration))
+			}
+		case *SubqueryExpr:
+			if opts.MaxRangeDuration > 0 && n.Range > opts.MaxRangeDuration {
+				addErrf(n.PositionRange(), "subquery range %s exceeds maximum allowed duration %s", model.Duration(n.Range), model.Duration(opts.MaxRangeDuration))
+			}
+			if opts.MinSubqueryStep > 0 && n.Step != 0 && n.Step < opts.MinSubqueryStep {
+				addErrf(n.PositionRange(), "subquery step %s is below minimum allowed step %s", model.Duration(n.Step), model.Duration(opts.MinSubqueryStep))
+			}
+			if opts.MaxSubqueryDepth > 0 {
+				depth := 1
+				for _, anc := range path {
+					if _, ok := anc.(*SubqueryExpr); ok {
+						depth++
+					}
+				}
+				if depth > opts.MaxSubqueryDepth {
+					addErrf(n.PositionRange(), "subquery nesting exceeds maximum allowed depth %d", opts.MaxSubqueryDepth)
+				}
+			}
+		}
+		return nil
+	})
+
+	if len(errs) != 0 {
+		return expr, errs
+	}
+	return expr, nil
+}
+
 // ParseMetric parses the input into a metric
 func ParseMetric(input string) (m labels.Labels, err error) {
 	p := newParser(input)
@@ -162,6 +247,21 @@ func ParseMetricSelector(input string) (m []*labels.Matcher, err error) {
 	return m, err
 }
 
+// ParseMetricSelectors parses a list of provided textual metric selectors into
+// lists of label matchers. On failure, the returned error identifies which of
+// the inputs could not be parsed.
+func ParseMetricSelectors(selectors []string) ([][]*labels.Matcher, error) {
+	var matcherSets [][]*labels.Matcher
+	for _, s := range selectors {
+		matchers, err := ParseMetricSelector(s)
+		if err != nil {
+			return nil, errors.Wrapf(err, "parsing metric selector %q", s)
+		}
+		matcherSets = append(matcherSets, matchers)
+	}
+	return matcherSets, nil
+}
+
 // newParser returns a new parser.
 func newParser(input string) *parser {
 	p := parserPool.Get().(*parser)
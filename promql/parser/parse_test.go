@@ -2821,6 +2821,25 @@ func TestParseSeries(t *testing.T) {
 	}
 }
 
+func TestParseMetricSelectors(t *testing.T) {
+	matcherSets, err := ParseMetricSelectors([]string{
+		`up`,
+		`{job="prometheus"}`,
+		`go_goroutines{job=~"api.*",instance!=""}`,
+	})
+	require.NoError(t, err)
+	require.Len(t, matcherSets, 3)
+
+	exp, err := ParseMetricSelector(`{job="prometheus"}`)
+	require.NoError(t, err)
+	require.Equal(t, exp, matcherSets[1])
+
+	// The error must identify which selector failed to parse.
+	_, err = ParseMetricSelectors([]string{`up`, `{job=`, `down`})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), `"{job="`)
+}
+
 func TestRecoverParserRuntime(t *testing.T) {
 	p := newParser("foo bar")
 	var err error
@@ -2848,3 +2867,69 @@ func TestRecoverParserError(t *testing.T) {
 
 	panic(e)
 }
+
+func TestParseExprWithOpts(t *testing.T) {
+	opts := ParseOpts{
+		MaxRangeDuration: 7 * 24 * time.Hour,
+		MinSubqueryStep:  time.Second,
+		MaxSubqueryDepth: 2,
+	}
+	cases := []struct {
+		input string
+		err   string
+	}{
+		{input: `rate(foo[5m])`},
+		{input: `max_over_time(rate(foo[5m])[1h:15s])`},
+		{input: `rate(foo[30d])`, err: `1:6: parse error: range 30d exceeds maximum allowed duration 1w`},
+		{input: `max_over_time(foo[30d:1h])`, err: `1:15: parse error: subquery range 30d exceeds maximum allowed duration 1w`},
+		{input: `max_over_time(foo[1h:100ms])`, err: `1:15: parse error: subquery step 100ms is below minimum allowed step 1s`},
+		{input: `max_over_time(min_over_time(max_over_time(foo[1h:])[1h:])[1h:])`, err: `1:43: parse error: subquery nesting exceeds maximum allowed depth 2`},
+		// Syntax errors still surface first.
+		{input: `rate(foo[30d)`, err: "1:13: parse error: unexpected \")\" in subquery or range, expected \":\" or \"]\""},
+	}
+
+	for _, c := range cases {
+		expr, err := ParseExprWithOpts(c.input, opts)
+		if c.err == "" {
+			require.NoError(t, err, "input %q", c.input)
+			require.NotNil(t, expr)
+			continue
+		}
+		require.Error(t, err, "input %q", c.input)
+		require.Equal(t, c.err, err.Error(), "input %q", c.input)
+	}
+
+	// The zero value enforces nothing.
+	_, err := ParseExprWithOpts(`max_over_time(foo[30d:100ms])`, ParseOpts{})
+	require.NoError(t, err)
+}
+
+func TestCheckTypes(t *testing.T) {
+	// Build ASTs that ParseExpr would reject, bypassing its checks.
+	rateFn, ok := getFunction("rate")
+	require.True(t, ok)
+	m, err := labels.NewMatcher(labels.MatchEqual, "__name__", "up")
+	require.NoError(t, err)
+	sumUp := &AggregateExpr{Op: SUM, Expr: &VectorSelector{
+		Name:          "up",
+		LabelMatchers: []*labels.Matcher{m},
+	}}
+
+	// rate(up): instant vector where a range vector is required.
+	err = CheckTypes(&Call{Func: rateFn, Args: Expressions{sumUp.Expr}})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "expected type range vector")
+
+	// sum(up[5m]): range vector where an instant vector is expected.
+	err = CheckTypes(&AggregateExpr{Op: SUM, Expr: &MatrixSelector{
+		VectorSelector: sumUp.Expr,
+		Range:          5 * time.Minute,
+	}})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "expected type instant vector")
+
+	// A valid expression passes.
+	expr, err := ParseExpr(`sum(rate(up[5m]))`)
+	require.NoError(t, err)
+	require.NoError(t, CheckTypes(expr))
+}
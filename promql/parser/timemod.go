@@ -0,0 +1,40 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package parser
+
+import "time"
+
+// TimeModifiers collects the time modifiers used anywhere in expr, descending
+// into subqueries. offsets holds every explicit offset of a selector or
+// subquery in visiting order, e.g. so caching layers can tell time-shifted
+// queries apart. This parser does not support the @ modifier yet, so hasAt is
+// always false and ats always empty; the signature anticipates it so callers
+// do not need to change once it lands.
+func TimeModifiers(expr Expr) (hasAt bool, offsets []time.Duration, ats []int64) {
+	//nolint: errcheck
+	Inspect(expr, func(node Node, _ []Node) error {
+		switch n := node.(type) {
+		case *VectorSelector:
+			if n.Offset != 0 {
+				offsets = append(offsets, n.Offset)
+			}
+		case *SubqueryExpr:
+			if n.Offset != 0 {
+				offsets = append(offsets, n.Offset)
+			}
+		}
+		return nil
+	})
+	return false, offsets, nil
+}
@@ -0,0 +1,48 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package parser
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTimeModifiers(t *testing.T) {
+	for _, test := range []struct {
+		input   string
+		offsets []time.Duration
+	}{
+		{input: `foo`},
+		{input: `foo offset 5m`, offsets: []time.Duration{5 * time.Minute}},
+		{
+			input:   `rate(foo[5m] offset 1h) + max_over_time(bar[1h:5m] offset 30m)`,
+			offsets: []time.Duration{time.Hour, 30 * time.Minute},
+		},
+		{
+			// Offsets inside subqueries are collected too.
+			input:   `max_over_time((foo offset 1m)[1h:5m] offset 2m)`,
+			offsets: []time.Duration{2 * time.Minute, time.Minute},
+		},
+	} {
+		expr, err := ParseExpr(test.input)
+		require.NoError(t, err)
+
+		hasAt, offsets, ats := TimeModifiers(expr)
+		require.False(t, hasAt, "input %q", test.input)
+		require.Empty(t, ats, "input %q", test.input)
+		require.Equal(t, test.offsets, offsets, "input %q", test.input)
+	}
+}
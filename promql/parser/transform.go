@@ -0,0 +1,131 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package parser
+
+import (
+	"github.com/pkg/errors"
+
+	"github.com/prometheus/prometheus/pkg/labels"
+)
+
+// Transform applies f to every node of expr bottom-up and returns the
+// resulting tree. Unlike rewrites via Inspect, the input tree is never
+// mutated: every node handed to f is a fresh copy whose children have already
+// been transformed, and slices like label matchers and call arguments are
+// copied too, so the original expression stays valid, e.g. for caching. f may
+// return its argument unchanged, a replacement node, or an error, which
+// aborts the transformation.
+//
+// The label matchers themselves and function definitions are shared with the
+// input; f must not mutate those in place.
+func Transform(expr Expr, f func(Expr) (Expr, error)) (Expr, error) {
+	if expr == nil {
+		return nil, nil
+	}
+
+	var cp Expr
+	switch e := expr.(type) {
+	case *NumberLiteral:
+		c := *e
+		cp = &c
+	case *StringLiteral:
+		c := *e
+		cp = &c
+	case *VectorSelector:
+		c := *e
+		c.LabelMatchers = append([]*labels.Matcher(nil), e.LabelMatchers...)
+		cp = &c
+	case *MatrixSelector:
+		c := *e
+		inner, err := Transform(e.VectorSelector, f)
+		if err != nil {
+			return nil, err
+		}
+		c.VectorSelector = inner
+		cp = &c
+	case *SubqueryExpr:
+		c := *e
+		inner, err := Transform(e.Expr, f)
+		if err != nil {
+			return nil, err
+		}
+		c.Expr = inner
+		cp = &c
+	case *ParenExpr:
+		c := *e
+		inner, err := Transform(e.Expr, f)
+		if err != nil {
+			return nil, err
+		}
+		c.Expr = inner
+		cp = &c
+	case *UnaryExpr:
+		c := *e
+		inner, err := Transform(e.Expr, f)
+		if err != nil {
+			return nil, err
+		}
+		c.Expr = inner
+		cp = &c
+	case *AggregateExpr:
+		c := *e
+		c.Grouping = append([]string(nil), e.Grouping...)
+		inner, err := Transform(e.Expr, f)
+		if err != nil {
+			return nil, err
+		}
+		c.Expr = inner
+		if e.Param != nil {
+			param, err := Transform(e.Param, f)
+			if err != nil {
+				return nil, err
+			}
+			c.Param = param
+		}
+		cp = &c
+	case *Call:
+		c := *e
+		c.Args = make(Expressions, len(e.Args))
+		for i, arg := range e.Args {
+			transformed, err := Transform(arg, f)
+			if err != nil {
+				return nil, err
+			}
+			c.Args[i] = transformed
+		}
+		cp = &c
+	case *BinaryExpr:
+		c := *e
+		if e.VectorMatching != nil {
+			vm := *e.VectorMatching
+			vm.MatchingLabels = append([]string(nil), e.VectorMatching.MatchingLabels...)
+			vm.Include = append([]string(nil), e.VectorMatching.Include...)
+			c.VectorMatching = &vm
+		}
+		lhs, err := Transform(e.LHS, f)
+		if err != nil {
+			return nil, err
+		}
+		rhs, err := Transform(e.RHS, f)
+		if err != nil {
+			return nil, err
+		}
+		c.LHS, c.RHS = lhs, rhs
+		cp = &c
+	default:
+		return nil, errors.Errorf("parser.Transform: unhandled node type %T", expr)
+	}
+
+	return f(cp)
+}
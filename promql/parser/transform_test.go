@@ -0,0 +1,61 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package parser
+
+import (
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTransform(t *testing.T) {
+	expr, err := ParseExpr(`sum(rate(foo{a="b"}[5m])) * 2 + (3 / scalar(bar))`)
+	require.NoError(t, err)
+	original := expr.String()
+
+	// Replace every number literal, leaving everything else alone.
+	out, err := Transform(expr, func(e Expr) (Expr, error) {
+		if n, ok := e.(*NumberLiteral); ok {
+			return &NumberLiteral{Val: n.Val * 10}, nil
+		}
+		return e, nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, `sum(rate(foo{a="b"}[5m])) * 20 + (30 / scalar(bar))`, out.String())
+
+	// The input tree is unchanged, including its selectors.
+	require.Equal(t, original, expr.String())
+
+	// Replacing a whole subtree works too.
+	out, err = Transform(expr, func(e Expr) (Expr, error) {
+		if vs, ok := e.(*VectorSelector); ok && vs.Name == "bar" {
+			return &NumberLiteral{Val: 1}, nil
+		}
+		return e, nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, `sum(rate(foo{a="b"}[5m])) * 2 + (3 / scalar(1))`, out.String())
+	require.Equal(t, original, expr.String())
+
+	// Errors abort the transformation.
+	boom := errors.New("boom")
+	_, err = Transform(expr, func(e Expr) (Expr, error) {
+		if _, ok := e.(*MatrixSelector); ok {
+			return nil, boom
+		}
+		return e, nil
+	})
+	require.Equal(t, boom, err)
+}
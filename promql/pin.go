@@ -0,0 +1,62 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package promql
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+// PinToTime rewrites expr so that evaluating the result at replayTime reads
+// the same data the original read at evalTime, for reproducible query replay.
+// Both times are in milliseconds. The grammar has no absolute timestamp
+// modifier, so pinning is expressed through offsets: every vector selector
+// and subquery gets replayTime-evalTime added to its offset, with selectors
+// lacking one gaining an explicit offset. Replaying before the original
+// evaluation time would need a negative offset, which the engine rejects, so
+// that is an error. The input expression is left unmodified.
+func PinToTime(expr parser.Expr, evalTime, replayTime int64) (parser.Expr, error) {
+	delta := time.Duration(replayTime-evalTime) * time.Millisecond
+	if delta < 0 {
+		return nil, errors.Errorf("cannot pin to %d: replay time %d lies before it", evalTime, replayTime)
+	}
+	cp, err := parser.Transform(expr, func(node parser.Expr) (parser.Expr, error) {
+		return node, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	//nolint: errcheck
+	parser.Inspect(cp, func(node parser.Node, path []parser.Node) error {
+		// Offsets inside a subquery are relative to the subquery's own
+		// evaluation timestamps, which the subquery's adjusted offset
+		// already moves, so only nodes outside any subquery shift.
+		for _, a := range path {
+			if _, ok := a.(*parser.SubqueryExpr); ok {
+				return nil
+			}
+		}
+		switch n := node.(type) {
+		case *parser.VectorSelector:
+			n.Offset += delta
+		case *parser.SubqueryExpr:
+			n.Offset += delta
+		}
+		return nil
+	})
+	return cp, nil
+}
@@ -0,0 +1,65 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package promql
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+func TestPinToTime(t *testing.T) {
+	cases := []struct {
+		input  string
+		pinned string
+	}{
+		{
+			input:  `foo{job="api"}`,
+			pinned: `foo{job="api"} offset 1m`,
+		},
+		{
+			input:  `rate(bar[5m] offset 1m) + foo`,
+			pinned: `rate(bar[5m] offset 2m) + foo offset 1m`,
+		},
+		{
+			input:  `max_over_time(foo[1h:1m] offset 30s)`,
+			pinned: `max_over_time(foo[1h:1m] offset 1m30s)`,
+		},
+	}
+
+	evalTime := int64(60 * 1000)
+	replayTime := evalTime + 60*1000
+
+	for _, c := range cases {
+		t.Run(c.input, func(t *testing.T) {
+			expr, err := parser.ParseExpr(c.input)
+			require.NoError(t, err)
+
+			pinned, err := PinToTime(expr, evalTime, replayTime)
+			require.NoError(t, err)
+			require.Equal(t, c.pinned, pinned.String())
+			// The original expression stays untouched.
+			require.Equal(t, c.input, expr.String())
+		})
+	}
+
+	t.Run("replay before eval time", func(t *testing.T) {
+		expr, err := parser.ParseExpr(`foo`)
+		require.NoError(t, err)
+		_, err = PinToTime(expr, evalTime, evalTime-1000)
+		require.Error(t, err)
+	})
+}
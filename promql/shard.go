@@ -0,0 +1,55 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package promql
+
+import (
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+// ShardableSelectors returns the vector selectors in expr that a
+// query-sharding frontend could split by a __name__/label hash, and whether
+// the top-level aggregation is shard-safe, i.e. whether evaluating the
+// expression per shard and merging with the same aggregation yields the same
+// result as a single evaluation. sum, count, min, max and group distribute
+// over a disjoint series partition; quantile, averages and rank selections
+// like topk do not without adjustment. Expressions whose top level is not an
+// aggregation are reported as not shard-safe, since there is no aggregation
+// to merge the shards with.
+func ShardableSelectors(expr parser.Expr) ([]*parser.VectorSelector, bool) {
+	var selectors []*parser.VectorSelector
+	//nolint: errcheck
+	parser.Inspect(expr, func(node parser.Node, _ []parser.Node) error {
+		if vs, ok := node.(*parser.VectorSelector); ok {
+			selectors = append(selectors, vs)
+		}
+		return nil
+	})
+
+	for {
+		paren, ok := expr.(*parser.ParenExpr)
+		if !ok {
+			break
+		}
+		expr = paren.Expr
+	}
+	agg, ok := expr.(*parser.AggregateExpr)
+	if !ok {
+		return selectors, false
+	}
+	switch agg.Op {
+	case parser.SUM, parser.COUNT, parser.MIN, parser.MAX, parser.GROUP:
+		return selectors, true
+	}
+	return selectors, false
+}
@@ -0,0 +1,76 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package promql
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+func TestShardableSelectors(t *testing.T) {
+	cases := []struct {
+		input     string
+		selectors []string
+		shardSafe bool
+	}{
+		{
+			input:     `sum(rate(foo[5m]))`,
+			selectors: []string{"foo"},
+			shardSafe: true,
+		},
+		{
+			input:     `max by (job)(foo / bar)`,
+			selectors: []string{"foo", "bar"},
+			shardSafe: true,
+		},
+		{
+			input:     `(count(up))`,
+			selectors: []string{"up"},
+			shardSafe: true,
+		},
+		{
+			input:     `topk(3, rate(foo[5m]))`,
+			selectors: []string{"foo"},
+			shardSafe: false,
+		},
+		{
+			input:     `quantile(0.9, foo)`,
+			selectors: []string{"foo"},
+			shardSafe: false,
+		},
+		{
+			input:     `rate(foo[5m])`,
+			selectors: []string{"foo"},
+			shardSafe: false,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.input, func(t *testing.T) {
+			expr, err := parser.ParseExpr(c.input)
+			require.NoError(t, err)
+
+			selectors, shardSafe := ShardableSelectors(expr)
+			names := make([]string, 0, len(selectors))
+			for _, vs := range selectors {
+				names = append(names, vs.Name)
+			}
+			require.Equal(t, c.selectors, names)
+			require.Equal(t, c.shardSafe, shardSafe)
+		})
+	}
+}
@@ -0,0 +1,102 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package promql
+
+import (
+	"regexp"
+	"regexp/syntax"
+
+	"github.com/prometheus/common/model"
+
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+// Simplify rewrites expr in place, removing calls that are provably no-ops,
+// and returns the rewritten expression. Currently it removes label_replace
+// calls that cannot change any series: either the regex can never match, or
+// the destination label is rewritten to its own unchanged value. The rewrite
+// is conservative; a call is kept unless it is a no-op for every input.
+func Simplify(expr parser.Expr) parser.Expr {
+	switch e := expr.(type) {
+	case *parser.ParenExpr:
+		e.Expr = Simplify(e.Expr)
+	case *parser.UnaryExpr:
+		e.Expr = Simplify(e.Expr)
+	case *parser.BinaryExpr:
+		e.LHS = Simplify(e.LHS)
+		e.RHS = Simplify(e.RHS)
+	case *parser.AggregateExpr:
+		e.Expr = Simplify(e.Expr)
+		if e.Param != nil {
+			e.Param = Simplify(e.Param)
+		}
+	case *parser.SubqueryExpr:
+		e.Expr = Simplify(e.Expr)
+	case *parser.MatrixSelector:
+		e.VectorSelector = Simplify(e.VectorSelector)
+	case *parser.Call:
+		for i := range e.Args {
+			e.Args[i] = Simplify(e.Args[i])
+		}
+		if e.Func.Name == "label_replace" && isNoOpLabelReplace(e) {
+			return e.Args[0]
+		}
+	}
+	return expr
+}
+
+// isNoOpLabelReplace reports whether the label_replace call provably leaves
+// every input series unchanged. Calls that would error at evaluation time,
+// e.g. an invalid regex or destination label, are never reported as no-ops so
+// removing the call cannot mask the error.
+func isNoOpLabelReplace(call *parser.Call) bool {
+	args := make([]string, 0, 4)
+	for _, arg := range call.Args[1:] {
+		lit, ok := arg.(*parser.StringLiteral)
+		if !ok {
+			return false
+		}
+		args = append(args, lit.Val)
+	}
+	dst, repl, src, regexStr := args[0], args[1], args[2], args[3]
+
+	if !model.LabelName(dst).IsValid() {
+		return false
+	}
+	if _, err := regexp.Compile("^(?:" + regexStr + ")$"); err != nil {
+		return false
+	}
+
+	// A regex that cannot match anything leaves all series untouched,
+	// whatever the other arguments say.
+	if re, err := syntax.Parse(regexStr, syntax.Perl); err == nil {
+		if s := re.Simplify(); s.Op == syntax.OpNoMatch || (s.Op == syntax.OpCharClass && len(s.Rune) == 0) {
+			return true
+		}
+	}
+
+	// Rewriting a label with its own full value changes nothing. Since
+	// label_replace anchors the regex, $0 is always the entire source
+	// value; $1 is only the entire value for the patterns below.
+	if dst != src {
+		return false
+	}
+	switch {
+	case repl == "$0":
+		return true
+	case repl == "$1" && (regexStr == "(.*)" || regexStr == "(.+)"):
+		return true
+	}
+	return false
+}
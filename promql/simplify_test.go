@@ -0,0 +1,52 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package promql
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+func TestSimplify(t *testing.T) {
+	for _, test := range []struct {
+		input    string
+		expected string
+	}{
+		// Rewriting a label to its own full value is a no-op.
+		{`label_replace(x, "a", "$1", "a", "(.*)")`, `x`},
+		{`label_replace(x, "a", "$1", "a", "(.+)")`, `x`},
+		{`label_replace(x, "a", "$0", "a", "foo.*")`, `x`},
+		// A regex that can never match leaves everything untouched.
+		{`label_replace(x, "b", "v", "a", "[^\\x00-\\x{10FFFF}]")`, `x`},
+		// Real replacements must be kept.
+		{`label_replace(x, "b", "$1", "a", "(.*)")`, `label_replace(x, "b", "$1", "a", "(.*)")`},
+		{`label_replace(x, "a", "static", "a", "(.*)")`, `label_replace(x, "a", "static", "a", "(.*)")`},
+		{`label_replace(x, "a", "$1", "a", "f(.*)")`, `label_replace(x, "a", "$1", "a", "f(.*)")`},
+		// An invalid regex errors at evaluation time; removing the call
+		// would hide that.
+		{`label_replace(x, "a", "$1", "a", "(")`, `label_replace(x, "a", "$1", "a", "(")`},
+		// Chained no-ops collapse and the rewrite recurses into
+		// surrounding expressions.
+		{`label_replace(label_replace(x, "a", "$1", "a", "(.*)"), "b", "$0", "b", ".*")`, `x`},
+		{`sum(label_replace(x, "a", "$1", "a", "(.*)")) / y`, `sum(x) / y`},
+		{`max_over_time(label_replace(x, "a", "$1", "a", "(.*)")[5m:1m])`, `max_over_time(x[5m:1m])`},
+	} {
+		expr, err := parser.ParseExpr(test.input)
+		require.NoError(t, err)
+		require.Equal(t, test.expected, Simplify(expr).String(), "input %q", test.input)
+	}
+}
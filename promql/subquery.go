@@ -0,0 +1,66 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package promql
+
+import (
+	"time"
+
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+// MaxSubquerySteps returns the largest number of resolution steps any
+// subquery in expr produces, so a scheduler can reject expressions like
+// `foo[1d:1s]` before they exhaust the engine. A subquery's step count is its
+// range divided by its step, rounded up, and a subquery nested inside another
+// is evaluated once per step of the outer one, so nested step counts
+// multiply. An expression without subqueries yields 0.
+//
+// Subqueries written without an explicit step resolve at the engine's default
+// evaluation interval; this assumes the standard 1m. Use
+// MaxSubqueryStepsWithInterval when the engine is configured differently.
+func MaxSubquerySteps(expr parser.Expr) int64 {
+	return MaxSubqueryStepsWithInterval(expr, time.Minute)
+}
+
+// MaxSubqueryStepsWithInterval is MaxSubquerySteps with an explicit default
+// step for subqueries that do not set one.
+func MaxSubqueryStepsWithInterval(expr parser.Expr, defaultStep time.Duration) int64 {
+	var max int64
+	//nolint: errcheck
+	parser.Inspect(expr, func(node parser.Node, path []parser.Node) error {
+		sq, ok := node.(*parser.SubqueryExpr)
+		if !ok {
+			return nil
+		}
+		total := subquerySteps(sq, defaultStep)
+		for _, a := range path {
+			if outer, ok := a.(*parser.SubqueryExpr); ok {
+				total *= subquerySteps(outer, defaultStep)
+			}
+		}
+		if total > max {
+			max = total
+		}
+		return nil
+	})
+	return max
+}
+
+func subquerySteps(sq *parser.SubqueryExpr, defaultStep time.Duration) int64 {
+	step := sq.Step
+	if step == 0 {
+		step = defaultStep
+	}
+	return int64((sq.Range + step - 1) / step)
+}
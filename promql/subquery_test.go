@@ -0,0 +1,53 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package promql
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+func TestMaxSubquerySteps(t *testing.T) {
+	cases := []struct {
+		input string
+		steps int64
+	}{
+		{input: `rate(foo[5m])`, steps: 0},
+		{input: `foo{job="api"}`, steps: 0},
+		{input: `max_over_time(foo[1h:1m])`, steps: 60},
+		{input: `max_over_time(rate(foo[1m])[1h:15s])`, steps: 240},
+		// The inner subquery runs once per outer step: 60 * 180.
+		{input: `max_over_time((min_over_time(foo[30m:10s]))[1h:1m])`, steps: 10800},
+		{input: `count_over_time(foo[10m:3m])`, steps: 4},
+	}
+
+	for _, c := range cases {
+		t.Run(c.input, func(t *testing.T) {
+			expr, err := parser.ParseExpr(c.input)
+			require.NoError(t, err)
+			require.Equal(t, c.steps, MaxSubquerySteps(expr))
+		})
+	}
+
+	t.Run("default step", func(t *testing.T) {
+		expr, err := parser.ParseExpr(`max_over_time(foo[10m:])`)
+		require.NoError(t, err)
+		require.Equal(t, int64(10), MaxSubquerySteps(expr))
+		require.Equal(t, int64(40), MaxSubqueryStepsWithInterval(expr, 15*time.Second))
+	})
+}
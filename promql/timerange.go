@@ -0,0 +1,134 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package promql
+
+import (
+	"time"
+
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/pkg/timestamp"
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+// QueryTimeRange returns the inclusive time range in milliseconds that an
+// instant query over expr at evalTime reads from storage. The computation
+// mirrors the engine's own: matrix selector ranges, offsets and nested
+// subquery windows are summed per selector, and instant vector selectors
+// look back by the engine's default lookback delta.
+func QueryTimeRange(expr parser.Expr, evalTime time.Time) (mint, maxt int64) {
+	var maxOffset time.Duration
+	//nolint: errcheck
+	parser.Inspect(expr, func(node parser.Node, path []parser.Node) error {
+		subqOffset, subqRange := subqueryOffsetRange(path)
+		switch n := node.(type) {
+		case *parser.VectorSelector:
+			if maxOffset < defaultLookbackDelta+subqOffset+subqRange {
+				maxOffset = defaultLookbackDelta + subqOffset + subqRange
+			}
+			if n.Offset+defaultLookbackDelta+subqOffset+subqRange > maxOffset {
+				maxOffset = n.Offset + defaultLookbackDelta + subqOffset + subqRange
+			}
+		case *parser.MatrixSelector:
+			if maxOffset < n.Range+subqOffset+subqRange {
+				maxOffset = n.Range + subqOffset + subqRange
+			}
+			if m := n.VectorSelector.(*parser.VectorSelector).Offset + n.Range + subqOffset + subqRange; m > maxOffset {
+				maxOffset = m
+			}
+		}
+		return nil
+	})
+	return timestamp.FromTime(evalTime.Add(-maxOffset)), timestamp.FromTime(evalTime)
+}
+
+// SelectorTimeRange pairs the matchers of one leaf selector with the
+// inclusive time window it reads, in milliseconds.
+type SelectorTimeRange struct {
+	Matchers   []*labels.Matcher
+	Start, End int64
+}
+
+// ExtractSelectorsWithTime returns every leaf selector in expr together with
+// its effective read window for an instant query at evalTime, e.g. to plan
+// reads against remote storage. Matrix selector ranges, offsets and the
+// windows of enclosing subqueries shift and widen the per-selector window the
+// same way the engine computes it; instant selectors look back by the default
+// lookback delta.
+func ExtractSelectorsWithTime(expr parser.Expr, evalTime int64) []SelectorTimeRange {
+	return ExtractSelectorsWithTimeAndLookback(expr, evalTime, defaultLookbackDelta)
+}
+
+// ExtractSelectorsWithTimeAndLookback is like ExtractSelectorsWithTime, but
+// instant selectors look back by the given lookbackDelta instead of the
+// engine's default, matching engines configured with a non-default delta.
+func ExtractSelectorsWithTimeAndLookback(expr parser.Expr, evalTime int64, lookbackDelta time.Duration) []SelectorTimeRange {
+	var ret []SelectorTimeRange
+	//nolint: errcheck
+	parser.Inspect(expr, func(node parser.Node, path []parser.Node) error {
+		vs, ok := node.(*parser.VectorSelector)
+		if !ok {
+			return nil
+		}
+		subqOffset, subqRange := subqueryOffsetRange(path)
+
+		// A vector selector directly below a matrix selector covers the
+		// matrix range; on its own it covers the lookback delta.
+		window := lookbackDelta
+		if len(path) > 0 {
+			if ms, ok := path[len(path)-1].(*parser.MatrixSelector); ok {
+				window = ms.Range
+			}
+		}
+
+		end := evalTime - durationMilliseconds(vs.Offset+subqOffset)
+		start := end - durationMilliseconds(window+subqRange)
+		ret = append(ret, SelectorTimeRange{
+			Matchers: vs.LabelMatchers,
+			Start:    start,
+			End:      end,
+		})
+		return nil
+	})
+	return ret
+}
+
+// TotalRangeMilliseconds returns the summed time span in milliseconds that
+// the range selectors in expr read from storage: every matrix selector
+// contributes its range, widened by the windows of enclosing subqueries, and
+// instant selectors inside a subquery contribute the subquery's window. A
+// scheduler can use this to reject pathologically wide queries before
+// evaluating them. Instant selectors outside subqueries contribute nothing;
+// lookback and offsets are not part of the sum.
+func TotalRangeMilliseconds(expr parser.Expr) int64 {
+	var total int64
+	//nolint: errcheck
+	parser.Inspect(expr, func(node parser.Node, path []parser.Node) error {
+		_, subqRange := subqueryOffsetRange(path)
+		switch n := node.(type) {
+		case *parser.VectorSelector:
+			// Only count the selector itself when it is not already
+			// covered by a matrix selector's range.
+			if len(path) > 0 {
+				if _, ok := path[len(path)-1].(*parser.MatrixSelector); ok {
+					return nil
+				}
+			}
+			total += durationMilliseconds(subqRange)
+		case *parser.MatrixSelector:
+			total += durationMilliseconds(n.Range + subqRange)
+		}
+		return nil
+	})
+	return total
+}
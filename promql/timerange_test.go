@@ -0,0 +1,145 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package promql
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/prometheus/prometheus/pkg/timestamp"
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+func TestQueryTimeRange(t *testing.T) {
+	evalTime := time.Unix(3600*10, 0).UTC()
+
+	cases := []struct {
+		input    string
+		lookback time.Duration
+	}{
+		// Instant selectors read back by the default lookback delta.
+		{input: `x`, lookback: defaultLookbackDelta},
+		{input: `x offset 30m`, lookback: 30*time.Minute + defaultLookbackDelta},
+		{input: `rate(x[5m])`, lookback: 5 * time.Minute},
+		{input: `rate(x[5m] offset 1h)`, lookback: time.Hour + 5*time.Minute},
+		// Nested subqueries add up their windows and offsets.
+		{input: `max_over_time(rate(x[5m])[30m:1m])`, lookback: 35 * time.Minute},
+		{input: `max_over_time(max_over_time(rate(x[5m])[30m:1m])[1h:5m] offset 1h)`, lookback: 2*time.Hour + 35*time.Minute},
+		// The widest selector wins.
+		{input: `rate(x[5m]) + rate(y[1h])`, lookback: time.Hour},
+	}
+
+	for _, c := range cases {
+		expr, err := parser.ParseExpr(c.input)
+		require.NoError(t, err)
+
+		mint, maxt := QueryTimeRange(expr, evalTime)
+		require.Equal(t, timestamp.FromTime(evalTime.Add(-c.lookback)), mint, "input %q", c.input)
+		require.Equal(t, timestamp.FromTime(evalTime), maxt, "input %q", c.input)
+	}
+}
+
+func TestExtractSelectorsWithTime(t *testing.T) {
+	const evalTime = int64(10 * 60 * 60 * 1000) // 10h in milliseconds.
+	lookback := durationMilliseconds(defaultLookbackDelta)
+
+	for _, test := range []struct {
+		input    string
+		expected []SelectorTimeRange
+	}{
+		{
+			input: `x`,
+			expected: []SelectorTimeRange{
+				{Start: evalTime - lookback, End: evalTime},
+			},
+		},
+		{
+			input: `rate(x[5m] offset 1h)`,
+			expected: []SelectorTimeRange{
+				{Start: evalTime - (60+5)*60*1000, End: evalTime - 60*60*1000},
+			},
+		},
+		{
+			input: `x + rate(y[10m])`,
+			expected: []SelectorTimeRange{
+				{Start: evalTime - lookback, End: evalTime},
+				{Start: evalTime - 10*60*1000, End: evalTime},
+			},
+		},
+		{
+			// The enclosing subquery widens and shifts the window.
+			input: `max_over_time(rate(x[5m])[30m:1m] offset 10m)`,
+			expected: []SelectorTimeRange{
+				{Start: evalTime - (10+30+5)*60*1000, End: evalTime - 10*60*1000},
+			},
+		},
+	} {
+		expr, err := parser.ParseExpr(test.input)
+		require.NoError(t, err)
+
+		ranges := ExtractSelectorsWithTime(expr, evalTime)
+		require.Len(t, ranges, len(test.expected), "input %q", test.input)
+		for i, exp := range test.expected {
+			require.NotEmpty(t, ranges[i].Matchers, "input %q", test.input)
+			require.Equal(t, exp.Start, ranges[i].Start, "input %q selector %d", test.input, i)
+			require.Equal(t, exp.End, ranges[i].End, "input %q selector %d", test.input, i)
+		}
+	}
+}
+
+func TestExtractSelectorsWithTimeAndLookback(t *testing.T) {
+	const evalTime = int64(10 * 60 * 60 * 1000) // 10h in milliseconds.
+
+	expr, err := parser.ParseExpr(`x + rate(y[10m])`)
+	require.NoError(t, err)
+
+	// The configured lookback only affects the instant selector; the matrix
+	// selector keeps its explicit range.
+	for _, lookback := range []time.Duration{5 * time.Minute, time.Minute} {
+		ranges := ExtractSelectorsWithTimeAndLookback(expr, evalTime, lookback)
+		require.Len(t, ranges, 2)
+		require.Equal(t, evalTime-durationMilliseconds(lookback), ranges[0].Start)
+		require.Equal(t, evalTime, ranges[0].End)
+		require.Equal(t, evalTime-10*60*1000, ranges[1].Start)
+		require.Equal(t, evalTime, ranges[1].End)
+	}
+
+	// The default delta keeps ExtractSelectorsWithTime's behavior.
+	require.Equal(t,
+		ExtractSelectorsWithTime(expr, evalTime),
+		ExtractSelectorsWithTimeAndLookback(expr, evalTime, defaultLookbackDelta),
+	)
+}
+
+func TestTotalRangeMilliseconds(t *testing.T) {
+	for _, test := range []struct {
+		input    string
+		expected int64
+	}{
+		{`up`, 0},
+		{`rate(x[5m])`, 5 * 60 * 1000},
+		// Parallel ranges are summed.
+		{`rate(x[5m]) + rate(y[10m])`, 15 * 60 * 1000},
+		// A subquery widens the window of every selector below it.
+		{`max_over_time(rate(x[5m])[30m:1m])`, 35 * 60 * 1000},
+		{`max_over_time(up[1h:1m])`, 60 * 60 * 1000},
+		{`max_over_time(max_over_time(up[10m:])[1h:])`, (60 + 10) * 60 * 1000},
+	} {
+		expr, err := parser.ParseExpr(test.input)
+		require.NoError(t, err)
+		require.Equal(t, test.expected, TotalRangeMilliseconds(expr), "input %q", test.input)
+	}
+}
@@ -26,8 +26,10 @@ import (
 var (
 	ErrNotFound                    = errors.New("not found")
 	ErrOutOfOrderSample            = errors.New("out of order sample")
+	ErrOutOfOrderExemplar          = errors.New("out of order exemplar")
 	ErrDuplicateSampleForTimestamp = errors.New("duplicate sample for timestamp")
 	ErrOutOfBounds                 = errors.New("out of bounds")
+	ErrExemplarLabelLength         = errors.New("label length for exemplar exceeds maximum length")
 )
 
 // Appendable allows creating appenders.
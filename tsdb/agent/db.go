@@ -0,0 +1,1007 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/atomic"
+
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/pkg/timestamp"
+	"github.com/prometheus/prometheus/storage"
+	"github.com/prometheus/prometheus/tsdb"
+	"github.com/prometheus/prometheus/tsdb/fileutil"
+	"github.com/prometheus/prometheus/tsdb/record"
+	"github.com/prometheus/prometheus/tsdb/wal"
+)
+
+var (
+	// ErrUnsupported is returned for operations the WAL-only storage does
+	// not support, like querying.
+	ErrUnsupported = errors.New("unsupported operation with WAL-only storage")
+
+	// ErrBackpressure is returned by appends when the WAL holds more than
+	// Options.MaxWALBytes of unsent data. It is retryable: appends succeed
+	// again once truncation has drained the backlog.
+	ErrBackpressure = errors.New("WAL backlog exceeds configured maximum")
+)
+
+// DefaultStripeSize is the default number of entries to allocate in the
+// stripeSeries list.
+const DefaultStripeSize = 1 << 14
+
+// WALCompressionType is the record compression codec of the WAL.
+type WALCompressionType string
+
+const (
+	// WALCompressionNone leaves records uncompressed, trading disk and
+	// bandwidth for CPU on constrained edge nodes.
+	WALCompressionNone WALCompressionType = "none"
+	// WALCompressionSnappy compresses records with Snappy.
+	WALCompressionSnappy WALCompressionType = "snappy"
+	// WALCompressionZstd is reserved for zstd compression, which the
+	// underlying WAL implementation does not support yet. Open rejects it
+	// so configurations do not silently run uncompressed.
+	WALCompressionZstd WALCompressionType = "zstd"
+)
+
+// Options of the WAL storage.
+type Options struct {
+	// Segments (wal files) max size.
+	// WALSegmentSize <= 0, segment size is default size.
+	WALSegmentSize int
+
+	// WALCompression selects the record compression codec of the WAL. An
+	// empty value means WALCompressionNone.
+	WALCompression WALCompressionType
+
+	// StripeSize is the size (power of 2) in entries of the series hash map. Reducing the size will save memory but impact performance.
+	StripeSize int
+
+	// TruncateFrequency determines how frequently to truncate data from the WAL.
+	TruncateFrequency time.Duration
+
+	// SeriesGCInterval determines how frequently inactive series are
+	// removed from memory, independently of WAL truncation. 0 disables the
+	// extra garbage collection; series are then only dropped as part of
+	// truncation every TruncateFrequency.
+	SeriesGCInterval time.Duration
+
+	// Shortest and longest amount of time data can exist in the WAL before being
+	// deleted.
+	MinWALTime, MaxWALTime int64
+
+	// MaxWALBytes caps the size of the WAL on disk. Appends return
+	// ErrBackpressure while the cap is exceeded, so callers back off
+	// instead of growing the WAL unbounded. 0 means unlimited.
+	MaxWALBytes int64
+
+	// RemoteWriteRetryCallback, if set, is invoked on every remote-write
+	// retry with the endpoint name, the attempt number (starting at 1) and
+	// the error that caused the retry.
+	RemoteWriteRetryCallback func(remoteName string, attempt int, err error)
+
+	// OnTruncate, if set, is invoked synchronously after each WAL
+	// truncation completes, with the number of series deleted by it and
+	// the highest segment included in the checkpoint. It gives tests and
+	// operators a deterministic signal instead of polling metrics.
+	OnTruncate func(deletedSeries int, checkpointedSegment int)
+}
+
+// DefaultOptions used for the WAL storage. They are sane for setups using
+// millisecond-precision timestamps.
+func DefaultOptions() *Options {
+	return &Options{
+		WALSegmentSize:    wal.DefaultSegmentSize,
+		WALCompression:    WALCompressionNone,
+		StripeSize:        DefaultStripeSize,
+		TruncateFrequency: 2 * time.Hour,
+		MinWALTime:        5 * 60 * 1000,      // 5 min in milliseconds.
+		MaxWALTime:        4 * 60 * 60 * 1000, // 4 hours in milliseconds.
+	}
+}
+
+// RemoteSendProgress reports progress of the remote-write subsystem. It
+// gates WAL truncation so data is not deleted before it has been sent.
+type RemoteSendProgress interface {
+	// LowestSentTimestamp returns the lowest timestamp in milliseconds
+	// that has been sent to all remote-write endpoints.
+	LowestSentTimestamp() int64
+}
+
+type dbMetrics struct {
+	numActiveSeries             prometheus.Gauge
+	numWALSeriesPendingDeletion prometheus.Gauge
+	totalAppendedSamples        prometheus.Counter
+	walReplayDuration           prometheus.Gauge
+	walCorruptionsTotal         prometheus.Counter
+	walOldestTimestamp          prometheus.Gauge
+	samplesSentTotal            *prometheus.CounterVec
+	samplesFailedTotal          *prometheus.CounterVec
+	remoteWriteRetriesTotal     *prometheus.CounterVec
+}
+
+func newDBMetrics(r prometheus.Registerer) *dbMetrics {
+	m := dbMetrics{
+		numActiveSeries: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "prometheus_agent_active_series",
+			Help: "Number of active series being tracked by the WAL storage",
+		}),
+		numWALSeriesPendingDeletion: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "prometheus_agent_deleted_series",
+			Help: "Number of series pending deletion from the WAL",
+		}),
+		totalAppendedSamples: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "prometheus_agent_samples_appended_total",
+			Help: "Total number of samples appended to the storage",
+		}),
+		walReplayDuration: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "prometheus_agent_wal_replay_duration_seconds",
+			Help: "Time taken to replay the WAL on startup",
+		}),
+		walCorruptionsTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "prometheus_agent_wal_corruptions_total",
+			Help: "Total number of WAL corruptions recovered from during replay",
+		}),
+		walOldestTimestamp: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "prometheus_agent_wal_oldest_timestamp_seconds",
+			Help: "Timestamp of the oldest sample still retained in the WAL, i.e. the low watermark of the last successful truncation",
+		}),
+		samplesSentTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "prometheus_agent_samples_sent_total",
+			Help: "Total number of samples successfully sent per remote-write endpoint",
+		}, []string{"remote_name"}),
+		samplesFailedTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "prometheus_agent_samples_failed_total",
+			Help: "Total number of samples that failed to send per remote-write endpoint",
+		}, []string{"remote_name"}),
+		remoteWriteRetriesTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "prometheus_agent_remote_write_retries_total",
+			Help: "Total number of remote-write send retries per remote-write endpoint",
+		}, []string{"remote_name"}),
+	}
+
+	if r != nil {
+		r.MustRegister(
+			m.numActiveSeries,
+			m.numWALSeriesPendingDeletion,
+			m.totalAppendedSamples,
+			m.walReplayDuration,
+			m.walCorruptionsTotal,
+			m.walOldestTimestamp,
+			m.samplesSentTotal,
+			m.samplesFailedTotal,
+			m.remoteWriteRetriesTotal,
+		)
+	}
+
+	return &m
+}
+
+// Storage implements storage.Storage and only supports appends. Samples and
+// series are written to the WAL for a remote-write subsystem to consume;
+// nothing is queryable locally.
+type Storage struct {
+	mtx sync.RWMutex
+
+	// truncateMtx serializes WAL truncation and series GC. Truncate makes
+	// them reachable from outside the run loop, and the two must not
+	// interleave: both mutate db.deleted, and overlapping
+	// checkpoint/truncate sequences would race on the same segments.
+	truncateMtx sync.Mutex
+
+	logger  log.Logger
+	opts    *Options
+	rs      RemoteSendProgress
+	metrics *dbMetrics
+
+	wal *wal.WAL
+
+	appenderPool sync.Pool
+	bufPool      sync.Pool
+
+	nextRef  atomic.Uint64
+	walBytes atomic.Int64
+	series   *stripeSeries
+	// deleted is a map of (ref IDs that should be deleted from WAL) to (the WAL segment they
+	// must be kept around to).
+	deleted map[uint64]int
+
+	donec chan struct{}
+	stopc chan struct{}
+}
+
+// SubDirectory returns the subdirectory within a Storage directory used for
+// the Prometheus WAL.
+func SubDirectory(base string) string {
+	return filepath.Join(base, "wal")
+}
+
+// Open returns a new WAL-only storage. The WAL and all state is stored in a
+// "wal" subdirectory of dir. rs may be nil if no remote-write subsystem
+// exists; the WAL is then truncated based on age alone.
+func Open(l log.Logger, reg prometheus.Registerer, rs RemoteSendProgress, dir string, opts *Options) (*Storage, error) {
+	opts = validateOptions(opts)
+
+	if l == nil {
+		l = log.NewNopLogger()
+	}
+
+	// remote_write expects WAL to be stored in a "wal" subdirectory of the
+	// main storage.
+	dir = SubDirectory(dir)
+
+	switch opts.WALCompression {
+	case WALCompressionNone, WALCompressionSnappy:
+	case WALCompressionZstd:
+		return nil, errors.Errorf("WAL compression %q is not supported by the WAL implementation", opts.WALCompression)
+	default:
+		return nil, errors.Errorf("invalid WAL compression %q", opts.WALCompression)
+	}
+
+	w, err := wal.NewSize(l, reg, dir, opts.WALSegmentSize, opts.WALCompression == WALCompressionSnappy)
+	if err != nil {
+		return nil, errors.Wrap(err, "creating WAL")
+	}
+
+	db := &Storage{
+		logger:  l,
+		opts:    opts,
+		rs:      rs,
+		metrics: newDBMetrics(reg),
+
+		wal: w,
+
+		nextRef: *atomic.NewUint64(0),
+		series:  newStripeSeries(opts.StripeSize),
+		deleted: make(map[uint64]int),
+
+		donec: make(chan struct{}),
+		stopc: make(chan struct{}),
+	}
+
+	db.bufPool.New = func() interface{} {
+		return make([]byte, 0, 1024)
+	}
+
+	db.appenderPool.New = func() interface{} {
+		return &appender{
+			Storage:        db,
+			pendingSeries:  make([]record.RefSeries, 0, 100),
+			pendingSamples: make([]record.RefSample, 0, 100),
+		}
+	}
+
+	walReplayStart := time.Now()
+	if err := db.replayWAL(); err != nil {
+		// A truncated or corrupted tail must not fail startup; everything
+		// before the corruption has been loaded, so repair the WAL and carry
+		// on like the server TSDB does.
+		db.metrics.walCorruptionsTotal.Inc()
+		level.Warn(db.logger).Log("msg", "encountered WAL read error, attempting repair", "err", err)
+		if err := w.Repair(err); err != nil {
+			return nil, errors.Wrap(err, "repair corrupted WAL")
+		}
+	}
+	db.metrics.walReplayDuration.Set(time.Since(walReplayStart).Seconds())
+
+	if size, err := fileutil.DirSize(w.Dir()); err == nil {
+		db.walBytes.Store(size)
+	}
+
+	go db.run()
+	return db, nil
+}
+
+func validateOptions(opts *Options) *Options {
+	if opts == nil {
+		opts = DefaultOptions()
+	}
+	if opts.WALSegmentSize <= 0 {
+		opts.WALSegmentSize = wal.DefaultSegmentSize
+	}
+	if opts.WALCompression == "" {
+		opts.WALCompression = WALCompressionNone
+	}
+
+	// Revert StripeSize to DefaultStripeSize if StripeSize is either 0 or not
+	// a power of 2.
+	if opts.StripeSize <= 0 || ((opts.StripeSize & (opts.StripeSize - 1)) != 0) {
+		opts.StripeSize = DefaultStripeSize
+	}
+	if opts.TruncateFrequency <= 0 {
+		opts.TruncateFrequency = DefaultOptions().TruncateFrequency
+	}
+	if opts.MinWALTime <= 0 {
+		opts.MinWALTime = DefaultOptions().MinWALTime
+	}
+	if opts.MaxWALTime <= 0 {
+		opts.MaxWALTime = DefaultOptions().MaxWALTime
+	}
+	if opts.MinWALTime > opts.MaxWALTime {
+		opts.MaxWALTime = opts.MinWALTime
+	}
+	return opts
+}
+
+func (db *Storage) replayWAL() error {
+	level.Info(db.logger).Log("msg", "replaying WAL, this may take a while", "dir", db.wal.Dir())
+	start := time.Now()
+
+	dir, startFrom, err := wal.LastCheckpoint(db.wal.Dir())
+	if err != nil && err != record.ErrNotFound {
+		return errors.Wrap(err, "find last checkpoint")
+	}
+
+	if err == nil {
+		sr, err := wal.NewSegmentsReader(dir)
+		if err != nil {
+			return errors.Wrap(err, "open checkpoint")
+		}
+		defer func() {
+			if err := sr.Close(); err != nil {
+				level.Warn(db.logger).Log("msg", "error while closing the wal segments reader", "err", err)
+			}
+		}()
+
+		// A corrupted checkpoint is a hard error for now and requires user
+		// intervention. There's likely little data that can be recovered anyway.
+		if err := db.loadWAL(wal.NewReader(sr)); err != nil {
+			return errors.Wrap(err, "backfill checkpoint")
+		}
+		startFrom++
+		level.Info(db.logger).Log("msg", "WAL checkpoint loaded")
+	}
+
+	// Find the last segment.
+	_, last, err := wal.Segments(db.wal.Dir())
+	if err != nil {
+		return errors.Wrap(err, "finding WAL segments")
+	}
+
+	// Backfill segments from the most recent checkpoint onwards.
+	for i := startFrom; i <= last; i++ {
+		seg, err := wal.OpenReadSegment(wal.SegmentName(db.wal.Dir(), i))
+		if err != nil {
+			return errors.Wrapf(err, "open WAL segment: %d", i)
+		}
+
+		sr := wal.NewSegmentBufReader(seg)
+		err = db.loadWAL(wal.NewReader(sr))
+		if err := sr.Close(); err != nil {
+			level.Warn(db.logger).Log("msg", "error while closing the wal segments reader", "err", err)
+		}
+		if err != nil {
+			return err
+		}
+		level.Info(db.logger).Log("msg", "WAL segment loaded", "segment", i, "maxSegment", last)
+	}
+
+	level.Info(db.logger).Log("msg", "WAL replay completed", "duration", time.Since(start))
+	return nil
+}
+
+func (db *Storage) loadWAL(r *wal.Reader) error {
+	var (
+		dec     record.Decoder
+		series  []record.RefSeries
+		samples []record.RefSample
+		// Later WAL segments may hold no series records at all (after a
+		// checkpoint they typically contain only samples), so the watermark
+		// carries over from previous loadWAL calls instead of restarting
+		// at zero and handing out refs that are already taken.
+		lastRef = db.nextRef.Load()
+	)
+
+	for r.Next() {
+		rec := r.Record()
+		switch dec.Type(rec) {
+		case record.Series:
+			series, err := dec.Series(rec, series[:0])
+			if err != nil {
+				// A single undecodable record does not prevent replaying the
+				// rest; the WAL reader already verified the checksum, so this
+				// is an encoding bug rather than disk corruption.
+				db.metrics.walCorruptionsTotal.Inc()
+				level.Warn(db.logger).Log("msg", "skipping corrupt series record", "segment", r.Segment(), "offset", r.Offset(), "err", err)
+				continue
+			}
+			for _, entry := range series {
+				// If this is a new series, create it in memory without a timestamp.
+				// If we read in a sample for it, we will assign a timestamp.
+				if db.series.getByID(entry.Ref) == nil {
+					s := &memSeries{ref: entry.Ref, lset: entry.Labels, lastTs: 0}
+					db.series.set(entry.Labels.Hash(), s)
+					db.metrics.numActiveSeries.Inc()
+					if entry.Ref > lastRef {
+						lastRef = entry.Ref
+					}
+				}
+			}
+		case record.Samples:
+			samples, err := dec.Samples(rec, samples[:0])
+			if err != nil {
+				db.metrics.walCorruptionsTotal.Inc()
+				level.Warn(db.logger).Log("msg", "skipping corrupt samples record", "segment", r.Segment(), "offset", r.Offset(), "err", err)
+				continue
+			}
+			for _, entry := range samples {
+				// Update the lastTs for the series based on the sample
+				// timestamp, so stale series can be garbage collected.
+				series := db.series.getByID(entry.Ref)
+				if series == nil {
+					level.Warn(db.logger).Log("msg", "found sample referencing non-existing series", "skipping")
+					continue
+				}
+				series.updateTimestamp(entry.T)
+			}
+		case record.Tombstones, record.Exemplars:
+			// We don't care about tombstones or exemplars during replay.
+		default:
+			level.Warn(db.logger).Log("msg", "unknown record type found during replay", "type", dec.Type(rec))
+		}
+	}
+	if err := r.Err(); err != nil {
+		return errors.Wrap(err, "read records")
+	}
+
+	db.nextRef.Store(lastRef)
+	return nil
+}
+
+func (db *Storage) run() {
+	defer close(db.donec)
+
+	// High-churn setups can garbage collect inactive series more often than
+	// the WAL is truncated. The nil channel keeps the case inert when the
+	// interval is unset.
+	var gcTick <-chan time.Time
+	if db.opts.SeriesGCInterval > 0 {
+		ticker := time.NewTicker(db.opts.SeriesGCInterval)
+		defer ticker.Stop()
+		gcTick = ticker.C
+	}
+
+	// The truncation timer must be a ticker rather than a per-iteration
+	// time.After: GC ticks wake the loop, and with a GC interval shorter
+	// than TruncateFrequency a fresh time.After would be reset on every
+	// wake-up and never fire.
+	truncateTick := time.NewTicker(db.opts.TruncateFrequency)
+	defer truncateTick.Stop()
+
+Loop:
+	for {
+		select {
+		case <-db.stopc:
+			break Loop
+		case <-gcTick:
+			db.truncateMtx.Lock()
+			db.mtx.RLock()
+			deleted := db.gc(db.gcCutoff())
+			db.mtx.RUnlock()
+			db.truncateMtx.Unlock()
+			level.Debug(db.logger).Log("msg", "series GC completed", "deleted", deleted)
+		case <-truncateTick.C:
+			// The cutoff determines which series are not receiving samples
+			// and may be deleted from the WAL: their most recent append
+			// timestamp is compared to it, and if older, they are
+			// considered inactive and may be deleted.
+			ts := db.gcCutoff()
+
+			level.Debug(db.logger).Log("msg", "truncating the WAL", "ts", ts)
+			if err := db.truncate(ts); err != nil {
+				level.Warn(db.logger).Log("msg", "failed to truncate WAL", "err", err)
+			}
+		}
+	}
+}
+
+// gcCutoff returns the timestamp before which series without newer samples
+// count as inactive, mirroring the computation the truncation loop uses: the
+// remote-write low watermark minus MinWALTime, bounded by MaxWALTime.
+func (db *Storage) gcCutoff() int64 {
+	ts := int64(0)
+	if db.rs != nil {
+		ts = db.rs.LowestSentTimestamp() - db.opts.MinWALTime
+	}
+	if ts < 0 {
+		ts = 0
+	}
+	if maxTS := timestamp.FromTime(time.Now()) - db.opts.MaxWALTime; ts < maxTS {
+		ts = maxTS
+	}
+	return ts
+}
+
+// Truncate performs the same WAL truncation the periodic loop runs, with the
+// same inactivity cutoff, and returns once it completes. It gives backup
+// workflows and tests a deterministic lever instead of waiting for
+// TruncateFrequency to elapse.
+func (db *Storage) Truncate() error {
+	return db.truncate(db.gcCutoff())
+}
+
+func (db *Storage) truncate(mint int64) error {
+	db.truncateMtx.Lock()
+	defer db.truncateMtx.Unlock()
+
+	db.mtx.RLock()
+	defer db.mtx.RUnlock()
+
+	start := time.Now()
+
+	first, last, err := wal.Segments(db.wal.Dir())
+	if err != nil {
+		return errors.Wrap(err, "get segment range")
+	}
+
+	// Start a new segment so low ingestion volume instances don't have more
+	// WAL than needed.
+	err = db.wal.NextSegment()
+	if err != nil {
+		return errors.Wrap(err, "next segment")
+	}
+
+	last-- // Never consider most recent segment for checkpoint.
+	if last < 0 {
+		return nil // no segments yet.
+	}
+
+	// The lower two-thirds of segments should contain mostly obsolete samples.
+	// If we have less than two segments, it's not worth checkpointing yet.
+	last = first + (last-first)*2/3
+	if last <= first {
+		return nil
+	}
+
+	keep := func(id uint64) bool {
+		if db.series.getByID(id) != nil {
+			return true
+		}
+
+		seg, ok := db.deleted[id]
+		return ok && seg > last
+	}
+
+	deletedSeries := db.gc(mint)
+	level.Info(db.logger).Log("msg", "series GC completed", "duration", time.Since(start))
+
+	if _, err = wal.Checkpoint(db.logger, db.wal, first, last, keep, mint); err != nil {
+		return errors.Wrap(err, "create checkpoint")
+	}
+	if err := db.wal.Truncate(last + 1); err != nil {
+		// If truncating fails, we'll just try it again at the next checkpoint.
+		// Leftover segments will still just be ignored in the future if there's a
+		// checkpoint that supersedes them.
+		level.Error(db.logger).Log("msg", "truncating segments failed", "err", err)
+	}
+
+	// The checkpoint is written and segments before it are truncated, so we
+	// no longer need to track deleted series that were being kept around.
+	for ref, segment := range db.deleted {
+		if segment < first {
+			delete(db.deleted, ref)
+		}
+	}
+	db.metrics.numWALSeriesPendingDeletion.Set(float64(len(db.deleted)))
+
+	if err := wal.DeleteCheckpoints(db.wal.Dir(), last); err != nil {
+		// Leftover old checkpoints do not cause problems down the line beyond
+		// occupying disk space. They will just be ignored since a newer checkpoint
+		// exists.
+		level.Error(db.logger).Log("msg", "delete old checkpoints", "err", err)
+	}
+
+	// Re-measure the WAL on disk so appends blocked by MaxWALBytes resume
+	// once truncation has freed enough space.
+	if size, err := fileutil.DirSize(db.wal.Dir()); err == nil {
+		db.walBytes.Store(size)
+	}
+
+	// Everything older than mint is gone now; compared against wall-clock
+	// time this exposes how far behind remote-write lets the WAL fall.
+	db.metrics.walOldestTimestamp.Set(float64(mint) / 1000)
+
+	level.Info(db.logger).Log("msg", "WAL checkpoint complete", "first", first, "last", last, "duration", time.Since(start))
+	if db.opts.OnTruncate != nil {
+		db.opts.OnTruncate(deletedSeries, last)
+	}
+	return nil
+}
+
+// gc marks ref IDs that have not received a sample since mint as deleted in
+// s.deleted, along with the segment where they originally got deleted. It
+// returns how many series were deleted by this pass.
+func (db *Storage) gc(mint int64) int {
+	deleted := db.series.gc(mint)
+	db.metrics.numActiveSeries.Sub(float64(len(deleted)))
+
+	_, last, _ := wal.Segments(db.wal.Dir())
+
+	// We want to keep series records for any newly deleted series
+	// until we've passed the last recorded segment. The WAL will
+	// still contain samples records with all of the ref IDs until
+	// the segment's samples has been deleted from the checkpoint.
+	//
+	// If the series weren't kept on startup when the WAL was replied,
+	// the samples wouldn't be able to be used since there wouldn't
+	// be any labels for that ref ID.
+	for ref := range deleted {
+		db.deleted[ref] = last
+	}
+
+	db.metrics.numWALSeriesPendingDeletion.Set(float64(len(db.deleted)))
+	return len(deleted)
+}
+
+// snapshotMetaFilename is the name of the metadata file written next to a
+// snapshot's WAL directory.
+const snapshotMetaFilename = "snapshot.json"
+
+// snapshotMeta records state about the storage at the time a snapshot was
+// taken that cannot be represented as WAL records.
+type snapshotMeta struct {
+	// LowestSentTimestamp is the lowest timestamp in milliseconds sent to
+	// all remote-write endpoints when the snapshot was taken.
+	LowestSentTimestamp int64 `json:"lowestSentTimestamp"`
+	// Time is the time the snapshot was taken, in milliseconds.
+	Time int64 `json:"time"`
+}
+
+// Snapshot writes a consistent snapshot of the current in-memory state into
+// dir. All active series are flushed into a fresh WAL so that a Storage
+// opened at dir only replays those records instead of the full WAL. The
+// last-sent remote-write offset is recorded alongside it so sending can
+// resume where it left off.
+func (db *Storage) Snapshot(dir string) error {
+	db.mtx.RLock()
+	defer db.mtx.RUnlock()
+
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return errors.Wrap(err, "create snapshot dir")
+	}
+
+	w, err := wal.NewSize(db.logger, nil, SubDirectory(dir), db.opts.WALSegmentSize, db.opts.WALCompression == WALCompressionSnappy)
+	if err != nil {
+		return errors.Wrap(err, "create snapshot WAL")
+	}
+
+	var (
+		enc    record.Encoder
+		buf    []byte
+		series = make([]record.RefSeries, 0, 512)
+	)
+	flush := func() error {
+		if len(series) == 0 {
+			return nil
+		}
+		buf = enc.Series(series, buf[:0])
+		series = series[:0]
+		return w.Log(buf)
+	}
+
+	err = db.series.forEach(func(s *memSeries) error {
+		series = append(series, record.RefSeries{Ref: s.ref, Labels: s.lset})
+		if len(series) == cap(series) {
+			return flush()
+		}
+		return nil
+	})
+	if err == nil {
+		err = flush()
+	}
+	if err != nil {
+		w.Close()
+		return errors.Wrap(err, "snapshot series")
+	}
+	if err := w.Close(); err != nil {
+		return errors.Wrap(err, "close snapshot WAL")
+	}
+
+	meta := snapshotMeta{Time: timestamp.FromTime(time.Now())}
+	if db.rs != nil {
+		meta.LowestSentTimestamp = db.rs.LowestSentTimestamp()
+	}
+	b, err := json.MarshalIndent(&meta, "", "\t")
+	if err != nil {
+		return errors.Wrap(err, "marshal snapshot meta")
+	}
+	return errors.Wrap(
+		ioutil.WriteFile(filepath.Join(dir, snapshotMetaFilename), b, 0666),
+		"write snapshot meta",
+	)
+}
+
+// maxListSeries caps the number of series returned by ListSeries, so an
+// overly broad matcher on a large head does not build an unbounded result.
+const maxListSeries = 10000
+
+// errListSeriesDone stops the series iteration early once the cap is hit.
+var errListSeriesDone = errors.New("list series done")
+
+// ListSeries returns the labels of up to maxListSeries series currently in
+// the head that match all given matchers. It exists for introspection, e.g.
+// to troubleshoot dropped metrics; unlike Querier it does not return
+// ErrUnsupported, but it offers no samples either.
+func (db *Storage) ListSeries(matchers ...*labels.Matcher) ([]labels.Labels, error) {
+	var ret []labels.Labels
+	err := db.series.forEach(func(s *memSeries) error {
+		for _, m := range matchers {
+			if !m.Matches(s.lset.Get(m.Name)) {
+				return nil
+			}
+		}
+		ret = append(ret, s.lset)
+		if len(ret) >= maxListSeries {
+			return errListSeriesDone
+		}
+		return nil
+	})
+	if err != nil && err != errListSeriesDone {
+		return nil, err
+	}
+	sort.Slice(ret, func(i, j int) bool { return labels.Compare(ret[i], ret[j]) < 0 })
+	return ret, nil
+}
+
+// SamplesSent records n samples as successfully sent by the remote-write
+// endpoint with the given name. The remote-write manager calls this after
+// each successful send. remoteName should be the configured name of the
+// endpoint or, if unnamed, its URL.
+func (db *Storage) SamplesSent(remoteName string, n int) {
+	db.metrics.samplesSentTotal.WithLabelValues(remoteName).Add(float64(n))
+}
+
+// SamplesFailed records n samples as dropped after the remote-write endpoint
+// with the given name exhausted its retries.
+func (db *Storage) SamplesFailed(remoteName string, n int) {
+	db.metrics.samplesFailedTotal.WithLabelValues(remoteName).Add(float64(n))
+}
+
+// RemoteWriteRetry records a retried send to the remote-write endpoint with
+// the given name. The remote-write manager calls this before each retry,
+// passing the attempt number (starting at 1) and the error that caused it.
+// The configured RemoteWriteRetryCallback, if any, is invoked with the same
+// arguments.
+func (db *Storage) RemoteWriteRetry(remoteName string, attempt int, err error) {
+	db.metrics.remoteWriteRetriesTotal.WithLabelValues(remoteName).Inc()
+	if db.opts.RemoteWriteRetryCallback != nil {
+		db.opts.RemoteWriteRetryCallback(remoteName, attempt, err)
+	}
+}
+
+// StartTime implements the Storage interface.
+func (db *Storage) StartTime() (int64, error) {
+	return int64(math.MaxInt64), ErrUnsupported
+}
+
+// Querier implements the Storage interface.
+func (db *Storage) Querier(ctx context.Context, mint, maxt int64) (storage.Querier, error) {
+	return nil, ErrUnsupported
+}
+
+// ChunkQuerier implements the Storage interface.
+func (db *Storage) ChunkQuerier(ctx context.Context, mint, maxt int64) (storage.ChunkQuerier, error) {
+	return nil, ErrUnsupported
+}
+
+// Appender implements storage.Storage.
+func (db *Storage) Appender(_ context.Context) storage.Appender {
+	return db.appenderPool.Get().(storage.Appender)
+}
+
+// Close closes the storage and all its underlying resources.
+func (db *Storage) Close() error {
+	close(db.stopc)
+	<-db.donec
+
+	return db.wal.Close()
+}
+
+type appender struct {
+	*Storage
+
+	pendingSeries  []record.RefSeries
+	pendingSamples []record.RefSample
+}
+
+// Add adds a sample pair for the given series.
+func (a *appender) Add(l labels.Labels, t int64, v float64) (uint64, error) {
+	if err := a.checkBackpressure(); err != nil {
+		return 0, err
+	}
+	hash := l.Hash()
+	series := a.series.getByHash(hash, l)
+	if series != nil {
+		return series.ref, a.AddFast(series.ref, t, v)
+	}
+
+	// Ensure no empty or duplicate labels have gotten through. This mirrors the
+	// equivalent validation code in the TSDB's headAppender.
+	l = l.WithoutEmpty()
+	if len(l) == 0 {
+		return 0, errors.Wrap(tsdb.ErrInvalidSample, "empty labelset")
+	}
+	if lbl, dup := l.HasDuplicateLabelNames(); dup {
+		return 0, errors.Wrap(tsdb.ErrInvalidSample, fmt.Sprintf(`label name "%s" is not unique`, lbl))
+	}
+
+	ref := a.nextRef.Inc()
+	series = &memSeries{ref: ref, lset: l, lastTs: t}
+
+	a.pendingSeries = append(a.pendingSeries, record.RefSeries{
+		Ref:    ref,
+		Labels: l,
+	})
+	a.pendingSamples = append(a.pendingSamples, record.RefSample{
+		Ref: ref,
+		T:   t,
+		V:   v,
+	})
+
+	a.series.set(hash, series)
+
+	a.metrics.numActiveSeries.Inc()
+	return series.ref, nil
+}
+
+// AddFast adds a sample pair for the referenced series.
+func (a *appender) AddFast(ref uint64, t int64, v float64) error {
+	if err := a.checkBackpressure(); err != nil {
+		return err
+	}
+	series := a.series.getByID(ref)
+	if series == nil {
+		return storage.ErrNotFound
+	}
+	series.Lock()
+	defer series.Unlock()
+
+	// Update last recorded timestamp. Used by Storage.gc to determine if a
+	// series is dead.
+	series.lastTs = t
+
+	a.pendingSamples = append(a.pendingSamples, record.RefSample{
+		Ref: ref,
+		T:   t,
+		V:   v,
+	})
+	return nil
+}
+
+// checkBackpressure returns ErrBackpressure when the WAL exceeds the
+// configured maximum size.
+func (db *Storage) checkBackpressure() error {
+	if db.opts.MaxWALBytes > 0 && db.walBytes.Load() >= db.opts.MaxWALBytes {
+		return ErrBackpressure
+	}
+	return nil
+}
+
+// Commit submits the collected samples and purges the batch.
+func (a *appender) Commit() error {
+	a.mtx.RLock()
+	defer a.mtx.RUnlock()
+
+	var encoder record.Encoder
+	buf := a.bufPool.Get().([]byte)
+
+	if len(a.pendingSeries) > 0 {
+		buf = encoder.Series(a.pendingSeries, buf)
+		if err := a.wal.Log(buf); err != nil {
+			return err
+		}
+		a.walBytes.Add(int64(len(buf)))
+		buf = buf[:0]
+	}
+
+	if len(a.pendingSamples) > 0 {
+		buf = encoder.Samples(a.pendingSamples, buf)
+		if err := a.wal.Log(buf); err != nil {
+			return err
+		}
+		a.walBytes.Add(int64(len(buf)))
+		buf = buf[:0]
+	}
+
+	a.metrics.totalAppendedSamples.Add(float64(len(a.pendingSamples)))
+
+	//nolint:staticcheck
+	a.bufPool.Put(buf)
+	return a.Rollback()
+}
+
+// Rollback rolls back all modifications made in the appender so far.
+func (a *appender) Rollback() error {
+	a.pendingSeries = a.pendingSeries[:0]
+	a.pendingSamples = a.pendingSamples[:0]
+	a.appenderPool.Put(a)
+	return nil
+}
+
+// DryRunAppender returns an appender that runs the same validation as the
+// real append path - backpressure and label checks - but registers no series,
+// writes nothing to the WAL and leaves all metrics untouched. It lets a
+// config-test mode surface the errors a real scrape would hit without
+// persisting anything.
+func (db *Storage) DryRunAppender() storage.Appender {
+	return &dryRunAppender{db: db, refs: map[uint64]struct{}{}}
+}
+
+type dryRunAppender struct {
+	db   *Storage
+	ref  uint64
+	refs map[uint64]struct{}
+}
+
+// Add validates the sample exactly like appender.Add but discards it. The
+// returned refs are local to this appender.
+func (a *dryRunAppender) Add(l labels.Labels, t int64, v float64) (uint64, error) {
+	if err := a.db.checkBackpressure(); err != nil {
+		return 0, err
+	}
+	if series := a.db.series.getByHash(l.Hash(), l); series != nil {
+		return series.ref, nil
+	}
+
+	// Mirrors the validation in appender.Add.
+	l = l.WithoutEmpty()
+	if len(l) == 0 {
+		return 0, errors.Wrap(tsdb.ErrInvalidSample, "empty labelset")
+	}
+	if lbl, dup := l.HasDuplicateLabelNames(); dup {
+		return 0, errors.Wrap(tsdb.ErrInvalidSample, fmt.Sprintf(`label name "%s" is not unique`, lbl))
+	}
+
+	a.ref++
+	a.refs[a.ref] = struct{}{}
+	return a.ref, nil
+}
+
+// AddFast validates the reference like appender.AddFast but records nothing.
+func (a *dryRunAppender) AddFast(ref uint64, t int64, v float64) error {
+	if err := a.db.checkBackpressure(); err != nil {
+		return err
+	}
+	if _, ok := a.refs[ref]; ok {
+		return nil
+	}
+	if a.db.series.getByID(ref) == nil {
+		return storage.ErrNotFound
+	}
+	return nil
+}
+
+// Commit discards the batch.
+func (a *dryRunAppender) Commit() error { return a.Rollback() }
+
+// Rollback discards the batch.
+func (a *dryRunAppender) Rollback() error {
+	a.refs = map[uint64]struct{}{}
+	return nil
+}
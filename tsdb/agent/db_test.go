@@ -0,0 +1,717 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	client_testutil "github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/atomic"
+
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/pkg/timestamp"
+	"github.com/prometheus/prometheus/tsdb/wal"
+)
+
+func seriesCount(t *testing.T, s *Storage) int {
+	t.Helper()
+	count := 0
+	require.NoError(t, s.series.forEach(func(*memSeries) error {
+		count++
+		return nil
+	}))
+	return count
+}
+
+func TestCommit(t *testing.T) {
+	const (
+		numDatapoints = 1000
+		numSeries     = 8
+	)
+
+	dir, err := ioutil.TempDir("", "agent_commit")
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, os.RemoveAll(dir))
+	}()
+
+	s, err := Open(log.NewNopLogger(), nil, nil, dir, DefaultOptions())
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, s.Close())
+	}()
+
+	app := s.Appender(context.TODO())
+	for i := 0; i < numSeries; i++ {
+		lset := labels.FromStrings("__name__", fmt.Sprintf("metric_%d", i))
+		for j := 0; j < numDatapoints; j++ {
+			_, err := app.Add(lset, int64(j), float64(j))
+			require.NoError(t, err)
+		}
+	}
+	require.NoError(t, app.Commit())
+	require.Equal(t, numSeries, seriesCount(t, s))
+}
+
+func TestSnapshot(t *testing.T) {
+	const (
+		numDatapoints = 100
+		numSeries     = 8
+	)
+
+	dir, err := ioutil.TempDir("", "agent_snapshot")
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, os.RemoveAll(dir))
+	}()
+
+	s, err := Open(log.NewNopLogger(), nil, nil, dir, DefaultOptions())
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, s.Close())
+	}()
+
+	now := timestamp.FromTime(time.Now())
+	app := s.Appender(context.TODO())
+	for i := 0; i < numSeries; i++ {
+		lset := labels.FromStrings("__name__", fmt.Sprintf("metric_%d", i))
+		for j := 0; j < numDatapoints; j++ {
+			_, err := app.Add(lset, now+int64(j), float64(j))
+			require.NoError(t, err)
+		}
+	}
+	require.NoError(t, app.Commit())
+
+	snapDir := filepath.Join(dir, "snapshot")
+	require.NoError(t, s.Snapshot(snapDir))
+
+	// The snapshot metadata should exist alongside the snapshot WAL.
+	_, err = os.Stat(filepath.Join(snapDir, snapshotMetaFilename))
+	require.NoError(t, err)
+
+	// A storage opened at the snapshot directory replays only the flushed
+	// series records and ends up with the same set of active series.
+	s2, err := Open(log.NewNopLogger(), nil, nil, snapDir, DefaultOptions())
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, s2.Close())
+	}()
+
+	require.Equal(t, seriesCount(t, s), seriesCount(t, s2))
+}
+
+func TestWALReplay(t *testing.T) {
+	const (
+		numDatapoints = 100
+		numSeries     = 8
+	)
+
+	dir, err := ioutil.TempDir("", "agent_replay")
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, os.RemoveAll(dir))
+	}()
+
+	s, err := Open(log.NewNopLogger(), nil, nil, dir, DefaultOptions())
+	require.NoError(t, err)
+
+	app := s.Appender(context.TODO())
+	for i := 0; i < numSeries; i++ {
+		lset := labels.FromStrings("__name__", fmt.Sprintf("metric_%d", i))
+		for j := 0; j < numDatapoints; j++ {
+			_, err := app.Add(lset, int64(j), float64(j))
+			require.NoError(t, err)
+		}
+	}
+	require.NoError(t, app.Commit())
+	require.NoError(t, s.Close())
+
+	// Corrupt the tail of the last segment so its checksum no longer
+	// matches. The series records were logged before the samples, so they
+	// all precede the corruption.
+	walDir := SubDirectory(dir)
+	_, last, err := wal.Segments(walDir)
+	require.NoError(t, err)
+	segFile := wal.SegmentName(walDir, last)
+	fi, err := os.Stat(segFile)
+	require.NoError(t, err)
+	f, err := os.OpenFile(segFile, os.O_WRONLY, 0666)
+	require.NoError(t, err)
+	_, err = f.WriteAt(bytes.Repeat([]byte{42}, 10), fi.Size()-100)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	// Startup must complete despite the corrupt tail and report the
+	// corruption through the metric.
+	s2, err := Open(log.NewNopLogger(), prometheus.NewRegistry(), nil, dir, DefaultOptions())
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, s2.Close())
+	}()
+
+	require.Equal(t, numSeries, seriesCount(t, s2))
+	require.Equal(t, 1.0, client_testutil.ToFloat64(s2.metrics.walCorruptionsTotal))
+}
+
+func TestBackpressure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "agent_backpressure")
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, os.RemoveAll(dir))
+	}()
+
+	opts := DefaultOptions()
+	opts.MaxWALBytes = 1024
+
+	s, err := Open(log.NewNopLogger(), nil, nil, dir, opts)
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, s.Close())
+	}()
+
+	// Fill the WAL past the cap.
+	app := s.Appender(context.TODO())
+	lset := labels.FromStrings("__name__", "metric_a")
+	ref, err := app.Add(lset, 0, 0)
+	require.NoError(t, err)
+	for j := 1; j < 1000; j++ {
+		require.NoError(t, app.AddFast(ref, int64(j), float64(j)))
+	}
+	require.NoError(t, app.Commit())
+	require.True(t, s.walBytes.Load() >= opts.MaxWALBytes)
+
+	app = s.Appender(context.TODO())
+	_, err = app.Add(lset, 1000, 1)
+	require.Equal(t, ErrBackpressure, err)
+	require.Equal(t, ErrBackpressure, app.(*appender).AddFast(ref, 1000, 1))
+	require.NoError(t, app.Rollback())
+
+	// Once truncation has drained the backlog, appends succeed again.
+	s.walBytes.Store(0)
+	app = s.Appender(context.TODO())
+	_, err = app.Add(lset, 1000, 1)
+	require.NoError(t, err)
+	require.NoError(t, app.Commit())
+}
+
+func TestPerEndpointSampleCounters(t *testing.T) {
+	dir, err := ioutil.TempDir("", "agent_endpoint_counters")
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, os.RemoveAll(dir))
+	}()
+
+	s, err := Open(log.NewNopLogger(), prometheus.NewRegistry(), nil, dir, DefaultOptions())
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, s.Close())
+	}()
+
+	// Two fake endpoints: "ok" accepts everything, "broken" rejects
+	// everything. A remote-write manager would report per send attempt.
+	endpoints := map[string]func(n int) error{
+		"ok":     func(int) error { return nil },
+		"broken": func(int) error { return fmt.Errorf("remote request failed") },
+	}
+	for name, send := range endpoints {
+		for i := 0; i < 5; i++ {
+			if err := send(10); err != nil {
+				s.SamplesFailed(name, 10)
+				continue
+			}
+			s.SamplesSent(name, 10)
+		}
+	}
+
+	require.Equal(t, 50.0, client_testutil.ToFloat64(s.metrics.samplesSentTotal.WithLabelValues("ok")))
+	require.Equal(t, 0.0, client_testutil.ToFloat64(s.metrics.samplesFailedTotal.WithLabelValues("ok")))
+	require.Equal(t, 0.0, client_testutil.ToFloat64(s.metrics.samplesSentTotal.WithLabelValues("broken")))
+	require.Equal(t, 50.0, client_testutil.ToFloat64(s.metrics.samplesFailedTotal.WithLabelValues("broken")))
+}
+
+func TestRemoteWriteRetryHook(t *testing.T) {
+	dir, err := ioutil.TempDir("", "agent_retry_hook")
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, os.RemoveAll(dir))
+	}()
+
+	type retry struct {
+		remoteName string
+		attempt    int
+		err        error
+	}
+	var retries []retry
+	opts := DefaultOptions()
+	opts.RemoteWriteRetryCallback = func(remoteName string, attempt int, err error) {
+		retries = append(retries, retry{remoteName, attempt, err})
+	}
+
+	s, err := Open(log.NewNopLogger(), prometheus.NewRegistry(), nil, dir, opts)
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, s.Close())
+	}()
+
+	// A flaky endpoint that fails the first two attempts. The remote-write
+	// manager reports each retry before re-sending.
+	sendErr := fmt.Errorf("connection reset")
+	flaky := func(attempt int) error {
+		if attempt <= 2 {
+			return sendErr
+		}
+		return nil
+	}
+	for attempt := 1; ; attempt++ {
+		if err := flaky(attempt); err != nil {
+			s.RemoteWriteRetry("flaky", attempt, err)
+			continue
+		}
+		s.SamplesSent("flaky", 10)
+		break
+	}
+
+	require.Equal(t, []retry{{"flaky", 1, sendErr}, {"flaky", 2, sendErr}}, retries)
+	require.Equal(t, 2.0, client_testutil.ToFloat64(s.metrics.remoteWriteRetriesTotal.WithLabelValues("flaky")))
+}
+
+func TestTruncateOnDemand(t *testing.T) {
+	const numSeries = 8
+
+	dir, err := ioutil.TempDir("", "agent_truncate_on_demand")
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, os.RemoveAll(dir))
+	}()
+
+	type truncation struct {
+		deletedSeries       int
+		checkpointedSegment int
+	}
+	truncated := make(chan truncation, 1)
+	opts := DefaultOptions()
+	opts.OnTruncate = func(deletedSeries, checkpointedSegment int) {
+		truncated <- truncation{deletedSeries, checkpointedSegment}
+	}
+
+	s, err := Open(log.NewNopLogger(), nil, nil, dir, opts)
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, s.Close())
+	}()
+
+	app := s.Appender(context.TODO())
+	for i := 0; i < numSeries; i++ {
+		lset := labels.FromStrings("__name__", fmt.Sprintf("metric_%d", i))
+		_, err := app.Add(lset, int64(i), float64(i))
+		require.NoError(t, err)
+	}
+	require.NoError(t, app.Commit())
+
+	for i := 0; i < 3; i++ {
+		require.NoError(t, s.wal.NextSegment())
+	}
+
+	// All samples are older than the cutoff, so the on-demand truncation
+	// deletes every series without any timer involved.
+	require.NoError(t, s.Truncate())
+	select {
+	case tr := <-truncated:
+		require.Equal(t, numSeries, tr.deletedSeries)
+	default:
+		t.Fatal("truncation did not run")
+	}
+	require.Equal(t, 0, seriesCount(t, s))
+}
+
+func TestSeriesGCInterval(t *testing.T) {
+	const numSeries = 8
+
+	dir, err := ioutil.TempDir("", "agent_series_gc")
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, os.RemoveAll(dir))
+	}()
+
+	opts := DefaultOptions()
+	opts.SeriesGCInterval = 25 * time.Millisecond
+
+	s, err := Open(log.NewNopLogger(), nil, nil, dir, opts)
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, s.Close())
+	}()
+
+	// All samples are far older than the GC cutoff, so every series is
+	// inactive from the start.
+	app := s.Appender(context.TODO())
+	for i := 0; i < numSeries; i++ {
+		lset := labels.FromStrings("__name__", fmt.Sprintf("metric_%d", i))
+		_, err := app.Add(lset, int64(i), float64(i))
+		require.NoError(t, err)
+	}
+	require.NoError(t, app.Commit())
+	require.Equal(t, numSeries, seriesCount(t, s))
+
+	// The GC loop drops them without any WAL truncation having run.
+	require.Eventually(t, func() bool {
+		return seriesCount(t, s) == 0
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Equal(t, 0.0, client_testutil.ToFloat64(s.metrics.numActiveSeries))
+}
+
+func TestWALOldestTimestampMetric(t *testing.T) {
+	dir, err := ioutil.TempDir("", "agent_oldest_ts")
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, os.RemoveAll(dir))
+	}()
+
+	s, err := Open(log.NewNopLogger(), nil, nil, dir, DefaultOptions())
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, s.Close())
+	}()
+
+	// Nothing truncated yet, so the low watermark is unset.
+	require.Equal(t, 0.0, client_testutil.ToFloat64(s.metrics.walOldestTimestamp))
+
+	app := s.Appender(context.TODO())
+	for i := 0; i < 4; i++ {
+		lset := labels.FromStrings("__name__", fmt.Sprintf("metric_%d", i))
+		_, err := app.Add(lset, int64(i), float64(i))
+		require.NoError(t, err)
+	}
+	require.NoError(t, app.Commit())
+
+	// Roll enough segments that truncate considers checkpointing.
+	for i := 0; i < 3; i++ {
+		require.NoError(t, s.wal.NextSegment())
+	}
+
+	mint := timestamp.FromTime(time.Now())
+	require.NoError(t, s.truncate(mint))
+	require.Equal(t, float64(mint)/1000, client_testutil.ToFloat64(s.metrics.walOldestTimestamp))
+
+	// A later truncation advances the watermark.
+	for i := 0; i < 3; i++ {
+		require.NoError(t, s.wal.NextSegment())
+	}
+	mint2 := timestamp.FromTime(time.Now().Add(time.Minute))
+	require.NoError(t, s.truncate(mint2))
+	require.Greater(t, client_testutil.ToFloat64(s.metrics.walOldestTimestamp), float64(mint)/1000)
+}
+
+func TestDryRunAppender(t *testing.T) {
+	dir, err := ioutil.TempDir("", "agent_dryrun")
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, os.RemoveAll(dir))
+	}()
+
+	s, err := Open(log.NewNopLogger(), nil, nil, dir, DefaultOptions())
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, s.Close())
+	}()
+
+	invalid := labels.Labels{
+		{Name: "a", Value: "1"},
+		{Name: "a", Value: "2"},
+	}
+
+	// The dry run returns the same error the real appender would.
+	realApp := s.Appender(context.TODO())
+	_, realErr := realApp.Add(invalid, 0, 1)
+	require.Error(t, realErr)
+	require.NoError(t, realApp.Rollback())
+
+	dry := s.DryRunAppender()
+	_, dryErr := dry.Add(invalid, 0, 1)
+	require.Error(t, dryErr)
+	require.Equal(t, realErr.Error(), dryErr.Error())
+
+	// Valid samples pass validation but persist nothing.
+	ref, err := dry.Add(labels.FromStrings("__name__", "metric_a"), 0, 1)
+	require.NoError(t, err)
+	require.NoError(t, dry.AddFast(ref, 1, 2))
+	require.Error(t, dry.AddFast(ref+1, 1, 2))
+	require.NoError(t, dry.Commit())
+
+	require.Equal(t, 0, seriesCount(t, s))
+	sz, err := s.wal.Size()
+	require.NoError(t, err)
+	require.Equal(t, int64(0), sz)
+}
+
+func TestListSeries(t *testing.T) {
+	dir, err := ioutil.TempDir("", "agent_list_series")
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, os.RemoveAll(dir))
+	}()
+
+	s, err := Open(log.NewNopLogger(), nil, nil, dir, DefaultOptions())
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, s.Close())
+	}()
+
+	app := s.Appender(context.TODO())
+	for i := 0; i < 4; i++ {
+		job := "a"
+		if i%2 == 1 {
+			job = "b"
+		}
+		_, err := app.Add(labels.FromStrings("__name__", fmt.Sprintf("metric_%d", i), "job", job), 0, 1)
+		require.NoError(t, err)
+	}
+	require.NoError(t, app.Commit())
+
+	m, err := labels.NewMatcher(labels.MatchEqual, "job", "a")
+	require.NoError(t, err)
+	series, err := s.ListSeries(m)
+	require.NoError(t, err)
+	require.Equal(t, []labels.Labels{
+		labels.FromStrings("__name__", "metric_0", "job", "a"),
+		labels.FromStrings("__name__", "metric_2", "job", "a"),
+	}, series)
+
+	// No matchers returns everything.
+	series, err = s.ListSeries()
+	require.NoError(t, err)
+	require.Len(t, series, 4)
+}
+
+func TestOnTruncateCallback(t *testing.T) {
+	const numSeries = 8
+
+	dir, err := ioutil.TempDir("", "agent_on_truncate")
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, os.RemoveAll(dir))
+	}()
+
+	type truncation struct {
+		deletedSeries       int
+		checkpointedSegment int
+	}
+	truncated := make(chan truncation, 1)
+	opts := DefaultOptions()
+	opts.OnTruncate = func(deletedSeries, checkpointedSegment int) {
+		truncated <- truncation{deletedSeries, checkpointedSegment}
+	}
+
+	s, err := Open(log.NewNopLogger(), nil, nil, dir, opts)
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, s.Close())
+	}()
+
+	app := s.Appender(context.TODO())
+	for i := 0; i < numSeries; i++ {
+		lset := labels.FromStrings("__name__", fmt.Sprintf("metric_%d", i))
+		_, err := app.Add(lset, int64(i), float64(i))
+		require.NoError(t, err)
+	}
+	require.NoError(t, app.Commit())
+
+	// Roll enough segments that truncate considers checkpointing.
+	for i := 0; i < 3; i++ {
+		require.NoError(t, s.wal.NextSegment())
+	}
+
+	// All appended samples are older than the cutoff, so every series is
+	// inactive and gets deleted; the callback reports that synchronously.
+	require.NoError(t, s.truncate(timestamp.FromTime(time.Now())))
+	select {
+	case tr := <-truncated:
+		require.Equal(t, numSeries, tr.deletedSeries)
+		require.GreaterOrEqual(t, tr.checkpointedSegment, 0)
+	default:
+		t.Fatal("OnTruncate was not invoked")
+	}
+}
+
+func TestWALCompressionRoundTrip(t *testing.T) {
+	for _, codec := range []WALCompressionType{WALCompressionNone, WALCompressionSnappy} {
+		t.Run(string(codec), func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "agent_wal_compression")
+			require.NoError(t, err)
+			defer func() {
+				require.NoError(t, os.RemoveAll(dir))
+			}()
+
+			opts := DefaultOptions()
+			opts.WALCompression = codec
+
+			s, err := Open(log.NewNopLogger(), nil, nil, dir, opts)
+			require.NoError(t, err)
+
+			app := s.Appender(context.TODO())
+			for i := 0; i < 8; i++ {
+				lset := labels.FromStrings("__name__", fmt.Sprintf("metric_%d", i))
+				for j := 0; j < 50; j++ {
+					_, err := app.Add(lset, int64(j), float64(j))
+					require.NoError(t, err)
+				}
+			}
+			require.NoError(t, app.Commit())
+			require.NoError(t, s.Close())
+
+			// Reopening replays the WAL; all series must survive the
+			// round trip through the codec.
+			s2, err := Open(log.NewNopLogger(), nil, nil, dir, opts)
+			require.NoError(t, err)
+			defer func() {
+				require.NoError(t, s2.Close())
+			}()
+			require.Equal(t, 8, seriesCount(t, s2))
+		})
+	}
+}
+
+func TestWALCompressionValidation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "agent_wal_compression_invalid")
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, os.RemoveAll(dir))
+	}()
+
+	for _, codec := range []WALCompressionType{WALCompressionZstd, "gzip"} {
+		opts := DefaultOptions()
+		opts.WALCompression = codec
+		_, err = Open(log.NewNopLogger(), nil, nil, dir, opts)
+		require.Error(t, err)
+	}
+}
+
+func TestWALReplayKeepsRefWatermark(t *testing.T) {
+	dir, err := ioutil.TempDir("", "agent_ref_watermark")
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, os.RemoveAll(dir))
+	}()
+
+	s, err := Open(log.NewNopLogger(), nil, nil, dir, DefaultOptions())
+	require.NoError(t, err)
+
+	app := s.Appender(context.TODO())
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	refA, err := app.Add(labels.FromStrings("__name__", "metric_a"), now, 1)
+	require.NoError(t, err)
+	require.NoError(t, app.Commit())
+
+	// Truncate repeatedly so the series record moves into the checkpoint
+	// and the tail segments replayed on reopen hold no series records.
+	for i := 0; i < 4; i++ {
+		require.NoError(t, s.wal.NextSegment())
+		require.NoError(t, s.Truncate())
+	}
+	require.NoError(t, s.Close())
+
+	s2, err := Open(log.NewNopLogger(), nil, nil, dir, DefaultOptions())
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, s2.Close())
+	}()
+
+	// A series appended after the reopen must not reuse metric_a's ref.
+	app = s2.Appender(context.TODO())
+	refB, err := app.Add(labels.FromStrings("__name__", "metric_b"), now, 1)
+	require.NoError(t, err)
+	require.NoError(t, app.Commit())
+	require.NotEqual(t, refA, refB)
+
+	series, err := s2.ListSeries()
+	require.NoError(t, err)
+	require.Len(t, series, 2)
+}
+
+func TestTruncateConcurrent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "agent_truncate_concurrent")
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, os.RemoveAll(dir))
+	}()
+
+	opts := DefaultOptions()
+	opts.SeriesGCInterval = time.Millisecond
+
+	s, err := Open(log.NewNopLogger(), nil, nil, dir, opts)
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, s.Close())
+	}()
+
+	app := s.Appender(context.TODO())
+	for i := 0; i < 8; i++ {
+		_, err := app.Add(labels.FromStrings("__name__", fmt.Sprintf("metric_%d", i)), 0, 1)
+		require.NoError(t, err)
+	}
+	require.NoError(t, app.Commit())
+
+	// Concurrent on-demand truncations race against the periodic GC ticks;
+	// under -race this catches unsynchronized access to db.deleted.
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				require.NoError(t, s.Truncate())
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestTruncationRunsAlongsideSeriesGC(t *testing.T) {
+	dir, err := ioutil.TempDir("", "agent_truncate_with_gc")
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, os.RemoveAll(dir))
+	}()
+
+	// The GC ticker fires far more often than the truncation timer; the
+	// frequent wake-ups must not keep resetting the truncation schedule.
+	var truncations atomic.Int64
+	opts := DefaultOptions()
+	opts.SeriesGCInterval = 5 * time.Millisecond
+	opts.TruncateFrequency = 100 * time.Millisecond
+	opts.OnTruncate = func(deletedSeries, checkpointedSegment int) {
+		truncations.Inc()
+	}
+
+	s, err := Open(log.NewNopLogger(), nil, nil, dir, opts)
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, s.Close())
+	}()
+
+	require.Eventually(t, func() bool {
+		return truncations.Load() > 0
+	}, 5*time.Second, 10*time.Millisecond)
+}
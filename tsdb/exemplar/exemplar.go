@@ -0,0 +1,805 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package exemplar
+
+import (
+	"context"
+	"sort"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/atomic"
+
+	"github.com/prometheus/prometheus/pkg/exemplar"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/pkg/relabel"
+	"github.com/prometheus/prometheus/storage"
+	tsdb_errors "github.com/prometheus/prometheus/tsdb/errors"
+	"github.com/prometheus/prometheus/tsdb/record"
+	"github.com/prometheus/prometheus/tsdb/wal"
+)
+
+// ErrOutOfOrderExemplar is returned for exemplars older than what the series'
+// newest exemplar and the configured out-of-order window allow.
+var ErrOutOfOrderExemplar = storage.ErrOutOfOrderExemplar
+
+// ErrExemplarLabelLength is returned for exemplars whose combined label name
+// and value bytes exceed the configured maximum.
+var ErrExemplarLabelLength = storage.ErrExemplarLabelLength
+
+// defaultMaxExemplarLabelLength is the limit the OpenMetrics specification
+// puts on the combined length of an exemplar's label names and values.
+const defaultMaxExemplarLabelLength = 128
+
+// checkContextEvery determines how many series are scanned between checks
+// of the context during Select. It trades cancellation latency against the
+// cost of the checks themselves.
+const checkContextEvery = 128
+
+// QueryResult holds the exemplars retained for a single series.
+type QueryResult struct {
+	SeriesLabels labels.Labels
+	Exemplars    []exemplar.Exemplar
+}
+
+type indexEntry struct {
+	oldest int
+	newest int
+	// newestTs is the highest timestamp ever stored for the series. With an
+	// out-of-order window the newest appended exemplar can be older than it.
+	newestTs int64
+}
+
+type circularBufferEntry struct {
+	exemplar     exemplar.Exemplar
+	seriesLabels labels.Labels
+	// next is the index of the next exemplar in the circular buffer that
+	// belongs to the same series, or noExemplar if this is the newest one.
+	next int
+}
+
+const noExemplar = -1
+
+// CircularExemplarStorage keeps the most recently appended exemplars in a
+// fixed size circular buffer, indexed by series labels. Appending a new
+// exemplar once the buffer is full evicts the oldest one, regardless of
+// which series it belongs to.
+type CircularExemplarStorage struct {
+	lock      sync.RWMutex
+	exemplars []*circularBufferEntry
+	nextIndex int
+
+	// Map of series labels (as produced by labels.Labels.String) to index
+	// entry, which points to the first and last exemplar for the series in
+	// the exemplars circular buffer. Keying by the full label string rather
+	// than a 64-bit hash rules out collisions attaching one series'
+	// exemplars to another.
+	index map[string]*indexEntry
+
+	// wal is optional. If set, appended exemplars are logged to it so they
+	// can be replayed on startup.
+	wal     *wal.WAL
+	enc     record.Encoder
+	walBuf  []byte
+	walRecs []record.SeriesExemplar
+
+	// relabelConfigs holds the current []*relabel.Config. It is swapped
+	// wholesale by ApplyRelabelConfigs, so appenders always read a
+	// consistent snapshot without taking a lock; a reload concurrent with
+	// an append can never expose a half-updated slice.
+	relabelConfigs atomic.Value
+
+	// oooTimeWindow is the grace window in milliseconds within which an
+	// exemplar older than the series' newest one is still accepted.
+	// Guarded by lock.
+	oooTimeWindow int64
+
+	// maxLabelLength bounds the combined byte length of an exemplar's label
+	// names and values; values <= 0 disable the check. Guarded by lock.
+	maxLabelLength int
+
+	metrics *exemplarMetrics
+}
+
+type exemplarMetrics struct {
+	relabelDroppedTotal  prometheus.Counter
+	outOfOrderTotal      prometheus.Counter
+	selectTruncatedTotal prometheus.Counter
+}
+
+func newExemplarMetrics(r prometheus.Registerer) *exemplarMetrics {
+	m := &exemplarMetrics{
+		relabelDroppedTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "prometheus_tsdb_exemplar_exemplars_relabel_dropped_total",
+			Help: "Total number of exemplars dropped by relabel configuration.",
+		}),
+		outOfOrderTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "prometheus_tsdb_exemplar_out_of_order_exemplars_total",
+			Help: "Total number of out of order exemplar ingestion failed attempts.",
+		}),
+		selectTruncatedTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "prometheus_tsdb_exemplar_select_truncated_total",
+			Help: "Total number of reads that stopped walking a series' exemplar chain early because its links did not terminate, returning truncated results.",
+		}),
+	}
+	if r != nil {
+		r.MustRegister(m.relabelDroppedTotal, m.outOfOrderTotal, m.selectTruncatedTotal)
+	}
+	return m
+}
+
+// NewCircularExemplarStorage creates a circular in-memory exemplar storage
+// that retains the last len exemplars appended to it. len must be positive;
+// reg may be nil.
+func NewCircularExemplarStorage(len int64, reg prometheus.Registerer) (*CircularExemplarStorage, error) {
+	if len <= 0 {
+		return nil, errors.Errorf("exemplar storage length must be positive, got %d", len)
+	}
+	c := &CircularExemplarStorage{
+		exemplars:      make([]*circularBufferEntry, len),
+		index:          make(map[string]*indexEntry),
+		maxLabelLength: defaultMaxExemplarLabelLength,
+		metrics:        newExemplarMetrics(reg),
+	}
+	if reg != nil {
+		reg.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "prometheus_tsdb_exemplar_exemplars_bytes",
+			Help: "Estimated memory in bytes used by stored exemplars, including their labels.",
+		}, func() float64 { return float64(c.EstimatedBytes()) }))
+	}
+	return c, nil
+}
+
+// bytesPerExemplarSlot is the estimated fixed overhead of one occupied buffer
+// slot: the exemplar and entry structs, the pointers to them and the index
+// bookkeeping, excluding the variable-size labels.
+const bytesPerExemplarSlot = 95
+
+// EstimatedBytes returns an estimate of the memory used by the stored
+// exemplars, summing the label sizes of the occupied slots plus a fixed
+// per-slot overhead. It lets operators calibrate the buffer length against a
+// memory budget instead of guessing a per-exemplar size.
+func (ce *CircularExemplarStorage) EstimatedBytes() int {
+	ce.lock.RLock()
+	defer ce.lock.RUnlock()
+
+	n := 0
+	for _, e := range ce.exemplars {
+		if e == nil {
+			continue
+		}
+		n += bytesPerExemplarSlot
+		for _, l := range e.exemplar.Labels {
+			n += len(l.Name) + len(l.Value)
+		}
+		for _, l := range e.seriesLabels {
+			n += len(l.Name) + len(l.Value)
+		}
+	}
+	return n
+}
+
+// SetOutOfOrderTimeWindow sets the grace window in milliseconds within which
+// exemplars older than the series' newest one are still accepted. An exemplar
+// older than the newest timestamp minus the window is rejected with
+// ErrOutOfOrderExemplar. A window of 0, the default, keeps strict ordering.
+func (ce *CircularExemplarStorage) SetOutOfOrderTimeWindow(window int64) {
+	ce.lock.Lock()
+	defer ce.lock.Unlock()
+	ce.oooTimeWindow = window
+}
+
+// SetMaxLabelLength sets the maximum combined byte length of an exemplar's
+// label names and values. Exemplars over the limit are rejected with
+// ErrExemplarLabelLength. The default is 128 bytes, the limit the
+// OpenMetrics specification imposes; a value <= 0 disables the check.
+func (ce *CircularExemplarStorage) SetMaxLabelLength(n int) {
+	ce.lock.Lock()
+	defer ce.lock.Unlock()
+	ce.maxLabelLength = n
+}
+
+// ApplyRelabelConfigs sets the relabel rules applied to the series labels of
+// appended exemplars. Exemplars whose series labels are dropped entirely by
+// the rules are discarded.
+func (ce *CircularExemplarStorage) ApplyRelabelConfigs(configs []*relabel.Config) {
+	ce.relabelConfigs.Store(configs)
+}
+
+// OpenCircularExemplarStorage returns a circular exemplar storage backed by
+// the given WAL. Exemplar records already present in the WAL directory are
+// replayed into the buffer, so only the newest len exemplars survive a
+// restart. Further appended exemplars are logged to w.
+func OpenCircularExemplarStorage(len int64, reg prometheus.Registerer, w *wal.WAL) (*CircularExemplarStorage, error) {
+	c, err := NewCircularExemplarStorage(len, reg)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.replayWAL(w.Dir()); err != nil {
+		return nil, err
+	}
+	c.wal = w
+	return c, nil
+}
+
+func (ce *CircularExemplarStorage) replayWAL(dir string) error {
+	sr, err := wal.NewSegmentsReader(dir)
+	if err != nil {
+		return errors.Wrap(err, "open WAL segments")
+	}
+	defer sr.Close()
+
+	var (
+		dec       record.Decoder
+		r         = wal.NewReader(sr)
+		exemplars []record.SeriesExemplar
+	)
+	for r.Next() {
+		rec := r.Record()
+		if dec.Type(rec) != record.Exemplars {
+			continue
+		}
+		exemplars, err = dec.Exemplars(rec, exemplars[:0])
+		if err != nil {
+			return errors.Wrap(err, "decode exemplars")
+		}
+		for _, e := range exemplars {
+			// Exemplars evicted from the buffer before the last
+			// truncation may resurface out of order. They have been
+			// superseded, so they can be dropped.
+			if err := ce.addExemplar(e.SeriesLabels, e.E); err != nil && err != ErrOutOfOrderExemplar {
+				return errors.Wrap(err, "replay exemplar")
+			}
+		}
+	}
+	return errors.Wrap(r.Err(), "read WAL")
+}
+
+// AddExemplar appends e as the newest exemplar for the series identified by l.
+// Exemplars for a single series must be appended in timestamp order; an
+// exemplar equal to the newest one stored for the series is a no-op.
+// If the storage was opened with a WAL, the exemplar is also logged to it.
+func (ce *CircularExemplarStorage) AddExemplar(l labels.Labels, e exemplar.Exemplar) error {
+	configs, _ := ce.relabelConfigs.Load().([]*relabel.Config)
+	if len(configs) > 0 {
+		if l = relabel.Process(l, configs...); l == nil {
+			ce.metrics.relabelDroppedTotal.Inc()
+			return nil
+		}
+	}
+
+	ce.lock.Lock()
+	defer ce.lock.Unlock()
+
+	if err := ce.addExemplar(l, e); err != nil {
+		if err == ErrOutOfOrderExemplar {
+			ce.metrics.outOfOrderTotal.Inc()
+		}
+		return err
+	}
+	if ce.wal == nil {
+		return nil
+	}
+	ce.walRecs = append(ce.walRecs[:0], record.SeriesExemplar{SeriesLabels: l, E: e})
+	ce.walBuf = ce.enc.Exemplars(ce.walRecs, ce.walBuf[:0])
+	return ce.wal.Log(ce.walBuf)
+}
+
+// AddExemplars appends all entries while taking the write lock only once,
+// amortizing the locking cost of batch operations such as scrape commits.
+// Entries failing the out-of-order check are skipped and reported in the
+// returned combined error; the remaining ones are still appended. If the
+// storage was opened with a WAL, all appended exemplars are logged in a
+// single record.
+func (ce *CircularExemplarStorage) AddExemplars(entries []record.SeriesExemplar) error {
+	configs, _ := ce.relabelConfigs.Load().([]*relabel.Config)
+
+	ce.lock.Lock()
+	defer ce.lock.Unlock()
+
+	errs := tsdb_errors.NewMulti()
+	ce.walRecs = ce.walRecs[:0]
+	for _, entry := range entries {
+		l := entry.SeriesLabels
+		if len(configs) > 0 {
+			if l = relabel.Process(l, configs...); l == nil {
+				ce.metrics.relabelDroppedTotal.Inc()
+				continue
+			}
+		}
+		if err := ce.addExemplar(l, entry.E); err != nil {
+			if err == ErrOutOfOrderExemplar {
+				ce.metrics.outOfOrderTotal.Inc()
+			}
+			errs.Add(err)
+			continue
+		}
+		if ce.wal != nil {
+			ce.walRecs = append(ce.walRecs, record.SeriesExemplar{SeriesLabels: l, E: entry.E})
+		}
+	}
+	if ce.wal != nil && len(ce.walRecs) > 0 {
+		ce.walBuf = ce.enc.Exemplars(ce.walRecs, ce.walBuf[:0])
+		if err := ce.wal.Log(ce.walBuf); err != nil {
+			errs.Add(err)
+		}
+	}
+	return errs.Err()
+}
+
+// addExemplar adds e to the circular buffer. The lock must be held.
+func (ce *CircularExemplarStorage) addExemplar(l labels.Labels, e exemplar.Exemplar) error {
+	if len(ce.exemplars) == 0 {
+		return nil
+	}
+	if ce.maxLabelLength > 0 {
+		labelLength := 0
+		for _, lbl := range e.Labels {
+			labelLength += len(lbl.Name) + len(lbl.Value)
+		}
+		if labelLength > ce.maxLabelLength {
+			return ErrExemplarLabelLength
+		}
+	}
+	seriesKey := l.String()
+
+	idx, ok := ce.index[seriesKey]
+	if ok {
+		newest := ce.exemplars[idx.newest].exemplar
+		if newest.Equals(e) {
+			return nil
+		}
+		// Exemplars without a timestamp cannot be ordered, so they are
+		// exempt from the out-of-order check.
+		if e.HasTs {
+			if ce.oooTimeWindow > 0 {
+				if e.Ts < idx.newestTs-ce.oooTimeWindow {
+					return ErrOutOfOrderExemplar
+				}
+			} else if newest.HasTs && e.Ts <= newest.Ts {
+				return ErrOutOfOrderExemplar
+			}
+		}
+	}
+
+	// If the buffer entry we are about to overwrite is the oldest exemplar
+	// of some series, update or delete that series' index entry.
+	if prev := ce.exemplars[ce.nextIndex]; prev != nil {
+		prevKey := prev.seriesLabels.String()
+		if prevIdx := ce.index[prevKey]; prevIdx != nil {
+			if prev.next == noExemplar {
+				delete(ce.index, prevKey)
+			} else {
+				prevIdx.oldest = prev.next
+			}
+		}
+	}
+
+	// The eviction may have deleted this series' own index entry if the
+	// overwritten slot held its only exemplar; re-read it so the append
+	// below starts a fresh chain instead of linking the new slot to itself.
+	idx, ok = ce.index[seriesKey]
+
+	ce.exemplars[ce.nextIndex] = &circularBufferEntry{
+		exemplar:     e,
+		seriesLabels: l,
+		next:         noExemplar,
+	}
+
+	if ok {
+		ce.exemplars[idx.newest].next = ce.nextIndex
+		idx.newest = ce.nextIndex
+		if e.HasTs && e.Ts > idx.newestTs {
+			idx.newestTs = e.Ts
+		}
+	} else {
+		idx = &indexEntry{oldest: ce.nextIndex, newest: ce.nextIndex}
+		if e.HasTs {
+			idx.newestTs = e.Ts
+		}
+		ce.index[seriesKey] = idx
+	}
+
+	ce.nextIndex = (ce.nextIndex + 1) % len(ce.exemplars)
+	return nil
+}
+
+// ClearSeries removes all exemplars of the series identified by l and its
+// index mapping, leaving every other series untouched. The freed slots are
+// reused once the write position reaches them, exactly as if the series had
+// been evicted. Clearing a series the storage does not hold is a no-op.
+func (ce *CircularExemplarStorage) ClearSeries(l labels.Labels) {
+	ce.lock.Lock()
+	defer ce.lock.Unlock()
+
+	key := l.String()
+	idx, ok := ce.index[key]
+	if !ok {
+		return
+	}
+	// Free the chain's slots so occupancy stats stay accurate and a later
+	// re-add of the series cannot alias the stale chain links.
+	for i := idx.oldest; ; {
+		next := ce.exemplars[i].next
+		ce.exemplars[i] = nil
+		if i == idx.newest || next == noExemplar {
+			break
+		}
+		i = next
+	}
+	delete(ce.index, key)
+}
+
+// Grow enlarges the circular buffer to newLen slots without dropping any
+// stored exemplar: existing entries keep their indices, so the index and the
+// per-series chains stay valid, and the new tail stays empty until the write
+// position wraps around to it. Shrinking is not supported; newLen smaller
+// than the current length is rejected.
+func (ce *CircularExemplarStorage) Grow(newLen int) error {
+	ce.lock.Lock()
+	defer ce.lock.Unlock()
+
+	if newLen < len(ce.exemplars) {
+		return errors.Errorf("new length %d smaller than current length %d", newLen, len(ce.exemplars))
+	}
+	if newLen == len(ce.exemplars) {
+		return nil
+	}
+	oldLen := len(ce.exemplars)
+	exemplars := make([]*circularBufferEntry, newLen)
+	copy(exemplars, ce.exemplars)
+	ce.exemplars = exemplars
+	// If the buffer had wrapped, the write position points at an occupied
+	// slot; move it to the start of the empty tail so the next appends fill
+	// the new capacity instead of evicting the oldest exemplars.
+	if ce.exemplars[ce.nextIndex] != nil {
+		ce.nextIndex = oldLen
+	}
+	return nil
+}
+
+// ExemplarStats is a point-in-time summary of the state of a
+// CircularExemplarStorage.
+type ExemplarStats struct {
+	// Capacity is the total number of slots in the circular buffer.
+	Capacity int
+	// Exemplars is the number of occupied slots.
+	Exemplars int
+	// Series is the number of distinct series with at least one exemplar.
+	Series int
+	// OldestTs and NewestTs are the minimum and maximum timestamps of the
+	// stored exemplars that carry one. They are zero if no stored exemplar
+	// has a timestamp.
+	OldestTs int64
+	NewestTs int64
+	// NextIndex is the buffer slot the next exemplar will be written to.
+	NextIndex int
+}
+
+// Stats returns a summary of the storage state for introspection, e.g. on
+// status pages. It takes the read lock and computes the result in a single
+// pass over the buffer.
+func (ce *CircularExemplarStorage) Stats() ExemplarStats {
+	ce.lock.RLock()
+	defer ce.lock.RUnlock()
+
+	st := ExemplarStats{
+		Capacity:  len(ce.exemplars),
+		Series:    len(ce.index),
+		NextIndex: ce.nextIndex,
+	}
+	first := true
+	for _, e := range ce.exemplars {
+		if e == nil {
+			continue
+		}
+		st.Exemplars++
+		if !e.exemplar.HasTs {
+			continue
+		}
+		if first || e.exemplar.Ts < st.OldestTs {
+			st.OldestTs = e.exemplar.Ts
+		}
+		if first || e.exemplar.Ts > st.NewestTs {
+			st.NewestTs = e.exemplar.Ts
+		}
+		first = false
+	}
+	return st
+}
+
+// Delete drops all exemplars of series matching any of the given matcher
+// sets. The buffer cannot be compacted, so the freed slots stay empty until
+// the write position wraps around to them; they are not returned by Select
+// anymore.
+func (ce *CircularExemplarStorage) Delete(matchers ...[]*labels.Matcher) error {
+	ce.lock.Lock()
+	defer ce.lock.Unlock()
+
+	for key, idx := range ce.index {
+		lbls := ce.exemplars[idx.oldest].seriesLabels
+		if !matchesSomeMatcherSet(lbls, matchers) {
+			continue
+		}
+		i := idx.oldest
+		for {
+			e := ce.exemplars[i]
+			ce.exemplars[i] = nil
+			if i == idx.newest {
+				break
+			}
+			i = e.next
+		}
+		delete(ce.index, key)
+	}
+	return nil
+}
+
+// Select returns the exemplars within the time range [start, end] for all
+// series matching any of the given matcher sets. Each series' exemplars are
+// ordered by timestamp; exemplars sharing a timestamp keep their insertion
+// order, so results are reproducible across runs. The scan checks ctx
+// periodically and returns early with ctx.Err() if it is canceled.
+func (ce *CircularExemplarStorage) Select(ctx context.Context, start, end int64, matchers ...[]*labels.Matcher) ([]QueryResult, error) {
+	return ce.selectLocked(ctx, start, end, func(l labels.Labels) bool {
+		return matchesSomeMatcherSet(l, matchers)
+	}, nil)
+}
+
+// SelectWithExemplarFilter is like Select, but additionally drops exemplars
+// whose own labels (e.g. trace IDs) do not satisfy all of the given exemplar
+// matchers. Series whose exemplars are all filtered out are omitted from the
+// result.
+func (ce *CircularExemplarStorage) SelectWithExemplarFilter(ctx context.Context, start, end int64, exemplarMatchers []*labels.Matcher, matchers ...[]*labels.Matcher) ([]QueryResult, error) {
+	return ce.selectLocked(ctx, start, end, func(l labels.Labels) bool {
+		return matchesSomeMatcherSet(l, matchers)
+	}, func(e exemplar.Exemplar) bool {
+		for _, m := range exemplarMatchers {
+			if !m.Matches(e.Labels.Get(m.Name)) {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+// SelectAll returns the exemplars within the time range [start, end] for every
+// series in the storage. Like Select, it returns early with ctx.Err() if the
+// context is canceled during the scan.
+func (ce *CircularExemplarStorage) SelectAll(ctx context.Context, start, end int64) ([]QueryResult, error) {
+	return ce.selectLocked(ctx, start, end, func(labels.Labels) bool { return true }, nil)
+}
+
+// SelectMany returns the exemplars within the time range [start, end] for
+// each of the given series, keyed by series label hash. Unlike calling
+// Select once per series, the read lock is only taken once, so all results
+// come from the same consistent snapshot of the storage. Series without
+// exemplars in range have no entry in the returned map.
+func (ce *CircularExemplarStorage) SelectMany(series []labels.Labels, start, end int64) (map[uint64][]exemplar.Exemplar, error) {
+	ce.lock.RLock()
+	defer ce.lock.RUnlock()
+
+	ret := make(map[uint64][]exemplar.Exemplar, len(series))
+	for _, lbls := range series {
+		idx, ok := ce.index[lbls.String()]
+		if !ok {
+			continue
+		}
+		if exemplars := ce.exemplarsInRange(idx, start, end); len(exemplars) > 0 {
+			ret[lbls.Hash()] = exemplars
+		}
+	}
+	return ret, nil
+}
+
+// SelectLimited returns at most limit of the exemplars of the series
+// identified by l within the time range [start, end], preferring the most
+// recent ones. The result stays in the same ascending order Select uses, so
+// capping drops the oldest exemplars, not the newest. A limit <= 0 means no
+// limit. The series' chain is forward-linked from oldest to newest, so the
+// whole chain is still walked; the limit caps the result, protecting callers
+// from very active series rather than bounding the scan itself.
+func (ce *CircularExemplarStorage) SelectLimited(l labels.Labels, start, end int64, limit int) ([]exemplar.Exemplar, error) {
+	ce.lock.RLock()
+	defer ce.lock.RUnlock()
+
+	idx, ok := ce.index[l.String()]
+	if !ok {
+		return nil, nil
+	}
+	exemplars := ce.appendSelect(nil, idx, start, end)
+	if limit > 0 && len(exemplars) > limit {
+		exemplars = exemplars[len(exemplars)-limit:]
+	}
+	return exemplars, nil
+}
+
+// AppendSelect appends the exemplars of the series identified by l within
+// the time range [start, end] to dst and returns the extended slice, in the
+// same ascending order SelectLimited uses. Callers that pool dst across
+// queries avoid the per-query result allocation; a nil dst behaves like a
+// plain select.
+func (ce *CircularExemplarStorage) AppendSelect(dst []exemplar.Exemplar, l labels.Labels, start, end int64) ([]exemplar.Exemplar, error) {
+	ce.lock.RLock()
+	defer ce.lock.RUnlock()
+
+	idx, ok := ce.index[l.String()]
+	if !ok {
+		return dst, nil
+	}
+	return ce.appendSelect(dst, idx, start, end), nil
+}
+
+// appendSelect appends the series' exemplars in range to dst. The read lock
+// must be held.
+func (ce *CircularExemplarStorage) appendSelect(dst []exemplar.Exemplar, idx *indexEntry, start, end int64) []exemplar.Exemplar {
+	ce.forEach(idx, start, end, func(e exemplar.Exemplar) bool {
+		dst = append(dst, e)
+		return true
+	})
+	return dst
+}
+
+func (ce *CircularExemplarStorage) selectLocked(ctx context.Context, start, end int64, match func(labels.Labels) bool, keep func(exemplar.Exemplar) bool) ([]QueryResult, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	ce.lock.RLock()
+	defer ce.lock.RUnlock()
+
+	ret := make([]QueryResult, 0)
+
+	scanned := 0
+	for _, idx := range ce.index {
+		if scanned++; scanned%checkContextEvery == 0 {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+		}
+
+		lbls := ce.exemplars[idx.oldest].seriesLabels
+		if !match(lbls) {
+			continue
+		}
+
+		var exemplars []exemplar.Exemplar
+		ce.forEach(idx, start, end, func(e exemplar.Exemplar) bool {
+			if keep == nil || keep(e) {
+				exemplars = append(exemplars, e)
+			}
+			return true
+		})
+		if len(exemplars) > 0 {
+			ret = append(ret, QueryResult{SeriesLabels: lbls, Exemplars: exemplars})
+		}
+	}
+
+	return ret, nil
+}
+
+// ForEach streams the exemplars of the series identified by l that fall into
+// the time range [start, end] to f, in the same order Select returns them.
+// It stops early when f returns false. Unlike Select, no intermediate slice
+// is allocated when the series' exemplars all carry timestamps.
+func (ce *CircularExemplarStorage) ForEach(l labels.Labels, start, end int64, f func(exemplar.Exemplar) bool) error {
+	ce.lock.RLock()
+	defer ce.lock.RUnlock()
+
+	idx, ok := ce.index[l.String()]
+	if !ok {
+		return nil
+	}
+	ce.forEach(idx, start, end, f)
+	return nil
+}
+
+// forEach streams the series' exemplars in range to f until f returns false.
+// The read lock must be held.
+func (ce *CircularExemplarStorage) forEach(idx *indexEntry, start, end int64, f func(exemplar.Exemplar) bool) {
+	// When every exemplar of the series carries a timestamp and the chain is
+	// in timestamp order, the buffer order can be streamed directly. Both can
+	// be violated: untimestamped exemplars are exempt from the ordering check
+	// and an out-of-order window admits slightly older timestamps.
+	var (
+		mixed  bool
+		first  = true
+		prevTs int64
+		steps  = 0
+	)
+	for i := idx.oldest; ; i = ce.exemplars[i].next {
+		// A chain longer than the buffer cannot terminate; treat it as
+		// mixed so the collecting path below applies its loop guard.
+		if steps++; steps > len(ce.exemplars) {
+			mixed = true
+			break
+		}
+		e := ce.exemplars[i].exemplar
+		if !e.HasTs || (!first && e.Ts < prevTs) {
+			mixed = true
+			break
+		}
+		prevTs, first = e.Ts, false
+		if i == idx.newest {
+			break
+		}
+	}
+	if mixed {
+		// Untimestamped exemplars need to be reordered to the end, so
+		// fall back to collecting and sorting.
+		for _, e := range ce.exemplarsInRange(idx, start, end) {
+			if !f(e) {
+				return
+			}
+		}
+		return
+	}
+	for i := idx.oldest; ; i = ce.exemplars[i].next {
+		if e := ce.exemplars[i].exemplar; e.Ts >= start && e.Ts <= end && !f(e) {
+			return
+		}
+		if i == idx.newest {
+			break
+		}
+	}
+}
+
+// exemplarsInRange collects the exemplars of the series described by idx
+// that fall into the time range [start, end]. Timestamped exemplars are
+// returned in ascending timestamp order, followed by untimestamped ones in
+// insertion order. The sort is stable, so exemplars with equal timestamps
+// stay in insertion order too. The read lock must be held.
+func (ce *CircularExemplarStorage) exemplarsInRange(idx *indexEntry, start, end int64) []exemplar.Exemplar {
+	var timed, untimed []exemplar.Exemplar
+	i := idx.oldest
+	for steps := 0; ; steps++ {
+		// A series' chain can never be longer than the buffer; a longer
+		// walk means its links do not terminate, so stop and account for
+		// the truncated result rather than looping forever.
+		if steps == len(ce.exemplars) {
+			ce.metrics.selectTruncatedTotal.Inc()
+			break
+		}
+		e := ce.exemplars[i]
+		switch {
+		case !e.exemplar.HasTs:
+			untimed = append(untimed, e.exemplar)
+		case e.exemplar.Ts >= start && e.exemplar.Ts <= end:
+			timed = append(timed, e.exemplar)
+		}
+		if i == idx.newest {
+			break
+		}
+		i = e.next
+	}
+	// Mixed appends can leave timestamped exemplars out of insertion order
+	// in the buffer since untimestamped ones are exempt from the ordering
+	// check on append.
+	sort.SliceStable(timed, func(a, b int) bool { return timed[a].Ts < timed[b].Ts })
+	return append(timed, untimed...)
+}
+
+func matchesSomeMatcherSet(lbls labels.Labels, matchers [][]*labels.Matcher) bool {
+Outer:
+	for _, ms := range matchers {
+		for _, m := range ms {
+			if !m.Matches(lbls.Get(m.Name)) {
+				continue Outer
+			}
+		}
+		return true
+	}
+	return false
+}
@@ -0,0 +1,1010 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package exemplar
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	client_testutil "github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/require"
+
+	"github.com/prometheus/prometheus/pkg/exemplar"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/pkg/relabel"
+	"github.com/prometheus/prometheus/storage"
+	"github.com/prometheus/prometheus/tsdb/record"
+	"github.com/prometheus/prometheus/tsdb/wal"
+)
+
+func TestAddExemplar(t *testing.T) {
+	es, err := NewCircularExemplarStorage(2, nil)
+	require.NoError(t, err)
+
+	l := labels.FromStrings("service", "asdf")
+	e := exemplar.Exemplar{
+		Labels: labels.FromStrings("traceID", "qwerty"),
+		Value:  0.1,
+		Ts:     1,
+		HasTs:  true,
+	}
+
+	require.NoError(t, es.AddExemplar(l, e))
+	require.Equal(t, es.index[l.String()].newest, 0, "exemplar was not stored correctly")
+
+	e2 := exemplar.Exemplar{
+		Labels: labels.FromStrings("traceID", "zxcvb"),
+		Value:  0.1,
+		Ts:     2,
+		HasTs:  true,
+	}
+
+	require.NoError(t, es.AddExemplar(l, e2))
+	require.Equal(t, es.index[l.String()].newest, 1, "exemplar was not stored correctly")
+
+	require.NoError(t, es.AddExemplar(l, e2), "adding duplicate exemplar should be a no-op")
+	require.Equal(t, es.index[l.String()].newest, 1, "duplicate exemplar was added")
+
+	e3 := exemplar.Exemplar{
+		Labels: labels.FromStrings("traceID", "pppp"),
+		Value:  0.1,
+		Ts:     1,
+		HasTs:  true,
+	}
+	require.Equal(t, ErrOutOfOrderExemplar, es.AddExemplar(l, e3))
+}
+
+func TestStorageOverflow(t *testing.T) {
+	// Test that circular buffer index and assignment
+	// works properly, adding more exemplars than can
+	// be stored and then querying for them.
+	es, err := NewCircularExemplarStorage(5, nil)
+	require.NoError(t, err)
+
+	l := labels.FromStrings("service", "asdf")
+
+	var eList []exemplar.Exemplar
+	for i := 0; i < len(es.exemplars)+1; i++ {
+		e := exemplar.Exemplar{
+			Labels: labels.FromStrings("traceID", fmt.Sprintf("a%d", i)),
+			Value:  float64(i),
+			Ts:     int64(101 + i),
+			HasTs:  true,
+		}
+		require.NoError(t, es.AddExemplar(l, e))
+		eList = append(eList, e)
+	}
+
+	m, err := labels.NewMatcher(labels.MatchEqual, "service", "asdf")
+	require.NoError(t, err)
+
+	ret, err := es.Select(context.Background(), 100, 110, []*labels.Matcher{m})
+	require.NoError(t, err)
+	require.Len(t, ret, 1)
+	require.Equal(t, eList[1:], ret[0].Exemplars, "select did not return the expected exemplars")
+}
+
+func TestSelectExemplar(t *testing.T) {
+	es, err := NewCircularExemplarStorage(5, nil)
+	require.NoError(t, err)
+
+	lNeedle := labels.FromStrings("service", "asdf")
+	e := exemplar.Exemplar{
+		Labels: labels.FromStrings("traceID", "querty"),
+		Value:  0.1,
+		Ts:     12,
+		HasTs:  true,
+	}
+	require.NoError(t, es.AddExemplar(lNeedle, e))
+
+	lOther := labels.FromStrings("service", "zxcv")
+	require.NoError(t, es.AddExemplar(lOther, exemplar.Exemplar{
+		Labels: labels.FromStrings("traceID", "zzzz"),
+		Value:  0.1,
+		Ts:     14,
+		HasTs:  true,
+	}))
+
+	m, err := labels.NewMatcher(labels.MatchEqual, "service", "asdf")
+	require.NoError(t, err)
+
+	ret, err := es.Select(context.Background(), 0, 100, []*labels.Matcher{m})
+	require.NoError(t, err)
+	require.Len(t, ret, 1)
+	require.Equal(t, lNeedle, ret[0].SeriesLabels)
+	require.Equal(t, []exemplar.Exemplar{e}, ret[0].Exemplars)
+
+	all, err := es.SelectAll(context.Background(), 0, 100)
+	require.NoError(t, err)
+	require.Len(t, all, 2)
+}
+
+func TestSelectCanceledContext(t *testing.T) {
+	es, err := NewCircularExemplarStorage(5, nil)
+	require.NoError(t, err)
+
+	l := labels.FromStrings("service", "asdf")
+	require.NoError(t, es.AddExemplar(l, exemplar.Exemplar{
+		Labels: labels.FromStrings("traceID", "querty"),
+		Value:  0.1,
+		Ts:     12,
+		HasTs:  true,
+	}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	m, err := labels.NewMatcher(labels.MatchEqual, "service", "asdf")
+	require.NoError(t, err)
+
+	_, err = es.Select(ctx, 0, 100, []*labels.Matcher{m})
+	require.Equal(t, context.Canceled, err)
+
+	_, err = es.SelectAll(ctx, 0, 100)
+	require.Equal(t, context.Canceled, err)
+}
+
+func TestSelectLimited(t *testing.T) {
+	es, err := NewCircularExemplarStorage(20, nil)
+	require.NoError(t, err)
+
+	l := labels.FromStrings("service", "asdf")
+	for i := 0; i < 10; i++ {
+		require.NoError(t, es.AddExemplar(l, exemplar.Exemplar{
+			Labels: labels.FromStrings("traceID", fmt.Sprintf("trace-%d", i)),
+			Value:  float64(i),
+			Ts:     int64(i),
+			HasTs:  true,
+		}))
+	}
+
+	// The cap keeps the newest exemplars, still in ascending order.
+	ret, err := es.SelectLimited(l, 0, 100, 3)
+	require.NoError(t, err)
+	require.Len(t, ret, 3)
+	for i, e := range ret {
+		require.Equal(t, int64(7+i), e.Ts)
+	}
+
+	// No limit returns everything in range.
+	ret, err = es.SelectLimited(l, 0, 100, 0)
+	require.NoError(t, err)
+	require.Len(t, ret, 10)
+
+	// Unknown series yield nothing.
+	ret, err = es.SelectLimited(labels.FromStrings("service", "other"), 0, 100, 3)
+	require.NoError(t, err)
+	require.Empty(t, ret)
+}
+
+func TestSelectTruncatedCounter(t *testing.T) {
+	es, err := NewCircularExemplarStorage(5, nil)
+	require.NoError(t, err)
+
+	l := labels.FromStrings("service", "asdf")
+	for i := 0; i < 3; i++ {
+		require.NoError(t, es.AddExemplar(l, exemplar.Exemplar{
+			Labels: labels.FromStrings("traceID", fmt.Sprintf("trace-%d", i)),
+			Value:  float64(i),
+			Ts:     int64(i),
+			HasTs:  true,
+		}))
+	}
+
+	// Corrupt the series' chain into a cycle that never reaches its newest
+	// slot, the shape a buffer overwrite bug would produce.
+	es.exemplars[1].next = 0
+
+	// Select still returns instead of hanging, and the truncation is
+	// accounted for.
+	ret, err := es.SelectAll(context.Background(), 0, 100)
+	require.NoError(t, err)
+	require.Len(t, ret, 1)
+	require.Equal(t, 1.0, client_testutil.ToFloat64(es.metrics.selectTruncatedTotal))
+
+	// An intact walk does not touch the counter.
+	es.exemplars[1].next = 2
+	_, err = es.SelectAll(context.Background(), 0, 100)
+	require.NoError(t, err)
+	require.Equal(t, 1.0, client_testutil.ToFloat64(es.metrics.selectTruncatedTotal))
+}
+
+func TestClearSeries(t *testing.T) {
+	es, err := NewCircularExemplarStorage(10, nil)
+	require.NoError(t, err)
+
+	l1 := labels.FromStrings("service", "asdf")
+	l2 := labels.FromStrings("service", "qwer")
+	for i := 0; i < 3; i++ {
+		for _, l := range []labels.Labels{l1, l2} {
+			require.NoError(t, es.AddExemplar(l, exemplar.Exemplar{
+				Labels: labels.FromStrings("traceID", fmt.Sprintf("%s-%d", l.Get("service"), i)),
+				Value:  float64(i),
+				Ts:     int64(i),
+				HasTs:  true,
+			}))
+		}
+	}
+
+	es.ClearSeries(l1)
+
+	// The cleared series is gone immediately, the other one is intact.
+	ret, err := es.SelectAll(context.Background(), 0, 100)
+	require.NoError(t, err)
+	require.Len(t, ret, 1)
+	require.Equal(t, l2, ret[0].SeriesLabels)
+	require.Len(t, ret[0].Exemplars, 3)
+	require.Equal(t, 3, es.Stats().Exemplars)
+
+	// The series can be re-added from scratch afterwards.
+	require.NoError(t, es.AddExemplar(l1, exemplar.Exemplar{
+		Labels: labels.FromStrings("traceID", "fresh"),
+		Value:  1,
+		Ts:     10,
+		HasTs:  true,
+	}))
+	ret, err = es.SelectAll(context.Background(), 0, 100)
+	require.NoError(t, err)
+	require.Len(t, ret, 2)
+
+	// Clearing an unknown series is a no-op.
+	es.ClearSeries(labels.FromStrings("service", "none"))
+	require.Equal(t, 4, es.Stats().Exemplars)
+}
+
+func TestSelectMany(t *testing.T) {
+	es, err := NewCircularExemplarStorage(10, nil)
+	require.NoError(t, err)
+
+	l1 := labels.FromStrings("service", "asdf")
+	l2 := labels.FromStrings("service", "qwer")
+	for i := 0; i < 3; i++ {
+		require.NoError(t, es.AddExemplar(l1, exemplar.Exemplar{
+			Labels: labels.FromStrings("traceID", fmt.Sprintf("a%d", i)),
+			Value:  float64(i),
+			Ts:     int64(101 + i),
+			HasTs:  true,
+		}))
+	}
+	require.NoError(t, es.AddExemplar(l2, exemplar.Exemplar{
+		Labels: labels.FromStrings("traceID", "b"),
+		Value:  1,
+		Ts:     200,
+		HasTs:  true,
+	}))
+
+	lMissing := labels.FromStrings("service", "none")
+	ret, err := es.SelectMany([]labels.Labels{l1, l2, lMissing}, 0, 150)
+	require.NoError(t, err)
+	require.Len(t, ret, 1)
+	require.Len(t, ret[l1.Hash()], 3)
+
+	ret, err = es.SelectMany([]labels.Labels{l1, l2}, 0, 300)
+	require.NoError(t, err)
+	require.Len(t, ret, 2)
+}
+
+func BenchmarkSelectManyVsSelect(b *testing.B) {
+	const numSeries = 100
+
+	es, err := NewCircularExemplarStorage(10000, nil)
+	require.NoError(b, err)
+
+	series := make([]labels.Labels, 0, numSeries)
+	matchers := make([][]*labels.Matcher, 0, numSeries)
+	for i := 0; i < numSeries; i++ {
+		l := labels.FromStrings("service", fmt.Sprintf("s%d", i))
+		series = append(series, l)
+		m, err := labels.NewMatcher(labels.MatchEqual, "service", fmt.Sprintf("s%d", i))
+		require.NoError(b, err)
+		matchers = append(matchers, []*labels.Matcher{m})
+		for j := 0; j < 10; j++ {
+			require.NoError(b, es.AddExemplar(l, exemplar.Exemplar{
+				Labels: labels.FromStrings("traceID", fmt.Sprintf("t%d", j)),
+				Value:  float64(j),
+				Ts:     int64(100 + j),
+				HasTs:  true,
+			}))
+		}
+	}
+
+	b.Run("select-per-series", func(b *testing.B) {
+		for n := 0; n < b.N; n++ {
+			for i := range series {
+				_, err := es.Select(context.Background(), 0, 1000, matchers[i])
+				require.NoError(b, err)
+			}
+		}
+	})
+	b.Run("select-many", func(b *testing.B) {
+		for n := 0; n < b.N; n++ {
+			_, err := es.SelectMany(series, 0, 1000)
+			require.NoError(b, err)
+		}
+	})
+}
+
+func TestWALRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "exemplar_wal")
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, os.RemoveAll(dir))
+	}()
+
+	w, err := wal.New(nil, nil, dir, false)
+	require.NoError(t, err)
+
+	es, err := OpenCircularExemplarStorage(5, nil, w)
+	require.NoError(t, err)
+
+	l := labels.FromStrings("service", "asdf")
+	var eList []exemplar.Exemplar
+	for i := 0; i < 7; i++ {
+		e := exemplar.Exemplar{
+			Labels: labels.FromStrings("traceID", fmt.Sprintf("a%d", i)),
+			Value:  float64(i),
+			Ts:     int64(101 + i),
+			HasTs:  true,
+		}
+		require.NoError(t, es.AddExemplar(l, e))
+		eList = append(eList, e)
+	}
+	require.NoError(t, w.Close())
+
+	// Simulate a restart by replaying the WAL into a fresh storage.
+	w, err = wal.New(nil, nil, dir, false)
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, w.Close())
+	}()
+
+	es, err = OpenCircularExemplarStorage(5, nil, w)
+	require.NoError(t, err)
+
+	ret, err := es.SelectAll(context.Background(), 0, 1000)
+	require.NoError(t, err)
+	require.Len(t, ret, 1)
+	require.Equal(t, l, ret[0].SeriesLabels)
+	// Only the newest exemplars fit into the restored buffer.
+	require.Equal(t, eList[2:], ret[0].Exemplars)
+}
+
+func TestStats(t *testing.T) {
+	es, err := NewCircularExemplarStorage(5, nil)
+	require.NoError(t, err)
+
+	require.Equal(t, ExemplarStats{Capacity: 5}, es.Stats())
+
+	l1 := labels.FromStrings("service", "asdf")
+	l2 := labels.FromStrings("service", "qwer")
+	require.NoError(t, es.AddExemplar(l1, exemplar.Exemplar{
+		Labels: labels.FromStrings("traceID", "a"),
+		Value:  1,
+		Ts:     100,
+		HasTs:  true,
+	}))
+	require.NoError(t, es.AddExemplar(l1, exemplar.Exemplar{
+		Labels: labels.FromStrings("traceID", "b"),
+		Value:  2,
+		Ts:     200,
+		HasTs:  true,
+	}))
+	require.NoError(t, es.AddExemplar(l2, exemplar.Exemplar{
+		Labels: labels.FromStrings("traceID", "c"),
+		Value:  3,
+		Ts:     150,
+		HasTs:  true,
+	}))
+
+	require.Equal(t, ExemplarStats{
+		Capacity:  5,
+		Exemplars: 3,
+		Series:    2,
+		OldestTs:  100,
+		NewestTs:  200,
+		NextIndex: 3,
+	}, es.Stats())
+}
+
+func TestSelectMixedTimestamps(t *testing.T) {
+	es, err := NewCircularExemplarStorage(10, nil)
+	require.NoError(t, err)
+
+	l := labels.FromStrings("service", "asdf")
+	eUntimed1 := exemplar.Exemplar{Labels: labels.FromStrings("traceID", "u1"), Value: 1}
+	eTimed1 := exemplar.Exemplar{Labels: labels.FromStrings("traceID", "t1"), Value: 2, Ts: 100, HasTs: true}
+	eUntimed2 := exemplar.Exemplar{Labels: labels.FromStrings("traceID", "u2"), Value: 3}
+	eTimed2 := exemplar.Exemplar{Labels: labels.FromStrings("traceID", "t2"), Value: 4, Ts: 50, HasTs: true}
+
+	for _, e := range []exemplar.Exemplar{eUntimed1, eTimed1, eUntimed2, eTimed2} {
+		require.NoError(t, es.AddExemplar(l, e))
+	}
+
+	ret, err := es.SelectAll(context.Background(), 0, 1000)
+	require.NoError(t, err)
+	require.Len(t, ret, 1)
+	// Timestamped exemplars come first in timestamp order, untimestamped
+	// ones follow in insertion order.
+	require.Equal(t, []exemplar.Exemplar{eTimed2, eTimed1, eUntimed1, eUntimed2}, ret[0].Exemplars)
+}
+
+func TestDelete(t *testing.T) {
+	es, err := NewCircularExemplarStorage(10, nil)
+	require.NoError(t, err)
+
+	l1 := labels.FromStrings("service", "asdf")
+	l2 := labels.FromStrings("service", "qwer")
+	e1 := exemplar.Exemplar{Labels: labels.FromStrings("traceID", "a"), Value: 0.1, Ts: 1, HasTs: true}
+	e2 := exemplar.Exemplar{Labels: labels.FromStrings("traceID", "b"), Value: 0.2, Ts: 2, HasTs: true}
+
+	require.NoError(t, es.AddExemplar(l1, e1))
+	require.NoError(t, es.AddExemplar(l2, e2))
+
+	m, err := labels.NewMatcher(labels.MatchEqual, "service", "asdf")
+	require.NoError(t, err)
+	require.NoError(t, es.Delete([]*labels.Matcher{m}))
+
+	ret, err := es.SelectAll(context.Background(), 0, 100)
+	require.NoError(t, err)
+	require.Len(t, ret, 1)
+	require.Equal(t, l2, ret[0].SeriesLabels)
+	require.Equal(t, []exemplar.Exemplar{e2}, ret[0].Exemplars)
+
+	// The freed slots must be reusable once the write position wraps to them.
+	require.Equal(t, 1, es.Stats().Exemplars)
+	for i := 0; i < 10; i++ {
+		require.NoError(t, es.AddExemplar(l2, exemplar.Exemplar{Value: float64(i), Ts: int64(10 + i), HasTs: true}))
+	}
+	require.Equal(t, 10, es.Stats().Exemplars)
+}
+
+func TestForEach(t *testing.T) {
+	es, err := NewCircularExemplarStorage(10, nil)
+	require.NoError(t, err)
+
+	l := labels.FromStrings("service", "asdf")
+	var added []exemplar.Exemplar
+	for i := 0; i < 5; i++ {
+		e := exemplar.Exemplar{Value: float64(i), Ts: int64(i * 10), HasTs: true}
+		added = append(added, e)
+		require.NoError(t, es.AddExemplar(l, e))
+	}
+
+	// No results for an unknown series or an empty range.
+	require.NoError(t, es.ForEach(labels.FromStrings("service", "other"), 0, 100, func(exemplar.Exemplar) bool {
+		t.Fatal("callback invoked for unknown series")
+		return true
+	}))
+
+	var got []exemplar.Exemplar
+	require.NoError(t, es.ForEach(l, 10, 30, func(e exemplar.Exemplar) bool {
+		got = append(got, e)
+		return true
+	}))
+	require.Equal(t, added[1:4], got)
+
+	// Early stop after the first exemplar.
+	got = got[:0]
+	require.NoError(t, es.ForEach(l, 0, 100, func(e exemplar.Exemplar) bool {
+		got = append(got, e)
+		return false
+	}))
+	require.Equal(t, added[:1], got)
+
+	// Mixed timestamped and untimestamped exemplars keep Select's order.
+	eUntimed := exemplar.Exemplar{Labels: labels.FromStrings("traceID", "u"), Value: 99}
+	require.NoError(t, es.AddExemplar(l, eUntimed))
+	got = got[:0]
+	require.NoError(t, es.ForEach(l, 0, 100, func(e exemplar.Exemplar) bool {
+		got = append(got, e)
+		return true
+	}))
+	require.Equal(t, append(added[:5:5], eUntimed), got)
+}
+
+func TestRelabelDroppedExemplars(t *testing.T) {
+	es, err := NewCircularExemplarStorage(5, nil)
+	require.NoError(t, err)
+
+	// Drop every series.
+	es.ApplyRelabelConfigs([]*relabel.Config{
+		{
+			SourceLabels: model.LabelNames{"service"},
+			Regex:        relabel.MustNewRegexp(".*"),
+			Action:       relabel.Drop,
+		},
+	})
+
+	l := labels.FromStrings("service", "asdf")
+	e := exemplar.Exemplar{Labels: labels.FromStrings("traceID", "qwerty"), Value: 0.1, Ts: 1, HasTs: true}
+
+	require.NoError(t, es.AddExemplar(l, e))
+	require.Equal(t, 1.0, client_testutil.ToFloat64(es.metrics.relabelDroppedTotal))
+
+	ret, err := es.SelectAll(context.Background(), 0, 100)
+	require.NoError(t, err)
+	require.Len(t, ret, 0)
+
+	// Without relabel rules the exemplar is kept and the counter is unchanged.
+	es.ApplyRelabelConfigs(nil)
+	require.NoError(t, es.AddExemplar(l, e))
+	require.Equal(t, 1.0, client_testutil.ToFloat64(es.metrics.relabelDroppedTotal))
+	ret, err = es.SelectAll(context.Background(), 0, 100)
+	require.NoError(t, err)
+	require.Len(t, ret, 1)
+}
+
+func TestSelectWithExemplarFilter(t *testing.T) {
+	es, err := NewCircularExemplarStorage(10, nil)
+	require.NoError(t, err)
+
+	l := labels.FromStrings("service", "asdf")
+	eABC1 := exemplar.Exemplar{Labels: labels.FromStrings("trace_id", "abc1"), Value: 1, Ts: 1, HasTs: true}
+	eXYZ := exemplar.Exemplar{Labels: labels.FromStrings("trace_id", "xyz9"), Value: 2, Ts: 2, HasTs: true}
+	eABC2 := exemplar.Exemplar{Labels: labels.FromStrings("trace_id", "abc2"), Value: 3, Ts: 3, HasTs: true}
+
+	for _, e := range []exemplar.Exemplar{eABC1, eXYZ, eABC2} {
+		require.NoError(t, es.AddExemplar(l, e))
+	}
+
+	mTrace, err := labels.NewMatcher(labels.MatchRegexp, "trace_id", "abc.*")
+	require.NoError(t, err)
+	mSeries, err := labels.NewMatcher(labels.MatchEqual, "service", "asdf")
+	require.NoError(t, err)
+
+	ret, err := es.SelectWithExemplarFilter(context.Background(), 0, 100, []*labels.Matcher{mTrace}, []*labels.Matcher{mSeries})
+	require.NoError(t, err)
+	require.Len(t, ret, 1)
+	require.Equal(t, []exemplar.Exemplar{eABC1, eABC2}, ret[0].Exemplars)
+
+	// A filter matching nothing drops the series entirely.
+	mNone, err := labels.NewMatcher(labels.MatchEqual, "trace_id", "nope")
+	require.NoError(t, err)
+	ret, err = es.SelectWithExemplarFilter(context.Background(), 0, 100, []*labels.Matcher{mNone}, []*labels.Matcher{mSeries})
+	require.NoError(t, err)
+	require.Len(t, ret, 0)
+}
+
+func TestEstimatedBytes(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	es, err := NewCircularExemplarStorage(4, reg)
+	require.NoError(t, err)
+	require.Equal(t, 0, es.EstimatedBytes())
+
+	l := labels.FromStrings("service", "asdf")
+	e := exemplar.Exemplar{Labels: labels.FromStrings("traceID", "qwerty"), Value: 1, Ts: 1, HasTs: true}
+	require.NoError(t, es.AddExemplar(l, e))
+
+	// One slot: fixed overhead plus series and exemplar label bytes.
+	exp := bytesPerExemplarSlot + len("service") + len("asdf") + len("traceID") + len("qwerty")
+	require.Equal(t, exp, es.EstimatedBytes())
+
+	mfs, err := reg.Gather()
+	require.NoError(t, err)
+	found := false
+	for _, mf := range mfs {
+		if mf.GetName() == "prometheus_tsdb_exemplar_exemplars_bytes" {
+			found = true
+			require.Equal(t, float64(exp), mf.GetMetric()[0].GetGauge().GetValue())
+		}
+	}
+	require.True(t, found)
+}
+
+func TestOutOfOrderTimeWindow(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	es, err := NewCircularExemplarStorage(10, reg)
+	require.NoError(t, err)
+	es.SetOutOfOrderTimeWindow(10)
+
+	l := labels.FromStrings("service", "asdf")
+	newExemplar := func(ts int64) exemplar.Exemplar {
+		return exemplar.Exemplar{
+			Labels: labels.FromStrings("traceID", fmt.Sprintf("qwerty-%d", ts)),
+			Value:  float64(ts),
+			Ts:     ts,
+			HasTs:  true,
+		}
+	}
+	require.NoError(t, es.AddExemplar(l, newExemplar(100)))
+
+	// Exactly at the boundary and just inside the window are accepted, just
+	// outside is rejected.
+	require.NoError(t, es.AddExemplar(l, newExemplar(90)))
+	require.NoError(t, es.AddExemplar(l, newExemplar(91)))
+	require.Equal(t, ErrOutOfOrderExemplar, es.AddExemplar(l, newExemplar(89)))
+	require.Equal(t, 1.0, client_testutil.ToFloat64(es.metrics.outOfOrderTotal))
+
+	// Select still returns timestamp order despite the unordered appends.
+	ret, err := es.Select(context.Background(), 0, 1000, []*labels.Matcher{
+		{Type: labels.MatchEqual, Name: "service", Value: "asdf"},
+	})
+	require.NoError(t, err)
+	require.Len(t, ret, 1)
+	require.Equal(t, []exemplar.Exemplar{newExemplar(90), newExemplar(91), newExemplar(100)}, ret[0].Exemplars)
+}
+
+func TestSelectEqualTimestampOrder(t *testing.T) {
+	es, err := NewCircularExemplarStorage(10, nil)
+	require.NoError(t, err)
+
+	// Exemplars sharing a timestamp must come back in insertion order.
+	l := labels.FromStrings("service", "asdf")
+	exemplars := []exemplar.Exemplar{
+		{Labels: labels.FromStrings("traceID", "a"), Value: 1, Ts: 100, HasTs: true},
+		{Labels: labels.FromStrings("traceID", "b"), Value: 2, Ts: 100, HasTs: true},
+		{Labels: labels.FromStrings("traceID", "c"), Value: 3, Ts: 100, HasTs: true},
+	}
+	es.SetOutOfOrderTimeWindow(1)
+	for _, e := range exemplars {
+		require.NoError(t, es.AddExemplar(l, e))
+	}
+
+	for i := 0; i < 10; i++ {
+		ret, err := es.Select(context.Background(), 0, 1000, []*labels.Matcher{
+			{Type: labels.MatchEqual, Name: "service", Value: "asdf"},
+		})
+		require.NoError(t, err)
+		require.Len(t, ret, 1)
+		require.Equal(t, exemplars, ret[0].Exemplars)
+	}
+}
+
+func TestAddExemplars(t *testing.T) {
+	es, err := NewCircularExemplarStorage(10, nil)
+	require.NoError(t, err)
+
+	l := labels.FromStrings("service", "asdf")
+	entries := []record.SeriesExemplar{
+		{SeriesLabels: l, E: exemplar.Exemplar{Labels: labels.FromStrings("traceID", "a"), Value: 1, Ts: 1, HasTs: true}},
+		{SeriesLabels: l, E: exemplar.Exemplar{Labels: labels.FromStrings("traceID", "b"), Value: 2, Ts: 2, HasTs: true}},
+		// Out of order; skipped but the rest is appended.
+		{SeriesLabels: l, E: exemplar.Exemplar{Labels: labels.FromStrings("traceID", "c"), Value: 3, Ts: 1, HasTs: true}},
+		{SeriesLabels: l, E: exemplar.Exemplar{Labels: labels.FromStrings("traceID", "d"), Value: 4, Ts: 3, HasTs: true}},
+	}
+	err = es.AddExemplars(entries)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "out of order exemplar")
+
+	ret, err := es.SelectAll(context.Background(), 0, 100)
+	require.NoError(t, err)
+	require.Len(t, ret, 1)
+	require.Equal(t, []exemplar.Exemplar{entries[0].E, entries[1].E, entries[3].E}, ret[0].Exemplars)
+}
+
+func BenchmarkAddExemplar(b *testing.B) {
+	entries := make([]record.SeriesExemplar, 100)
+	for i := range entries {
+		entries[i] = record.SeriesExemplar{
+			SeriesLabels: labels.FromStrings("service", fmt.Sprintf("svc-%d", i)),
+			E:            exemplar.Exemplar{Labels: labels.FromStrings("traceID", fmt.Sprintf("t-%d", i)), Value: float64(i), Ts: int64(i), HasTs: true},
+		}
+	}
+
+	b.Run("single", func(b *testing.B) {
+		es, err := NewCircularExemplarStorage(int64(len(entries)), nil)
+		require.NoError(b, err)
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			for _, e := range entries {
+				if err := es.AddExemplar(e.SeriesLabels, e.E); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+	b.Run("bulk", func(b *testing.B) {
+		es, err := NewCircularExemplarStorage(int64(len(entries)), nil)
+		require.NoError(b, err)
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if err := es.AddExemplars(entries); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestIndexKeyedByFullLabels(t *testing.T) {
+	es, err := NewCircularExemplarStorage(4, nil)
+	require.NoError(t, err)
+
+	// Two distinct series. With the index keyed by a 64-bit hash these
+	// could collide and attach one series' exemplars to the other; keying
+	// by the full label string makes that impossible regardless of how
+	// the hash function behaves.
+	l1 := labels.FromStrings("service", "a")
+	l2 := labels.FromStrings("service", "b")
+
+	for i := int64(0); i < 4; i++ {
+		l := l1
+		if i%2 == 1 {
+			l = l2
+		}
+		require.NoError(t, es.AddExemplar(l, exemplar.Exemplar{
+			Labels: labels.FromStrings("traceID", fmt.Sprintf("%d", i)),
+			Value:  float64(i), Ts: i * 10, HasTs: true,
+		}))
+	}
+	require.Len(t, es.index, 2)
+	for _, key := range []string{l1.String(), l2.String()} {
+		_, ok := es.index[key]
+		require.True(t, ok, "index not keyed by label string %q", key)
+	}
+
+	for i, l := range []labels.Labels{l1, l2} {
+		ret, err := es.Select(context.Background(), 0, 100, [][]*labels.Matcher{{
+			{Type: labels.MatchEqual, Name: "service", Value: l.Get("service")},
+		}}...)
+		require.NoError(t, err)
+		require.Len(t, ret, 1)
+		require.Equal(t, l, ret[0].SeriesLabels)
+		require.Len(t, ret[0].Exemplars, 2)
+		for _, e := range ret[0].Exemplars {
+			require.Equal(t, int64(i), int64(e.Value)%2, "exemplar %v bled into series %v", e, l)
+		}
+	}
+
+	// Wrapping the buffer exercises the eviction walk, which also resolves
+	// series by their full label string now.
+	for i := int64(4); i < 8; i++ {
+		require.NoError(t, es.AddExemplar(l1, exemplar.Exemplar{
+			Labels: labels.FromStrings("traceID", fmt.Sprintf("%d", i)),
+			Value:  float64(i), Ts: i * 10, HasTs: true,
+		}))
+	}
+	require.Len(t, es.index, 1)
+	ret, err := es.SelectAll(context.Background(), 0, 100)
+	require.NoError(t, err)
+	require.Len(t, ret, 1)
+	require.Equal(t, l1, ret[0].SeriesLabels)
+	require.Len(t, ret[0].Exemplars, 4)
+}
+
+func TestGrow(t *testing.T) {
+	es, err := NewCircularExemplarStorage(3, nil)
+	require.NoError(t, err)
+
+	l := labels.FromStrings("service", "asdf")
+	for i := int64(0); i < 3; i++ {
+		require.NoError(t, es.AddExemplar(l, exemplar.Exemplar{
+			Labels: labels.FromStrings("traceID", fmt.Sprintf("%d", i)),
+			Value:  float64(i), Ts: i, HasTs: true,
+		}))
+	}
+
+	require.Error(t, es.Grow(2), "shrinking must be rejected")
+	require.NoError(t, es.Grow(10))
+	require.Equal(t, 10, es.Stats().Capacity)
+
+	// All three original exemplars survive the grow...
+	ret, err := es.Select(context.Background(), 0, 100, [][]*labels.Matcher{{
+		{Type: labels.MatchEqual, Name: "service", Value: "asdf"},
+	}}...)
+	require.NoError(t, err)
+	require.Len(t, ret, 1)
+	require.Len(t, ret[0].Exemplars, 3)
+
+	// ...and new ones land in the grown tail without evicting them.
+	for i := int64(3); i < 10; i++ {
+		require.NoError(t, es.AddExemplar(l, exemplar.Exemplar{
+			Labels: labels.FromStrings("traceID", fmt.Sprintf("%d", i)),
+			Value:  float64(i), Ts: i, HasTs: true,
+		}))
+	}
+	ret, err = es.Select(context.Background(), 0, 100, [][]*labels.Matcher{{
+		{Type: labels.MatchEqual, Name: "service", Value: "asdf"},
+	}}...)
+	require.NoError(t, err)
+	require.Len(t, ret, 1)
+	require.Len(t, ret[0].Exemplars, 10)
+	for i, e := range ret[0].Exemplars {
+		require.Equal(t, float64(i), e.Value)
+	}
+}
+
+func TestNewCircularExemplarStorageLength(t *testing.T) {
+	for _, len := range []int64{0, -1} {
+		_, err := NewCircularExemplarStorage(len, nil)
+		require.Error(t, err, "length %d must be rejected", len)
+	}
+
+	es, err := NewCircularExemplarStorage(1, nil)
+	require.NoError(t, err)
+	require.Equal(t, 1, es.Stats().Capacity)
+}
+
+func TestAppendSelect(t *testing.T) {
+	es, err := NewCircularExemplarStorage(10, nil)
+	require.NoError(t, err)
+
+	l := labels.FromStrings("service", "asdf")
+	var want []exemplar.Exemplar
+	for i := 0; i < 6; i++ {
+		e := exemplar.Exemplar{
+			Labels: labels.FromStrings("traceID", fmt.Sprintf("a%d", i)),
+			Value:  float64(i),
+			Ts:     int64(101 + i),
+			HasTs:  true,
+		}
+		require.NoError(t, es.AddExemplar(l, e))
+		want = append(want, e)
+	}
+
+	// Nil dst behaves like a plain select.
+	got, err := es.AppendSelect(nil, l, 0, 200)
+	require.NoError(t, err)
+	require.Equal(t, want, got)
+
+	// An existing dst is extended, not replaced.
+	dst := []exemplar.Exemplar{want[0]}
+	got, err = es.AppendSelect(dst, l, 0, 200)
+	require.NoError(t, err)
+	require.Equal(t, append([]exemplar.Exemplar{want[0]}, want...), got)
+
+	// Unknown series leaves dst untouched.
+	got, err = es.AppendSelect(dst[:1], labels.FromStrings("service", "nope"), 0, 200)
+	require.NoError(t, err)
+	require.Equal(t, dst[:1], got)
+}
+
+func BenchmarkAppendSelect(b *testing.B) {
+	es, err := NewCircularExemplarStorage(1000, nil)
+	require.NoError(b, err)
+
+	l := labels.FromStrings("service", "asdf")
+	for i := 0; i < 1000; i++ {
+		require.NoError(b, es.AddExemplar(l, exemplar.Exemplar{
+			Labels: labels.FromStrings("traceID", fmt.Sprintf("a%d", i)),
+			Value:  float64(i),
+			Ts:     int64(101 + i),
+			HasTs:  true,
+		}))
+	}
+
+	b.Run("select", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := es.SelectLimited(l, 0, 2000, 0); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("append-pooled", func(b *testing.B) {
+		b.ReportAllocs()
+		var dst []exemplar.Exemplar
+		for i := 0; i < b.N; i++ {
+			var err error
+			if dst, err = es.AppendSelect(dst[:0], l, 0, 2000); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestAddExemplarLabelLength(t *testing.T) {
+	es, err := NewCircularExemplarStorage(5, nil)
+	require.NoError(t, err)
+
+	l := labels.FromStrings("service", "asdf")
+	atLimit := exemplar.Exemplar{
+		Labels: labels.FromStrings("trace_id", strings.Repeat("a", defaultMaxExemplarLabelLength-len("trace_id"))),
+		Value:  1,
+		Ts:     1,
+		HasTs:  true,
+	}
+	require.NoError(t, es.AddExemplar(l, atLimit))
+
+	overLimit := exemplar.Exemplar{
+		Labels: labels.FromStrings("trace_id", strings.Repeat("b", defaultMaxExemplarLabelLength-len("trace_id")+1)),
+		Value:  2,
+		Ts:     2,
+		HasTs:  true,
+	}
+	require.Equal(t, storage.ErrExemplarLabelLength, es.AddExemplar(l, overLimit))
+
+	// Raising the limit admits it, disabling the check admits anything.
+	es.SetMaxLabelLength(256)
+	require.NoError(t, es.AddExemplar(l, overLimit))
+	es.SetMaxLabelLength(0)
+	require.NoError(t, es.AddExemplar(l, exemplar.Exemplar{
+		Labels: labels.FromStrings("trace_id", strings.Repeat("c", 1024)),
+		Value:  3,
+		Ts:     3,
+		HasTs:  true,
+	}))
+}
+
+func TestApplyRelabelConfigsConcurrent(t *testing.T) {
+	es, err := NewCircularExemplarStorage(100, nil)
+	require.NoError(t, err)
+
+	cfg := relabel.Config{
+		SourceLabels: model.LabelNames{"service"},
+		Regex:        relabel.MustNewRegexp("drop.*"),
+		Action:       relabel.Drop,
+	}
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if i%2 == 0 {
+				es.ApplyRelabelConfigs([]*relabel.Config{&cfg})
+			} else {
+				es.ApplyRelabelConfigs(nil)
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		l := labels.FromStrings("service", "asdf")
+		for i := 0; i < 1000; i++ {
+			require.NoError(t, es.AddExemplar(l, exemplar.Exemplar{
+				Labels: labels.FromStrings("traceID", fmt.Sprintf("a%d", i)),
+				Value:  float64(i),
+				Ts:     int64(101 + i),
+				HasTs:  true,
+			}))
+		}
+		close(done)
+	}()
+	wg.Wait()
+}
+
+func TestAddExemplarEvictsOwnOnlyExemplar(t *testing.T) {
+	es, err := NewCircularExemplarStorage(2, nil)
+	require.NoError(t, err)
+
+	lA := labels.FromStrings("service", "a")
+	lB := labels.FromStrings("service", "b")
+	e1 := exemplar.Exemplar{Labels: labels.FromStrings("traceID", "a1"), Value: 1, Ts: 1, HasTs: true}
+	e2 := exemplar.Exemplar{Labels: labels.FromStrings("traceID", "b1"), Value: 2, Ts: 2, HasTs: true}
+	require.NoError(t, es.AddExemplar(lA, e1))
+	require.NoError(t, es.AddExemplar(lB, e2))
+
+	// The buffer is full; this append overwrites the slot holding A's only
+	// exemplar, evicting A's own index entry mid-append.
+	e3 := exemplar.Exemplar{Labels: labels.FromStrings("traceID", "a2"), Value: 3, Ts: 3, HasTs: true}
+	require.NoError(t, es.AddExemplar(lA, e3))
+
+	ret, err := es.SelectAll(context.Background(), 0, 100)
+	require.NoError(t, err)
+	require.Len(t, ret, 2)
+	got := map[string]exemplar.Exemplar{}
+	for _, qr := range ret {
+		require.Len(t, qr.Exemplars, 1)
+		got[qr.SeriesLabels.String()] = qr.Exemplars[0]
+	}
+	require.Equal(t, e3, got[lA.String()])
+	require.Equal(t, e2, got[lB.String()])
+
+	stats := es.Stats()
+	require.Equal(t, 2, stats.Exemplars)
+	require.Equal(t, 2, stats.Series)
+}
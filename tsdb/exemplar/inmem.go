@@ -0,0 +1,106 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package exemplar
+
+import (
+	"context"
+	"math"
+	"sort"
+	"sync"
+
+	"github.com/prometheus/prometheus/pkg/exemplar"
+	"github.com/prometheus/prometheus/pkg/labels"
+)
+
+// InMemExemplarStorage keeps every appended exemplar in memory, keyed by
+// series. Unlike CircularExemplarStorage it neither bounds its size nor
+// enforces append order, which makes it suitable for tests and short-lived
+// tooling rather than long-running servers. Both implementations answer
+// Select with the same time-window semantics so they stay interchangeable.
+type InMemExemplarStorage struct {
+	lock   sync.RWMutex
+	series map[uint64]*inMemSeries
+}
+
+type inMemSeries struct {
+	labels    labels.Labels
+	exemplars []exemplar.Exemplar
+}
+
+// NewInMemExemplarStorage returns an empty unbounded exemplar storage.
+func NewInMemExemplarStorage() *InMemExemplarStorage {
+	return &InMemExemplarStorage{series: map[uint64]*inMemSeries{}}
+}
+
+// AddExemplar appends e as an exemplar of the series identified by l.
+func (es *InMemExemplarStorage) AddExemplar(l labels.Labels, e exemplar.Exemplar) error {
+	es.lock.Lock()
+	defer es.lock.Unlock()
+
+	s, ok := es.series[l.Hash()]
+	if !ok {
+		s = &inMemSeries{labels: l}
+		es.series[l.Hash()] = s
+	}
+	s.exemplars = append(s.exemplars, e)
+	return nil
+}
+
+// ClearSeries removes all exemplars of the series identified by l and the
+// series itself. Clearing a series the storage does not hold is a no-op.
+func (es *InMemExemplarStorage) ClearSeries(l labels.Labels) {
+	es.lock.Lock()
+	defer es.lock.Unlock()
+
+	delete(es.series, l.Hash())
+}
+
+// Select returns the exemplars within the time range [start, end] for all
+// series matching any of the given matcher sets, ordered like
+// CircularExemplarStorage.Select: by timestamp, keeping insertion order for
+// equal timestamps. Exemplars without a timestamp cannot be placed in a time
+// window and are only returned by unbounded queries over the full time range.
+func (es *InMemExemplarStorage) Select(ctx context.Context, start, end int64, matchers ...[]*labels.Matcher) ([]QueryResult, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	es.lock.RLock()
+	defer es.lock.RUnlock()
+
+	bounded := start > math.MinInt64 || end < math.MaxInt64
+
+	ret := make([]QueryResult, 0)
+	for _, s := range es.series {
+		if !matchesSomeMatcherSet(s.labels, matchers) {
+			continue
+		}
+		var timed, untimed []exemplar.Exemplar
+		for _, e := range s.exemplars {
+			switch {
+			case !e.HasTs:
+				if !bounded {
+					untimed = append(untimed, e)
+				}
+			case e.Ts >= start && e.Ts <= end:
+				timed = append(timed, e)
+			}
+		}
+		sort.SliceStable(timed, func(a, b int) bool { return timed[a].Ts < timed[b].Ts })
+		if exemplars := append(timed, untimed...); len(exemplars) > 0 {
+			ret = append(ret, QueryResult{SeriesLabels: s.labels, Exemplars: exemplars})
+		}
+	}
+	return ret, nil
+}
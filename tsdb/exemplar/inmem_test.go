@@ -0,0 +1,92 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package exemplar
+
+import (
+	"context"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/prometheus/prometheus/pkg/exemplar"
+	"github.com/prometheus/prometheus/pkg/labels"
+)
+
+func TestInMemSelectTimeRange(t *testing.T) {
+	es := NewInMemExemplarStorage()
+
+	l := labels.FromStrings("service", "asdf")
+	timed := []exemplar.Exemplar{
+		{Labels: labels.FromStrings("traceID", "a"), Value: 1, Ts: 10, HasTs: true},
+		{Labels: labels.FromStrings("traceID", "b"), Value: 2, Ts: 20, HasTs: true},
+		{Labels: labels.FromStrings("traceID", "c"), Value: 3, Ts: 30, HasTs: true},
+	}
+	untimed := exemplar.Exemplar{Labels: labels.FromStrings("traceID", "d"), Value: 4}
+	// Append out of insertion order to check the result is sorted.
+	require.NoError(t, es.AddExemplar(l, timed[1]))
+	require.NoError(t, es.AddExemplar(l, untimed))
+	require.NoError(t, es.AddExemplar(l, timed[0]))
+	require.NoError(t, es.AddExemplar(l, timed[2]))
+
+	matchers := [][]*labels.Matcher{{
+		{Type: labels.MatchEqual, Name: "service", Value: "asdf"},
+	}}
+
+	// Bounded queries filter by [start, end] and exclude untimestamped
+	// exemplars, which cannot be placed in a window.
+	ret, err := es.Select(context.Background(), 10, 20, matchers...)
+	require.NoError(t, err)
+	require.Len(t, ret, 1)
+	require.Equal(t, []exemplar.Exemplar{timed[0], timed[1]}, ret[0].Exemplars)
+
+	ret, err = es.Select(context.Background(), 31, 100, matchers...)
+	require.NoError(t, err)
+	require.Len(t, ret, 0)
+
+	// The unbounded query returns everything, untimestamped last.
+	ret, err = es.Select(context.Background(), math.MinInt64, math.MaxInt64, matchers...)
+	require.NoError(t, err)
+	require.Len(t, ret, 1)
+	require.Equal(t, []exemplar.Exemplar{timed[0], timed[1], timed[2], untimed}, ret[0].Exemplars)
+
+	// Non-matching matchers return nothing.
+	ret, err = es.Select(context.Background(), 0, 100, [][]*labels.Matcher{{
+		{Type: labels.MatchEqual, Name: "service", Value: "other"},
+	}}...)
+	require.NoError(t, err)
+	require.Len(t, ret, 0)
+}
+
+func TestInMemClearSeries(t *testing.T) {
+	es := NewInMemExemplarStorage()
+
+	l1 := labels.FromStrings("service", "asdf")
+	l2 := labels.FromStrings("service", "qwer")
+	for _, l := range []labels.Labels{l1, l2} {
+		require.NoError(t, es.AddExemplar(l, exemplar.Exemplar{
+			Labels: labels.FromStrings("traceID", "abc"),
+			Value:  1,
+			Ts:     1,
+			HasTs:  true,
+		}))
+	}
+
+	es.ClearSeries(l1)
+
+	ret, err := es.Select(context.Background(), 0, 100, []*labels.Matcher{})
+	require.NoError(t, err)
+	require.Len(t, ret, 1)
+	require.Equal(t, l2, ret[0].SeriesLabels)
+}
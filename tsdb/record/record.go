@@ -20,6 +20,7 @@ import (
 
 	"github.com/pkg/errors"
 
+	"github.com/prometheus/prometheus/pkg/exemplar"
 	"github.com/prometheus/prometheus/pkg/labels"
 	"github.com/prometheus/prometheus/tsdb/encoding"
 	"github.com/prometheus/prometheus/tsdb/tombstones"
@@ -37,6 +38,8 @@ const (
 	Samples Type = 2
 	// Tombstones is used to match WAL records of type Tombstones.
 	Tombstones Type = 3
+	// Exemplars is used to match WAL records of type Exemplars.
+	Exemplars Type = 4
 )
 
 var (
@@ -57,6 +60,14 @@ type RefSample struct {
 	V   float64
 }
 
+// SeriesExemplar is an exemplar paired with the labels of the series it
+// belongs to. Exemplars are keyed by series labels rather than series
+// references since exemplar storage is independent of the head series.
+type SeriesExemplar struct {
+	SeriesLabels labels.Labels
+	E            exemplar.Exemplar
+}
+
 // Decoder decodes series, sample, and tombstone records.
 // The zero value is ready to use.
 type Decoder struct {
@@ -69,7 +80,7 @@ func (d *Decoder) Type(rec []byte) Type {
 		return Unknown
 	}
 	switch t := Type(rec[0]); t {
-	case Series, Samples, Tombstones:
+	case Series, Samples, Tombstones, Exemplars:
 		return t
 	}
 	return Unknown
@@ -166,6 +177,49 @@ func (d *Decoder) Tombstones(rec []byte, tstones []tombstones.Stone) ([]tombston
 	return tstones, nil
 }
 
+// Exemplars appends exemplars in rec to the given slice.
+func (d *Decoder) Exemplars(rec []byte, exemplars []SeriesExemplar) ([]SeriesExemplar, error) {
+	dec := encoding.Decbuf{B: rec}
+
+	if Type(dec.Byte()) != Exemplars {
+		return nil, errors.New("invalid record type")
+	}
+	for len(dec.B) > 0 && dec.Err() == nil {
+		slset := make(labels.Labels, dec.Uvarint())
+		for i := range slset {
+			slset[i].Name = dec.UvarintStr()
+			slset[i].Value = dec.UvarintStr()
+		}
+		sort.Sort(slset)
+
+		elset := make(labels.Labels, dec.Uvarint())
+		for i := range elset {
+			elset[i].Name = dec.UvarintStr()
+			elset[i].Value = dec.UvarintStr()
+		}
+		sort.Sort(elset)
+
+		e := exemplar.Exemplar{
+			Labels: elset,
+			Value:  math.Float64frombits(dec.Be64()),
+			HasTs:  dec.Byte() != 0,
+		}
+		e.Ts = dec.Varint64()
+
+		exemplars = append(exemplars, SeriesExemplar{
+			SeriesLabels: slset,
+			E:            e,
+		})
+	}
+	if dec.Err() != nil {
+		return nil, errors.Wrapf(dec.Err(), "decode error after %d exemplars", len(exemplars))
+	}
+	if len(dec.B) > 0 {
+		return nil, errors.Errorf("unexpected %d bytes left in entry", len(dec.B))
+	}
+	return exemplars, nil
+}
+
 // Encoder encodes series, sample, and tombstones records.
 // The zero value is ready to use.
 type Encoder struct {
@@ -212,6 +266,35 @@ func (e *Encoder) Samples(samples []RefSample, b []byte) []byte {
 	return buf.Get()
 }
 
+// Exemplars appends the encoded exemplars to b and returns the resulting slice.
+func (e *Encoder) Exemplars(exemplars []SeriesExemplar, b []byte) []byte {
+	buf := encoding.Encbuf{B: b}
+	buf.PutByte(byte(Exemplars))
+
+	for _, ex := range exemplars {
+		buf.PutUvarint(len(ex.SeriesLabels))
+		for _, l := range ex.SeriesLabels {
+			buf.PutUvarintStr(l.Name)
+			buf.PutUvarintStr(l.Value)
+		}
+
+		buf.PutUvarint(len(ex.E.Labels))
+		for _, l := range ex.E.Labels {
+			buf.PutUvarintStr(l.Name)
+			buf.PutUvarintStr(l.Value)
+		}
+
+		buf.PutBE64(math.Float64bits(ex.E.Value))
+		if ex.E.HasTs {
+			buf.PutByte(1)
+		} else {
+			buf.PutByte(0)
+		}
+		buf.PutVarint64(ex.E.Ts)
+	}
+	return buf.Get()
+}
+
 // Tombstones appends the encoded tombstones to b and returns the resulting slice.
 func (e *Encoder) Tombstones(tstones []tombstones.Stone, b []byte) []byte {
 	buf := encoding.Encbuf{B: b}
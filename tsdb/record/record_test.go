@@ -20,6 +20,7 @@ import (
 	"github.com/pkg/errors"
 	"github.com/stretchr/testify/require"
 
+	"github.com/prometheus/prometheus/pkg/exemplar"
 	"github.com/prometheus/prometheus/pkg/labels"
 	"github.com/prometheus/prometheus/tsdb/encoding"
 	"github.com/prometheus/prometheus/tsdb/tombstones"
@@ -74,6 +75,28 @@ func TestRecord_EncodeDecode(t *testing.T) {
 		{Ref: 13, Intervals: tombstones.Intervals{{Mint: -1000, Maxt: -11}}},
 		{Ref: 13, Intervals: tombstones.Intervals{{Mint: 5000, Maxt: 1000}}},
 	}, decTstones)
+
+	exemplars := []SeriesExemplar{
+		{
+			SeriesLabels: labels.FromStrings("abc", "def", "123", "456"),
+			E: exemplar.Exemplar{
+				Labels: labels.FromStrings("traceID", "qwerty"),
+				Value:  0.1,
+				HasTs:  true,
+				Ts:     12345,
+			},
+		},
+		{
+			SeriesLabels: labels.FromStrings("xyz", "def", "foo", "bar"),
+			E: exemplar.Exemplar{
+				Labels: labels.FromStrings("traceID", "zxcvb"),
+				Value:  -1,
+			},
+		},
+	}
+	decExemplars, err := dec.Exemplars(enc.Exemplars(exemplars, nil), nil)
+	require.NoError(t, err)
+	require.Equal(t, exemplars, decExemplars)
 }
 
 // TestRecord_Corrupted ensures that corrupted records return the correct error.
@@ -53,13 +53,13 @@ var scenarios = map[string]struct {
 	"invalid params from the beginning": {
 		params: "match[]=-not-a-valid-metric-name",
 		code:   400,
-		body: `1:1: parse error: unexpected <op:->
+		body: `parsing metric selector "-not-a-valid-metric-name": 1:1: parse error: unexpected <op:->
 `,
 	},
 	"invalid params somewhere in the middle": {
 		params: "match[]=not-a-valid-metric-name",
 		code:   400,
-		body: `1:4: parse error: unexpected <op:->
+		body: `parsing metric selector "not-a-valid-metric-name": 1:4: parse error: unexpected <op:->
 `,
 	},
 	"test_metric1": {